@@ -1,41 +1,229 @@
 package compiler
 
 import (
+	"arlindohall/glua/constants"
 	"arlindohall/glua/glerror"
 	"arlindohall/glua/scanner"
 	"arlindohall/glua/value"
 	"fmt"
-	"os"
+	"io"
 )
 
 type Node interface {
 	Emit(compiler *compiler)
-	printTree(indent int)
+	printTree(out io.Writer, indent int)
 	assign(compiler *compiler) Node
 }
 
-func PrintTree(node *Node) {
-	(*node).printTree(0)
+// The Emit method of an expression leaves its value in the next free
+// register, emitTo puts it in a register that is already allocated
+type expression interface {
+	Node
+	emitTo(compiler *compiler, register int)
+}
+
+// Assignment targets aren't emitted, they store a value that is in a
+// register or is an RK constant
+type assignable interface {
+	store(compiler *compiler, source int)
+}
+
+func (compiler *compiler) emitTo(node Node, register int) {
+	if compiler.optimizing(optimizeFold) {
+		if val, ok := compiler.fold(node); ok {
+			compiler.emitLoadConstant(register, val, compiler.literalSpan(node))
+			return
+		}
+	}
+
+	node.(expression).emitTo(compiler, register)
+}
+
+// Locals are used in their own register and literals with a small enough
+// constant index are RK operands, anything else is evaluated into a new
+// register which the caller frees
+func (compiler *compiler) operand(node Node) int {
+	if val, ok := compiler.constantValue(node); ok {
+		if operand, ok := compiler.constantOperand(val, compiler.literalSpan(node)); ok {
+			return operand
+		}
+	}
+
+	return compiler.register(node)
+}
+
+// Like operand, for an instruction that writes to `register`. When that is a
+// temporary nothing else lives there, so an operand that has to be evaluated
+// is put straight in it instead of taking another register
+func (compiler *compiler) operandInto(node Node, register int) int {
+	if !compiler.isTemporary(register) || compiler.isOperand(node) {
+		return compiler.operand(node)
+	}
+
+	compiler.emitTo(node, register)
+	return register
+}
+
+func (compiler *compiler) isOperand(node Node) bool {
+	if _, ok := compiler.localRegister(node); ok {
+		return true
+	}
+
+	val, ok := compiler.constantValue(node)
+	if !ok {
+		return false
+	}
+
+	_, ok = compiler.constantOperand(val, compiler.literalSpan(node))
+	return ok
+}
+
+// Like operand, for instructions that only take registers
+func (compiler *compiler) register(node Node) int {
+	if local, ok := compiler.localRegister(node); ok {
+		return local
+	}
+
+	register := compiler.registers
+	node.Emit(compiler)
+
+	return register
+}
+
+func (compiler *compiler) localRegister(node Node) (int, bool) {
+	primary, ok := node.(VariablePrimary)
+	if !ok {
+		return 0, false
+	}
+
+	local := compiler.getLocal(primary.name)
+	if local == -1 || compiler.locals[local].constant != nil {
+		return 0, false
+	}
+
+	return local, true
+}
+
+// Literals and <const> variables are known while compiling, and when
+// optimizing so are operations on them
+func (compiler *compiler) constantValue(node Node) (value.Value, bool) {
+	switch node := node.(type) {
+	case LiteralPrimary:
+		return node.value, true
+	case VariablePrimary:
+		if constant := compiler.variableConstant(node.name); constant != nil {
+			return *constant, true
+		}
+	default:
+		if compiler.optimizing(optimizeFold) {
+			return compiler.fold(node)
+		}
+	}
+
+	return value.Nil(), false
+}
+
+// Errors about a literal's constant point at the literal, other constants
+// belong to the node being emitted
+func (compiler *compiler) literalSpan(node Node) glerror.Span {
+	if literal, ok := node.(LiteralPrimary); ok && literal.span != (glerror.Span{}) {
+		return literal.span
+	}
+
+	return compiler.position
+}
+
+func (compiler *compiler) variableConstant(name Identifier) *value.Value {
+	if local := compiler.getLocal(name); local != -1 {
+		return compiler.locals[local].constant
+	}
+
+	if upvalue := compiler.getUpvalue(name); upvalue != -1 {
+		return compiler.upvalues[upvalue].constant
+	}
+
+	return nil
+}
+
+// Moves a register or RK constant into the destination register
+func (compiler *compiler) emitMove(dest, source int) {
+	switch {
+	case IsConstant(source):
+		compiler.emitABx(OpConstant, dest, ConstantIndex(source))
+	case source != dest:
+		compiler.emitABC(OpMove, dest, source, 0)
+	}
+}
+
+// Evaluates the values into `want` registers starting at the next free one,
+// as the right hand side of an assignment. A call in the last position fills
+// the registers that are left with its results, missing values are nil and
+// extra values are evaluated and dropped
+func (compiler *compiler) emitValues(values []Node, want int) {
+	register := compiler.registers
+
+	for i, val := range values {
+		call, ok := val.(*Call)
+		if ok && call.isAssignment && i == len(values)-1 && i < want {
+			call.emitCall(compiler, want-i)
+		} else {
+			val.Emit(compiler)
+		}
+	}
+
+	if missing := want - (compiler.registers - register); missing > 0 {
+		compiler.emitABC(OpNil, compiler.allocate(missing), missing, 0)
+	}
+
+	compiler.free(register + want)
+}
+
+func PrintTree(out io.Writer, node *Node) {
+	(*node).printTree(out, 0)
 }
 
 type FunctionNode struct {
 	name       Identifier
 	parameters []Identifier
 	body       Node
+	span       glerror.Span
 }
 
 func (function FunctionNode) Emit(parent *compiler) {
+	parent.at(function.span)
+	child := function.compile(parent)
+
+	compiledFunction, err := child.end()
+
+	if !err.IsEmpty() {
+		parent.err.AppendAll(&err)
+		return
+	}
+
+	register := parent.allocate(1)
+	makeClosure(parent, compiledFunction, register)
+
+	if parent.scope > 0 {
+		parent.addLocal(function.name)
+	} else {
+		parent.emitSetGlobal(function.name, register)
+		parent.free(register)
+	}
+}
 
+func (function FunctionNode) compile(parent *compiler) *compiler {
 	child := &compiler{
-		text:   parent.text,
-		curr:   parent.curr,
-		chunk:  value.Chunk{},
-		name:   string(function.name),
-		locals: nil,
-		scope:  0,
-		err:    glerror.GluaErrorChain{},
-		mode:   parent.mode,
-		parent: parent,
+		tokens:   parent.tokens,
+		chunk:    value.Chunk{Source: parent.chunk.Source},
+		name:     string(function.name),
+		locals:   nil,
+		scope:    0,
+		err:      glerror.GluaErrorChain{},
+		mode:     parent.mode,
+		parent:   parent,
+		position: parent.position,
+		emitting: true,
+		options:  parent.options,
 	}
 
 	// Do not set function name so that base is not accessible
@@ -44,42 +232,28 @@ func (function FunctionNode) Emit(parent *compiler) {
 		child.addLocal(param)
 	}
 
-	function.body.Emit(child)
-
-	compiledFunction, err := child.end()
+	// The function and its arguments are in place when it is called
+	child.allocate(len(child.locals))
+	child.chunk.Arity = len(function.parameters)
 
-	if !err.IsEmpty() {
-		parent.err.AppendAll(&err)
-		return
-	}
+	function.body.Emit(child)
 
-	if parent.scope > 0 {
-		parent.locals = append(parent.locals, Local{function.name, parent.scope})
-		makeClosure(parent, compiledFunction)
-	} else {
-		parent.emitByte(OpAssignStart)
-		fn := parent.makeConstant(value.StringVal(function.name))
-		makeClosure(parent, compiledFunction)
-		parent.emitBytes(OpSetGlobal, fn)
-		parent.emitByte(OpAssignCleanup)
-	}
+	return child
 }
 
 // todo: is there a way to emit the closure without the constant?
 // we could key them to the instruction that creates them and look
 // the compiled functions in a map??
-func makeClosure(compiler *compiler, function Function) {
-	c := compiler.makeConstant(value.NewClosure(function.Chunk, function.Name))
-	compiler.emitBytes(OpConstant, c)
-	compiler.emitByte(OpClosure)
+func makeClosure(compiler *compiler, function Function, register int) {
+	c := compiler.makeConstant(value.ClosureValue(value.NewClosure(function.Chunk, function.Name)), compiler.position)
+	compiler.emitABx(OpClosure, register, c)
 
 	for _, upvalue := range function.Upvalues {
-		compiler.emitBytes(OpCreateUpvalue, byte(upvalue.index))
-		compiler.emitByte(toByte(upvalue.isLocal))
+		compiler.emitABC(OpCreateUpvalue, register, upvalue.index, toInt(upvalue.isLocal))
 	}
 }
 
-func toByte(b bool) byte {
+func toInt(b bool) int {
 	if b {
 		return 1
 	} else {
@@ -87,17 +261,17 @@ func toByte(b bool) byte {
 	}
 }
 
-func (function FunctionNode) printTree(indent int) {
-	printIndent(indent, "Function")
-	printIndent(indent+1, function.name)
+func (function FunctionNode) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "Function")
+	printIndent(out, indent+1, function.name)
 
-	printIndent(indent+1, "Parameters")
+	printIndent(out, indent+1, "Parameters")
 	for _, p := range function.parameters {
-		printIndent(indent+2, p)
+		printIndent(out, indent+2, p)
 	}
 
-	printIndent(indent+1, "Body")
-	function.body.printTree(indent + 2)
+	printIndent(out, indent+1, "Body")
+	function.body.printTree(out, indent+2)
 }
 
 func (function FunctionNode) assign(compiler *compiler) Node {
@@ -110,29 +284,25 @@ type GlobalDeclaration struct {
 }
 
 func (declaration GlobalDeclaration) Emit(compiler *compiler) {
-	compiler.emitByte(OpAssignStart)
-
-	for _, value := range declaration.values {
-		value.Emit(compiler)
-	}
+	register := compiler.registers
+	compiler.emitValues(declaration.values, len(declaration.names))
 
-	for _, name := range declaration.names {
-		b := compiler.makeConstant(value.StringVal(name))
-		compiler.emitBytes(OpSetGlobal, b)
+	for i, name := range declaration.names {
+		compiler.emitSetGlobal(name, register+i)
 	}
 
-	compiler.emitByte(OpAssignCleanup)
+	compiler.free(register)
 }
 
-func (declaration GlobalDeclaration) printTree(indent int) {
-	printIndent(indent, "GlobalDeclaration")
+func (declaration GlobalDeclaration) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "GlobalDeclaration")
 
 	for _, name := range declaration.names {
-		printIndent(indent+1, string(name))
+		printIndent(out, indent+1, string(name))
 	}
 
 	for _, value := range declaration.values {
-		value.printTree(indent + 1)
+		value.printTree(out, indent+1)
 	}
 }
 
@@ -143,38 +313,90 @@ func (declaration GlobalDeclaration) assign(compiler *compiler) Node {
 }
 
 type LocalDeclaration struct {
-	names  []Identifier
-	values []Node
+	names   []Identifier
+	attribs []Attribute
+	values  []Node
 }
 
+// The values are evaluated into the registers after the locals in scope,
+// which then become the registers of the new locals
 func (declaration LocalDeclaration) Emit(compiler *compiler) {
-	compiler.emitBytes(OpLocalAllocate, byte(len(declaration.names)))
+	if len(declaration.names) > maxLocals {
+		compiler.error(fmt.Sprint("Too many variables in local declaration, limit is ", maxLocals))
+	}
 
-	for _, value := range declaration.values {
-		value.Emit(compiler)
+	register := compiler.registers
+	compiler.emitValues(declaration.values, len(declaration.names))
+
+	// The values are known before the new locals hide any they read
+	constants := make([]*value.Value, len(declaration.names))
+	for i := range declaration.names {
+		constants[i] = declaration.constant(i, compiler.variableConstant)
 	}
 
-	for _, name := range declaration.names {
+	for i, name := range declaration.names {
 		compiler.addLocal(name)
+
+		local := &compiler.locals[len(compiler.locals)-1]
+		local.attrib = declaration.attribute(i)
+		local.constant = constants[i]
 	}
 
-	compiler.emitByte(OpLocalCleanup)
+	// Register to-be-closed variables only once they hold their value
+	for i, name := range declaration.names {
+		if declaration.attribute(i) == AttribClose {
+			compiler.emitABx(OpMarkClose, register+i, compiler.makeConstant(value.StringVal(string(name)), compiler.position))
+		}
+	}
+}
+
+func (declaration LocalDeclaration) attribute(i int) Attribute {
+	if i < len(declaration.attribs) {
+		return declaration.attribs[i]
+	}
+
+	return AttribNone
+}
+
+// Only <const> locals initialized with a constant expression can be folded,
+// anything else still needs to be computed at runtime
+func (declaration LocalDeclaration) constant(i int, variableConstant func(Identifier) *value.Value) *value.Value {
+	if declaration.attribute(i) != AttribConst || i >= len(declaration.values) {
+		return nil
+	}
+
+	if val, ok := constantExpression(declaration.values[i], variableConstant); ok {
+		return &val
+	}
+
+	return nil
 }
 
 func (compiler *compiler) addLocal(name Identifier) {
-	local := Local{name, compiler.scope}
+	if len(compiler.locals) >= maxLocals {
+		compiler.error(fmt.Sprint("Too many local variables in function, limit is ", maxLocals))
+	}
+
+	local := Local{name: name, scope: compiler.scope}
 	compiler.locals = append(compiler.locals, local)
 }
 
-func (declaration LocalDeclaration) printTree(indent int) {
-	printIndent(indent, "LocalDeclaration")
+func (declaration LocalDeclaration) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "LocalDeclaration")
 
-	for _, name := range declaration.names {
-		printIndent(indent+1, string(name))
+	for i, name := range declaration.names {
+		switch declaration.attribute(i) {
+		case AttribConst:
+			printIndent(out, indent+1, fmt.Sprintf("%s <const>", name))
+		case AttribClose:
+			printIndent(out, indent+1, fmt.Sprintf("%s <close>", name))
+		default:
+			printIndent(out, indent+1, string(name))
+		}
 	}
 
 	for _, value := range declaration.values {
-		value.printTree(indent + 1)
+		value.printTree(out, indent+1)
 	}
 }
 
@@ -190,27 +412,58 @@ type WhileStatement struct {
 }
 
 func (statement WhileStatement) Emit(compiler *compiler) {
+	if condition, ok := compiler.constantCondition(statement.condition); ok {
+		statement.emitConstant(compiler, condition)
+		return
+	}
+
 	loopTo := compiler.chunkSize()
-	statement.condition.Emit(compiler)
+	jumpFrom := compiler.emitTest(statement.condition)
+
+	compiler.startLoop()
+	statement.body.Emit(compiler)
 
-	jumpFrom := compiler.chunkSize()
-	compiler.emitJump(OpJumpIfFalse)
+	compiler.emitLoop(loopTo)
+	compiler.patchJump(jumpFrom, compiler.chunkSize())
+	compiler.endLoop()
+}
+
+// A loop that always runs needs no test and one that never runs is dropped
+func (statement WhileStatement) emitConstant(compiler *compiler, condition bool) {
+	compiler.startLoop()
+	defer compiler.endLoop()
 
+	if !condition {
+		compiler.emitUnreachable(statement.body)
+		return
+	}
+
+	loopTo := compiler.chunkSize()
 	statement.body.Emit(compiler)
+	compiler.emitLoop(loopTo)
+}
+
+// Emits the condition followed by a jump that is taken if it's false, for
+// the caller to patch
+func (compiler *compiler) emitTest(condition Node) int {
+	if compiler.emitTestComparison(condition) {
+		return compiler.emitJump()
+	}
 
-	loopFrom := compiler.chunkSize()
-	compiler.emitJump(OpLoop)
-	jumpTo := compiler.chunkSize()
+	top := compiler.registers
+	register := compiler.register(condition)
 
-	compiler.patchJump(loopFrom, loopTo)
-	compiler.patchJump(jumpFrom, jumpTo)
+	compiler.emitABC(OpTest, register, 0, 0)
+	compiler.free(top)
+
+	return compiler.emitJump()
 }
 
-func (statement WhileStatement) printTree(indent int) {
-	printIndent(indent, "While")
-	statement.condition.printTree(indent + 1)
+func (statement WhileStatement) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "While")
+	statement.condition.printTree(out, indent+1)
 
-	statement.body.printTree(indent + 1)
+	statement.body.printTree(out, indent+1)
 }
 
 func (statement WhileStatement) assign(compiler *compiler) Node {
@@ -228,27 +481,30 @@ type NumericForStatement struct {
 // bounds checks but if we don't inline them, it's less code which
 // would also mean less loading from memory
 func (statement NumericForStatement) Emit(compiler *compiler) {
+	compiler.startLoop()
+
 	for _, val := range statement.values {
 		compiler.startScope()
-		compiler.addLocal(statement.variable)
 		val.Emit(compiler)
+		compiler.addLocal(statement.variable)
 
 		statement.body.Emit(compiler)
 
-		compiler.emitByte(OpPop)
 		compiler.endScope()
 	}
+
+	compiler.endLoop()
 }
 
-func (statement NumericForStatement) printTree(indent int) {
-	printIndent(indent, "NumericFor")
-	printIndent(indent+1, string(statement.variable))
+func (statement NumericForStatement) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "NumericFor")
+	printIndent(out, indent+1, string(statement.variable))
 
 	for _, val := range statement.values {
-		val.printTree(indent + 2)
+		val.printTree(out, indent+2)
 	}
 
-	statement.body.printTree(indent + 1)
+	statement.body.printTree(out, indent+1)
 }
 
 func (statement NumericForStatement) assign(compiler *compiler) Node {
@@ -260,6 +516,7 @@ type GenericForStatement struct {
 	targets  []Identifier
 	iterator []Node
 	body     Node
+	span     glerror.Span
 }
 
 /**
@@ -307,14 +564,25 @@ func (statement GenericForStatement) Emit(compiler *compiler) {
 	// Just convert the for loop to the equivalent while statement
 	compiler.startScope()
 
+	transform := statement.transform()
+	if compiler.options.DumpAst {
+		transform.printTree(compiler.options.Writer(), 0)
+	}
+	transform.Emit(compiler)
+
+	compiler.endScope()
+}
+
+func (statement GenericForStatement) transform() BlockStatement {
 	loopInit := LocalDeclaration{
 		names:  []Identifier{"#f", "#s", "#var"},
 		values: statement.iterator,
 	}
 
 	call := &Call{
-		base:      VariablePrimary{"#f"},
+		base:      VariablePrimary{"#f", statement.span},
 		arguments: []Node{},
+		span:      statement.span,
 	}
 
 	varInit := LocalDeclaration{
@@ -324,7 +592,7 @@ func (statement GenericForStatement) Emit(compiler *compiler) {
 
 	var locals []Node
 	for _, target := range statement.targets {
-		locals = append(locals, VariablePrimary{target})
+		locals = append(locals, VariablePrimary{target, statement.span})
 	}
 
 	varUpdate := MultipleAssignment{
@@ -333,41 +601,36 @@ func (statement GenericForStatement) Emit(compiler *compiler) {
 	}
 
 	loopCondUpdate := MultipleAssignment{
-		variables: []Node{VariablePrimary{Identifier("#var")}},
-		values:    []Node{VariablePrimary{statement.targets[0]}},
+		variables: []Node{VariablePrimary{"#var", statement.span}},
+		values:    []Node{VariablePrimary{statement.targets[0], statement.span}},
 	}
 
 	body := BlockStatement{[]Node{statement.body, varUpdate, loopCondUpdate}}
 
 	whileStatement := WhileStatement{
-		condition: VariablePrimary{"#var"},
+		condition: VariablePrimary{"#var", statement.span},
 		body:      body,
 	}
 
-	transform := BlockStatement{[]Node{
+	return BlockStatement{[]Node{
 		loopInit, varInit, loopCondUpdate, whileStatement,
 	}}
-
-	transform.printTree(0)
-	transform.Emit(compiler)
-
-	compiler.endScope()
 }
 
-func (statement GenericForStatement) printTree(indent int) {
-	printIndent(indent, "GenericFor")
+func (statement GenericForStatement) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "GenericFor")
 
-	printIndent(indent+1, "Targets")
+	printIndent(out, indent+1, "Targets")
 	for _, target := range statement.targets {
-		printIndent(indent+2, string(target))
+		printIndent(out, indent+2, string(target))
 	}
 
-	printIndent(indent+1, "Iterator")
+	printIndent(out, indent+1, "Iterator")
 	for _, it := range statement.iterator {
-		it.printTree(indent + 2)
+		it.printTree(out, indent+2)
 	}
 
-	statement.body.printTree(indent + 1)
+	statement.body.printTree(out, indent+1)
 }
 
 func (statement GenericForStatement) assign(compiler *compiler) Node {
@@ -382,38 +645,53 @@ type IfStatement struct {
 }
 
 func (statement IfStatement) Emit(compiler *compiler) {
-	statement.condition.Emit(compiler)
+	if condition, ok := compiler.constantCondition(statement.condition); ok {
+		statement.emitConstant(compiler, condition)
+		return
+	}
 
-	jumpFromIfFalse := compiler.chunkSize()
-	compiler.emitJump(OpJumpIfFalse)
+	jumpFromIfFalse := compiler.emitTest(statement.condition)
 
 	statement.body.Emit(compiler)
 	jumpToIfFalse := compiler.chunkSize()
 
 	if statement.counterfactual != nil {
-		compiler.emitByte(OpNil)
-		jumpFromIfTrue := compiler.chunkSize()
-		compiler.emitJump(OpJumpIfFalse)
+		jumpFromIfTrue := compiler.emitJump()
 
 		// We jump past the else jump if there's a counterfactual
 		jumpToIfFalse = compiler.chunkSize()
 
 		statement.counterfactual.Emit(compiler)
-		jumpToIfTrue := compiler.chunkSize()
-		compiler.patchJump(jumpFromIfTrue, jumpToIfTrue)
+		compiler.patchJump(jumpFromIfTrue, compiler.chunkSize())
 	}
 
 	compiler.patchJump(jumpFromIfFalse, jumpToIfFalse)
 }
 
-func (statement IfStatement) printTree(indent int) {
-	printIndent(indent, "If")
-	statement.condition.printTree(indent + 1)
-	statement.body.printTree(indent + 1)
+// Only the branch that is taken is kept
+func (statement IfStatement) emitConstant(compiler *compiler, condition bool) {
+	taken, dropped := statement.body, statement.counterfactual
+	if !condition {
+		taken, dropped = dropped, taken
+	}
+
+	if dropped != nil {
+		compiler.emitUnreachable(dropped)
+	}
+
+	if taken != nil {
+		taken.Emit(compiler)
+	}
+}
+
+func (statement IfStatement) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "If")
+	statement.condition.printTree(out, indent+1)
+	statement.body.printTree(out, indent+1)
 
 	if statement.counterfactual != nil {
-		printIndent(indent+1, "Else")
-		statement.counterfactual.printTree(indent + 2)
+		printIndent(out, indent+1, "Else")
+		statement.counterfactual.printTree(out, indent+2)
 	}
 }
 
@@ -423,23 +701,60 @@ func (statement IfStatement) assign(compiler *compiler) Node {
 }
 
 type ReturnStatement struct {
-	arity  byte
 	values []Node
 }
 
 func (statement ReturnStatement) Emit(compiler *compiler) {
-	for _, value := range statement.values {
-		value.Emit(compiler)
+	if call, ok := statement.tailCall(); ok && !compiler.hasCloseVariables() {
+		call.emitTailCall(compiler)
+		return
+	}
+
+	// A local can be returned from its own register
+	if len(statement.values) == 1 {
+		if local, ok := compiler.localRegister(statement.values[0]); ok {
+			compiler.emitABC(OpReturn, local, 2, 0)
+			return
+		}
+	}
+
+	register := compiler.registers
+	for _, val := range statement.values {
+		val.Emit(compiler)
+	}
+
+	compiler.emitABC(OpReturn, register, len(statement.values)+1, 0)
+	compiler.free(register)
+}
+
+// `return f(args)` reuses the returning function's frame for the call, so
+// tail recursion runs in constant stack space
+func (statement ReturnStatement) tailCall() (*Call, bool) {
+	if len(statement.values) != 1 {
+		return nil, false
+	}
+
+	call, ok := statement.values[0].(*Call)
+	return call, ok
+}
+
+// To-be-closed variables are closed after the return values are computed,
+// which a tail call can't wait for
+func (compiler *compiler) hasCloseVariables() bool {
+	for _, local := range compiler.locals {
+		if local.attrib == AttribClose {
+			return true
+		}
 	}
 
-	compiler.emitBytes(OpReturn, statement.arity)
+	return false
 }
 
-func (statement ReturnStatement) printTree(indent int) {
-	printIndent(indent, "Return")
+func (statement ReturnStatement) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "Return")
 
 	for _, value := range statement.values {
-		value.printTree(indent + 1)
+		value.printTree(out, indent+1)
 	}
 }
 
@@ -448,18 +763,90 @@ func (statement ReturnStatement) assign(compiler *compiler) Node {
 	return statement
 }
 
+// The loop a break leaves, the scope it started in and the jumps to its end
+type loop struct {
+	scope  int
+	breaks []int
+}
+
+type BreakStatement struct{}
+
+// Like endScope, the locals of the loop that were captured or are to be
+// closed are closed before jumping out of it. A closure made after the break
+// in the loop only ever captures the locals of a later iteration
+func (statement BreakStatement) Emit(compiler *compiler) {
+	loop := &compiler.loops[len(compiler.loops)-1]
+
+	var stackTop int
+	for stackTop = 0; stackTop < len(compiler.locals); stackTop++ {
+		if compiler.locals[stackTop].scope > loop.scope {
+			break
+		}
+	}
+
+	for _, local := range compiler.locals[stackTop:] {
+		if local.captured || local.attrib == AttribClose {
+			compiler.emitABC(OpCloseUpvalues, stackTop, 0, 0)
+			break
+		}
+	}
+
+	loop.breaks = append(loop.breaks, compiler.emitJump())
+}
+
+func (compiler *compiler) startLoop() {
+	compiler.loops = append(compiler.loops, loop{scope: compiler.scope})
+}
+
+// The breaks jump to whatever comes after the loop
+func (compiler *compiler) endLoop() {
+	last := len(compiler.loops) - 1
+
+	for _, jump := range compiler.loops[last].breaks {
+		compiler.patchJump(jump, compiler.chunkSize())
+	}
+
+	compiler.loops = compiler.loops[:last]
+}
+
+func (statement BreakStatement) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "Break")
+}
+
+func (statement BreakStatement) assign(compiler *compiler) Node {
+	compiler.error("Cannot assign to break statement")
+	return statement
+}
+
 type BlockStatement struct {
 	statements []Node
 }
 
 func (statement BlockStatement) Emit(compiler *compiler) {
 	compiler.startScope()
-	for _, st := range statement.statements {
+	for i, st := range statement.statements {
 		st.Emit(compiler)
+
+		if endsBlock(st) && compiler.optimizing(optimizeFold) {
+			for _, unreachable := range statement.statements[i+1:] {
+				compiler.emitUnreachable(unreachable)
+			}
+
+			break
+		}
 	}
 	compiler.endScope()
 }
 
+func endsBlock(statement Node) bool {
+	switch statement.(type) {
+	case ReturnStatement, BreakStatement:
+		return true
+	default:
+		return false
+	}
+}
+
 func (compiler *compiler) startScope() {
 	compiler.scope += 1
 }
@@ -476,11 +863,17 @@ func (compiler *compiler) endScope() {
 	}
 
 	// function f() x = 1 do y = 2 end return x end
-	// stack=[..., Function<f>, 1, 2] <- stack with locals, second is in scope
+	// registers=[Function<f>, 1, 2] <- registers of the locals, second is in scope
 	//
 	// to close the upvalue 2, we want to emit close upvalue up to but not
-	// including stackTop
-	compiler.emitBytes(OpCloseUpvalues, byte(stackTop))
+	// including stackTop. Only locals that were captured or are to be closed
+	// need it, the rest are simply forgotten
+	for _, local := range compiler.locals[stackTop:] {
+		if local.captured || local.attrib == AttribClose {
+			compiler.emitABC(OpCloseUpvalues, stackTop, 0, 0)
+			break
+		}
+	}
 
 	// Drop the whole list of locals after that
 	if stackTop == 0 {
@@ -488,13 +881,15 @@ func (compiler *compiler) endScope() {
 	} else {
 		compiler.locals = compiler.locals[0:stackTop]
 	}
+
+	compiler.free(stackTop)
 }
 
-func (statement BlockStatement) printTree(indent int) {
-	printIndent(indent, "Block")
+func (statement BlockStatement) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "Block")
 
 	for _, st := range statement.statements {
-		st.printTree(indent + 1)
+		st.printTree(out, indent+1)
 	}
 }
 
@@ -505,17 +900,25 @@ func (statement BlockStatement) assign(compiler *compiler) Node {
 }
 
 type AssertStatement struct {
-	value Node
+	value   Node
+	message Node
+	span    glerror.Span
 }
 
 func (statement AssertStatement) Emit(compiler *compiler) {
-	statement.value.Emit(compiler)
-	compiler.emitByte(OpAssert)
+	top := compiler.registers
+	register := compiler.register(statement.value)
+	message := compiler.operand(statement.message)
+
+	compiler.at(statement.span)
+	compiler.emitABC(OpAssert, register, message, 0)
+	compiler.free(top)
 }
 
-func (statement AssertStatement) printTree(indent int) {
-	printIndent(indent, "Assert")
-	statement.value.printTree(indent + 1)
+func (statement AssertStatement) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "Assert")
+	statement.value.printTree(out, indent+1)
+	statement.message.printTree(out, indent+1)
 }
 
 func (statement AssertStatement) assign(compiler *compiler) Node {
@@ -528,32 +931,59 @@ type MultipleAssignment struct {
 	values    []Node
 }
 
+// Every value is evaluated before any variable is assigned, so that
+// `a, b = b, a` swaps the two
 func (assignment MultipleAssignment) Emit(compiler *compiler) {
-	compiler.emitByte(OpAssignStart)
+	if len(assignment.variables) == 1 && len(assignment.values) == 1 {
+		assignment.emitSingle(compiler)
+		return
+	}
 
-	for _, value := range assignment.values {
-		value.Emit(compiler)
+	register := compiler.registers
+	compiler.emitValues(assignment.values, len(assignment.variables))
+
+	for i, variable := range assignment.variables {
+		if target, ok := variable.assign(compiler).(assignable); ok {
+			target.store(compiler, register+i)
+		}
 	}
 
-	for _, variable := range assignment.variables {
-		variable.assign(compiler).Emit(compiler)
+	compiler.free(register)
+}
+
+// With a single local variable the value is put straight in its register
+func (assignment MultipleAssignment) emitSingle(compiler *compiler) {
+	register := compiler.registers
+	variable := assignment.variables[0].assign(compiler)
+
+	if local, ok := variable.(VariableAssignment); ok {
+		if slot := compiler.getLocal(local.name); slot != -1 {
+			compiler.at(local.span)
+			compiler.checkAssignable(local.name, compiler.locals[slot].attrib)
+			compiler.emitTo(assignment.values[0], slot)
+			return
+		}
 	}
 
-	compiler.emitByte(OpAssignCleanup)
+	if target, ok := variable.(assignable); ok {
+		target.store(compiler, compiler.operand(assignment.values[0]))
+	}
+
+	compiler.free(register)
 }
 
-func (assignment MultipleAssignment) printTree(indent int) {
-	printIndent(indent, "Assignment")
-	printIndent(indent+1, "Variables")
+func (assignment MultipleAssignment) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "Assignment")
+	printIndent(out, indent+1, "Variables")
 
 	for _, variable := range assignment.variables {
-		variable.printTree(indent + 2)
+		variable.printTree(out, indent+2)
 	}
 
-	printIndent(indent+1, "Values")
+	printIndent(out, indent+1, "Values")
 
 	for _, value := range assignment.values {
-		value.printTree(indent + 2)
+		value.printTree(out, indent+2)
 	}
 }
 
@@ -566,14 +996,28 @@ type Expression struct {
 	expression Node
 }
 
+// The value is dropped, except in the REPL where the last expression is the
+// result of the script
 func (statement Expression) Emit(compiler *compiler) {
-	statement.expression.Emit(compiler)
-	compiler.emitByte(OpPop)
+	register := compiler.registers
+	keep := compiler.mode == constants.ReplMode && compiler.scope == 0
+
+	if call, ok := statement.expression.(*Call); ok && !keep {
+		call.emitCall(compiler, 0)
+	} else {
+		statement.expression.Emit(compiler)
+	}
+
+	if keep {
+		compiler.result = replResult{register, compiler.chunkSize()}
+	}
+
+	compiler.free(register)
 }
 
-func (statement Expression) printTree(indent int) {
-	printIndent(indent, "Expression")
-	statement.expression.printTree(indent + 1)
+func (statement Expression) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "Expression")
+	statement.expression.printTree(out, indent+1)
 }
 
 func (statement Expression) assign(compiler *compiler) Node {
@@ -583,28 +1027,51 @@ func (statement Expression) assign(compiler *compiler) Node {
 
 type VariableAssignment struct {
 	name Identifier
+	span glerror.Span
 }
 
 func (assignment VariableAssignment) Emit(compiler *compiler) {
+	panic("Internal error: assignment targets are stored to, not emitted")
+}
+
+func (assignment VariableAssignment) store(compiler *compiler, source int) {
+	register := compiler.registers
+	compiler.at(assignment.span)
+
 	// todo: determine local/upvalue/global when building AST
 	local := compiler.getLocal(assignment.name)
 	if local != -1 {
-		compiler.emitBytes(OpSetLocal, byte(local))
+		compiler.checkAssignable(assignment.name, compiler.locals[local].attrib)
+		compiler.emitMove(local, source)
 		return
 	}
 
 	upvalue := compiler.getUpvalue(assignment.name)
 	if upvalue != -1 {
-		compiler.emitBytes(OpSetUpvalue, byte(upvalue))
+		compiler.checkAssignable(assignment.name, compiler.upvalues[upvalue].attrib)
+		compiler.emitABC(OpSetUpvalue, compiler.toRegister(source), upvalue, 0)
+		compiler.free(register)
+		return
+	}
+
+	if assignment.name == envName {
+		compiler.error("Cannot assign to _ENV, declare a local _ENV instead")
 		return
 	}
 
-	name := compiler.makeConstant(value.StringVal(assignment.name))
-	compiler.emitBytes(OpSetGlobal, name)
+	compiler.emitSetGlobal(assignment.name, compiler.toRegister(source))
+	compiler.free(register)
+}
+
+// To-be-closed variables are also read-only
+func (compiler *compiler) checkAssignable(name Identifier, attrib Attribute) {
+	if attrib != AttribNone {
+		compiler.error(fmt.Sprintf("Attempt to assign to const variable '%s'", name))
+	}
 }
 
-func (assignment VariableAssignment) printTree(indent int) {
-	printIndent(indent, assignment.name)
+func (assignment VariableAssignment) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, assignment.name)
 }
 
 func (assignment VariableAssignment) assign(compiler *compiler) Node {
@@ -614,18 +1081,27 @@ func (assignment VariableAssignment) assign(compiler *compiler) Node {
 type TableAssignment struct {
 	table     Node
 	attribute Node
+	span      glerror.Span
 }
 
 func (assignment TableAssignment) Emit(compiler *compiler) {
-	assignment.table.Emit(compiler)
-	assignment.attribute.Emit(compiler)
-	compiler.emitByte(OpSetTable)
+	panic("Internal error: assignment targets are stored to, not emitted")
+}
+
+func (assignment TableAssignment) store(compiler *compiler, source int) {
+	register := compiler.registers
+	table := compiler.register(assignment.table)
+	key := compiler.operand(assignment.attribute)
+
+	compiler.at(assignment.span)
+	compiler.emitABC(OpSetTable, table, key, source)
+	compiler.free(register)
 }
 
-func (assignment TableAssignment) printTree(indent int) {
-	printIndent(indent, "AssignTable")
-	assignment.table.printTree(indent + 1)
-	assignment.attribute.printTree(indent + 1)
+func (assignment TableAssignment) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "AssignTable")
+	assignment.table.printTree(out, indent+1)
+	assignment.attribute.printTree(out, indent+1)
 }
 
 func (assignment TableAssignment) assign(compiler *compiler) Node {
@@ -636,19 +1112,27 @@ func (assignment TableAssignment) assign(compiler *compiler) Node {
 type TableAccessor struct {
 	table     Node
 	attribute Node
+	span      glerror.Span
 }
 
 func (accessor TableAccessor) Emit(compiler *compiler) {
-	accessor.table.Emit(compiler)
-	accessor.attribute.Emit(compiler)
+	compiler.emitTo(accessor, compiler.allocate(1))
+}
 
-	compiler.emitByte(OpGetTable)
+func (accessor TableAccessor) emitTo(compiler *compiler, register int) {
+	top := compiler.registers
+	table := compiler.register(accessor.table)
+	key := compiler.operand(accessor.attribute)
+
+	compiler.at(accessor.span)
+	compiler.emitABC(OpGetTable, register, table, key)
+	compiler.free(top)
 }
 
-func (accessor TableAccessor) printTree(indent int) {
-	printIndent(indent, "TableGet")
-	accessor.table.printTree(indent + 1)
-	accessor.attribute.printTree(indent + 1)
+func (accessor TableAccessor) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "TableGet")
+	accessor.table.printTree(out, indent+1)
+	accessor.attribute.printTree(out, indent+1)
 }
 
 func (accessor TableAccessor) assign(compiler *compiler) Node {
@@ -660,25 +1144,27 @@ type LogicOr struct {
 	or    []Node
 }
 
-// todo: short circuit or with a jump
 func (logicOr LogicOr) Emit(compiler *compiler) {
-	logicOr.value.Emit(compiler)
-	for _, la := range logicOr.or {
-		la.Emit(compiler)
-		compiler.emitByte(OpOr)
-	}
+	compiler.emitTo(logicOr, compiler.allocate(1))
+}
+
+// todo: short circuit or with a jump
+func (logicOr LogicOr) emitTo(compiler *compiler, register int) {
+	compiler.emitChain(register, logicOr.value, logicOr.or, func(i, result, left, right int) {
+		compiler.emitABC(OpOr, result, left, right)
+	})
 }
 
-func (logicOr LogicOr) printTree(indent int) {
+func (logicOr LogicOr) printTree(out io.Writer, indent int) {
 	if len(logicOr.or) == 0 {
-		logicOr.value.printTree(indent)
+		logicOr.value.printTree(out, indent)
 		return
 	}
 
-	printIndent(indent, "Or")
-	logicOr.value.printTree(indent + 1)
+	printIndent(out, indent, "Or")
+	logicOr.value.printTree(out, indent+1)
 	for _, or := range logicOr.or {
-		or.printTree(indent + 1)
+		or.printTree(out, indent+1)
 	}
 }
 
@@ -693,23 +1179,59 @@ type LogicAnd struct {
 }
 
 func (logicAnd LogicAnd) Emit(compiler *compiler) {
-	logicAnd.value.Emit(compiler)
-	for _, comp := range logicAnd.and {
-		comp.Emit(compiler)
-		compiler.emitByte(OpAnd)
+	compiler.emitTo(logicAnd, compiler.allocate(1))
+}
+
+func (logicAnd LogicAnd) emitTo(compiler *compiler, register int) {
+	compiler.emitChain(register, logicAnd.value, logicAnd.and, func(i, result, left, right int) {
+		compiler.emitABC(OpAnd, result, left, right)
+	})
+}
+
+// Chains like `a + b - c` are evaluated from left to right, keeping the
+// result so far in the destination register. A local's register can't hold
+// it when there's more than one operation, since the operands still to come
+// might read the local
+func (compiler *compiler) emitChain(register int, first Node, operands []Node, emit func(i, result, left, right int)) {
+	if len(operands) == 0 {
+		compiler.emitTo(first, register)
+		return
 	}
+
+	top := compiler.registers
+	result := register
+	if !compiler.isTemporary(register) && len(operands) > 1 {
+		result = compiler.allocate(1)
+	}
+
+	mark := compiler.registers
+	left := compiler.operandInto(first, result)
+
+	for i, operand := range operands {
+		right := compiler.operand(operand)
+
+		if i == len(operands)-1 {
+			result = register
+		}
+
+		emit(i, result, left, right)
+		compiler.free(mark)
+		left = result
+	}
+
+	compiler.free(top)
 }
 
-func (logicAnd LogicAnd) printTree(indent int) {
+func (logicAnd LogicAnd) printTree(out io.Writer, indent int) {
 	if len(logicAnd.and) == 0 {
-		logicAnd.value.printTree(indent)
+		logicAnd.value.printTree(out, indent)
 		return
 	}
 
-	printIndent(indent, "And")
-	logicAnd.value.printTree(indent + 1)
+	printIndent(out, indent, "And")
+	logicAnd.value.printTree(out, indent+1)
 	for _, comp := range logicAnd.and {
-		comp.printTree(indent + 1)
+		comp.printTree(out, indent+1)
 	}
 }
 
@@ -723,43 +1245,56 @@ type Comparison struct {
 	items []ComparisonItem
 }
 
-// todo: could return second rather than pop but that would not
-// be compatible with Lua
 func (comparison Comparison) Emit(compiler *compiler) {
-	comparison.term.Emit(compiler)
-	for _, ci := range comparison.items {
-		ci.term.Emit(compiler)
+	compiler.emitTo(comparison, compiler.allocate(1))
+}
+
+// Greater than comparisons swap the operands of less than
+func (comparison Comparison) emitTo(compiler *compiler, register int) {
+	compiler.emitChain(register, comparison.term, comparison.operands(), func(i, result, left, right int) {
+		ci := comparison.items[i]
+		compiler.at(ci.span)
 		switch ci.compareOp {
 		case scanner.TokenEqualEqual:
-			compiler.emitByte(OpEquals)
+			compiler.emitABC(OpEquals, result, left, right)
 		case scanner.TokenTildeEqual:
-			compiler.emitBytes(OpEquals, OpNot)
+			compiler.emitABC(OpEquals, result, left, right)
+			compiler.emitABC(OpNot, result, result, 0)
 		case scanner.TokenLess:
-			compiler.emitByte(OpLess)
+			compiler.emitABC(OpLess, result, left, right)
 		case scanner.TokenLessEqual:
-			compiler.emitBytes(OpGreater, OpNot)
+			compiler.emitABC(OpLessEqual, result, left, right)
 		case scanner.TokenGreater:
-			compiler.emitByte(OpGreater)
+			compiler.emitABC(OpLess, result, right, left)
 		case scanner.TokenGreaterEqual:
-			compiler.emitBytes(OpLess, OpNot)
+			compiler.emitABC(OpLessEqual, result, right, left)
 		default:
 			compiler.error(fmt.Sprint("Unknown comparator operator: ", ci.compareOp))
 		}
+	})
+}
+
+func (comparison Comparison) operands() []Node {
+	operands := make([]Node, len(comparison.items))
+	for i, ci := range comparison.items {
+		operands[i] = ci.term
 	}
+
+	return operands
 }
 
-func (comparison Comparison) printTree(indent int) {
+func (comparison Comparison) printTree(out io.Writer, indent int) {
 	if len(comparison.items) == 0 {
-		comparison.term.printTree(indent)
+		comparison.term.printTree(out, indent)
 		return
 	}
 
-	printIndent(indent, comparison.items[0].compareOp)
-	comparison.term.printTree(indent + 1)
+	printIndent(out, indent, comparison.items[0].compareOp)
+	comparison.term.printTree(out, indent+1)
 	Comparison{
 		comparison.items[0].term,
 		comparison.items[1:],
-	}.printTree(indent + 1)
+	}.printTree(out, indent+1)
 }
 
 func (comparison Comparison) assign(compiler *compiler) Node {
@@ -770,6 +1305,72 @@ func (comparison Comparison) assign(compiler *compiler) Node {
 type ComparisonItem struct {
 	compareOp scanner.TokenType
 	term      Node
+	span      glerror.Span
+}
+
+type Bitwise struct {
+	operand Node
+	items   []BitwiseItem
+}
+
+func (bitwise Bitwise) Emit(compiler *compiler) {
+	compiler.emitTo(bitwise, compiler.allocate(1))
+}
+
+func (bitwise Bitwise) emitTo(compiler *compiler, register int) {
+	compiler.emitChain(register, bitwise.operand, bitwise.operands(), func(i, result, left, right int) {
+		bi := bitwise.items[i]
+		compiler.at(bi.span)
+		switch bi.bitwiseOp {
+		case scanner.TokenPipe:
+			compiler.emitABC(OpBitOr, result, left, right)
+		case scanner.TokenTilde:
+			compiler.emitABC(OpBitXor, result, left, right)
+		case scanner.TokenAmpersand:
+			compiler.emitABC(OpBitAnd, result, left, right)
+		case scanner.TokenLessLess:
+			compiler.emitABC(OpShiftLeft, result, left, right)
+		case scanner.TokenGreaterGreater:
+			compiler.emitABC(OpShiftRight, result, left, right)
+		default:
+			compiler.error(fmt.Sprint("Unknown bitwise operator: ", bi.bitwiseOp))
+		}
+	})
+}
+
+func (bitwise Bitwise) operands() []Node {
+	operands := make([]Node, len(bitwise.items))
+	for i, bi := range bitwise.items {
+		operands[i] = bi.operand
+	}
+
+	return operands
+}
+
+func (bitwise Bitwise) printTree(out io.Writer, indent int) {
+	if len(bitwise.items) == 0 {
+		bitwise.operand.printTree(out, indent)
+		return
+	}
+
+	printIndent(out, indent, bitwise.items[0].bitwiseOp)
+	bitwise.operand.printTree(out, indent+1)
+
+	Bitwise{
+		bitwise.items[0].operand,
+		bitwise.items[1:],
+	}.printTree(out, indent+1)
+}
+
+func (bitwise Bitwise) assign(compiler *compiler) Node {
+	compiler.error("Cannot assign to bitwise operation")
+	return bitwise
+}
+
+type BitwiseItem struct {
+	bitwiseOp scanner.TokenType
+	operand   Node
+	span      glerror.Span
 }
 
 type Term struct {
@@ -778,33 +1379,46 @@ type Term struct {
 }
 
 func (term Term) Emit(compiler *compiler) {
-	term.factor.Emit(compiler)
-	for _, ti := range term.items {
-		ti.factor.Emit(compiler)
+	compiler.emitTo(term, compiler.allocate(1))
+}
+
+func (term Term) emitTo(compiler *compiler, register int) {
+	compiler.emitChain(register, term.factor, term.operands(), func(i, result, left, right int) {
+		ti := term.items[i]
+		compiler.at(ti.span)
 		switch ti.termOp {
 		case scanner.TokenPlus:
-			compiler.emitByte(OpAdd)
+			compiler.emitABC(OpAdd, result, left, right)
 		case scanner.TokenMinus:
-			compiler.emitByte(OpSubtract)
+			compiler.emitABC(OpSubtract, result, left, right)
 		default:
 			compiler.error(fmt.Sprint("Unknown term operator: ", ti.termOp))
 		}
+	})
+}
+
+func (term Term) operands() []Node {
+	operands := make([]Node, len(term.items))
+	for i, ti := range term.items {
+		operands[i] = ti.factor
 	}
+
+	return operands
 }
 
-func (term Term) printTree(indent int) {
+func (term Term) printTree(out io.Writer, indent int) {
 	if len(term.items) == 0 {
-		term.factor.printTree(indent)
+		term.factor.printTree(out, indent)
 		return
 	}
 
-	printIndent(indent, term.items[0].termOp)
-	term.factor.printTree(indent + 1)
+	printIndent(out, indent, term.items[0].termOp)
+	term.factor.printTree(out, indent+1)
 
 	Term{
 		term.items[0].factor,
 		term.items[1:],
-	}.printTree(indent + 1)
+	}.printTree(out, indent+1)
 }
 
 func (term Term) assign(compiler *compiler) Node {
@@ -815,6 +1429,7 @@ func (term Term) assign(compiler *compiler) Node {
 type TermItem struct {
 	termOp scanner.TokenType
 	factor Node
+	span   glerror.Span
 }
 
 type Factor struct {
@@ -823,33 +1438,46 @@ type Factor struct {
 }
 
 func (factor Factor) Emit(compiler *compiler) {
-	factor.unary.Emit(compiler)
-	for _, u := range factor.items {
-		u.unary.Emit(compiler)
+	compiler.emitTo(factor, compiler.allocate(1))
+}
+
+func (factor Factor) emitTo(compiler *compiler, register int) {
+	compiler.emitChain(register, factor.unary, factor.operands(), func(i, result, left, right int) {
+		u := factor.items[i]
+		compiler.at(u.span)
 		switch u.factorOp {
 		case scanner.TokenStar:
-			compiler.emitByte(OpMult)
+			compiler.emitABC(OpMult, result, left, right)
 		case scanner.TokenSlash:
-			compiler.emitByte(OpDivide)
+			compiler.emitABC(OpDivide, result, left, right)
 		default:
 			compiler.error(fmt.Sprint("Unkown factor operator: ", u.factorOp))
 		}
+	})
+}
+
+func (factor Factor) operands() []Node {
+	operands := make([]Node, len(factor.items))
+	for i, u := range factor.items {
+		operands[i] = u.unary
 	}
+
+	return operands
 }
 
-func (factor Factor) printTree(indent int) {
+func (factor Factor) printTree(out io.Writer, indent int) {
 	if len(factor.items) == 0 {
-		factor.unary.printTree(indent)
+		factor.unary.printTree(out, indent)
 		return
 	}
 
-	printIndent(indent, factor.items[0].factorOp)
-	factor.unary.printTree(indent + 1)
+	printIndent(out, indent, factor.items[0].factorOp)
+	factor.unary.printTree(out, indent+1)
 
 	Factor{
 		factor.items[0].unary,
 		factor.items[1:],
-	}.printTree(indent + 1)
+	}.printTree(out, indent+1)
 }
 
 func (factor Factor) assign(compiler *compiler) Node {
@@ -860,20 +1488,25 @@ func (factor Factor) assign(compiler *compiler) Node {
 type FactorItem struct {
 	factorOp scanner.TokenType
 	unary    Node
+	span     glerror.Span
 }
 
 type NegateUnary struct {
 	unary Node
+	span  glerror.Span
 }
 
 func (unary NegateUnary) Emit(compiler *compiler) {
-	unary.unary.Emit(compiler)
-	compiler.emitByte(OpNegate)
+	compiler.emitTo(unary, compiler.allocate(1))
+}
+
+func (unary NegateUnary) emitTo(compiler *compiler, register int) {
+	compiler.emitUnary(OpNegate, register, unary.unary, unary.span)
 }
 
-func (unary NegateUnary) printTree(indent int) {
-	printIndent(indent, "Negate")
-	unary.unary.printTree(indent + 1)
+func (unary NegateUnary) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "Negate")
+	unary.unary.printTree(out, indent+1)
 }
 
 func (unary NegateUnary) assign(compiler *compiler) Node {
@@ -883,16 +1516,20 @@ func (unary NegateUnary) assign(compiler *compiler) Node {
 
 type NotUnary struct {
 	unary Node
+	span  glerror.Span
 }
 
 func (unary NotUnary) Emit(compiler *compiler) {
-	unary.unary.Emit(compiler)
-	compiler.emitByte(OpNot)
+	compiler.emitTo(unary, compiler.allocate(1))
 }
 
-func (unary NotUnary) printTree(indent int) {
-	printIndent(indent, "Not")
-	unary.unary.printTree(indent + 1)
+func (unary NotUnary) emitTo(compiler *compiler, register int) {
+	compiler.emitUnary(OpNot, register, unary.unary, unary.span)
+}
+
+func (unary NotUnary) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "Not")
+	unary.unary.printTree(out, indent+1)
 }
 
 func (unary NotUnary) assign(compiler *compiler) Node {
@@ -900,27 +1537,83 @@ func (unary NotUnary) assign(compiler *compiler) Node {
 	return unary
 }
 
+type BitwiseNotUnary struct {
+	unary Node
+	span  glerror.Span
+}
+
+func (unary BitwiseNotUnary) Emit(compiler *compiler) {
+	compiler.emitTo(unary, compiler.allocate(1))
+}
+
+func (unary BitwiseNotUnary) emitTo(compiler *compiler, register int) {
+	compiler.emitUnary(OpBitNot, register, unary.unary, unary.span)
+}
+
+func (unary BitwiseNotUnary) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "BitwiseNot")
+	unary.unary.printTree(out, indent+1)
+}
+
+func (unary BitwiseNotUnary) assign(compiler *compiler) Node {
+	compiler.error("Cannot assign to unary")
+	return unary
+}
+
+func (compiler *compiler) emitUnary(op byte, register int, operand Node, span glerror.Span) {
+	top := compiler.registers
+	source := compiler.operandInto(operand, register)
+
+	compiler.at(span)
+	compiler.emitABC(op, register, source, 0)
+	compiler.free(top)
+}
+
+type LengthUnary struct {
+	unary Node
+	span  glerror.Span
+}
+
+func (unary LengthUnary) Emit(compiler *compiler) {
+	compiler.emitTo(unary, compiler.allocate(1))
+}
+
+func (unary LengthUnary) emitTo(compiler *compiler, register int) {
+	compiler.emitUnary(OpLength, register, unary.unary, unary.span)
+}
+
+func (unary LengthUnary) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "Length")
+	unary.unary.printTree(out, indent+1)
+}
+
+func (unary LengthUnary) assign(compiler *compiler) Node {
+	compiler.error("Cannot assign to unary")
+	return unary
+}
+
 type Exponent struct {
 	base Node
 	exp  *Node
 }
 
 func (exponent Exponent) Emit(compiler *compiler) {
-	exponent.base.Emit(compiler)
+	compiler.emitTo(exponent, compiler.allocate(1))
+}
 
-	if exponent.exp != nil {
-		(*exponent.exp).Emit(compiler)
-		panic("todo exponentiation")
-	}
+// The parser has already reported the exponent as an error, so only the
+// base is emitted and the chunk is never run
+func (exponent Exponent) emitTo(compiler *compiler, register int) {
+	compiler.emitTo(exponent.base, register)
 }
 
-func (exponent Exponent) printTree(indent int) {
+func (exponent Exponent) printTree(out io.Writer, indent int) {
 	if exponent.exp == nil {
-		exponent.base.printTree(indent)
+		exponent.base.printTree(out, indent)
 	} else {
-		printIndent(indent, "Exp")
-		exponent.base.printTree(indent + 1)
-		(*exponent.exp).printTree(indent + 1)
+		printIndent(out, indent, "Exp")
+		exponent.base.printTree(out, indent+1)
+		(*exponent.exp).printTree(out, indent+1)
 	}
 }
 
@@ -933,33 +1626,75 @@ type Call struct {
 	base         Node
 	arguments    []Node
 	isAssignment bool
+	span         glerror.Span
 }
 
 func (call *Call) Emit(compiler *compiler) {
-	call.base.Emit(compiler)
+	call.emitCall(compiler, 1)
+}
+
+func (call *Call) emitTo(compiler *compiler, register int) {
+	if compiler.reusable(register) {
+		compiler.free(register)
+		call.emitCall(compiler, 1)
+		return
+	}
+
+	top := compiler.registers
+	call.emitCall(compiler, 1)
+	compiler.emitMove(register, top)
+	compiler.free(top)
+}
+
+// The function goes in the next free register with the arguments after it,
+// and the results replace them starting from the function's register
+func (call *Call) emitCall(compiler *compiler, results int) {
+	function := compiler.allocate(1)
+	compiler.emitTo(call.base, function)
+	arity := call.emitArguments(compiler)
+
+	compiler.emitABC(OpCall, function, arity+1, results+1)
+	compiler.free(function)
+	compiler.allocate(results)
+}
 
+func (call *Call) emitTailCall(compiler *compiler) {
+	function := compiler.allocate(1)
+	compiler.emitTo(call.base, function)
+	arity := call.emitArguments(compiler)
+
+	compiler.emitABC(OpTailCall, function, arity+1, 0)
+	compiler.free(function)
+}
+
+// Emits the arguments into the registers after the function and returns
+// the arity
+func (call *Call) emitArguments(compiler *compiler) int {
 	arity := 0
 	for _, arg := range call.arguments {
 		arg.Emit(compiler)
 		arity++
 	}
 
-	// todo: audit places where ints are downcast for overflow
-	// -> arity, locals, upvalues
-	compiler.emitBytes(OpCall, byte(arity))
-	compiler.emitByte(toByte(call.isAssignment))
+	compiler.at(call.span)
+
+	if arity > maxArguments {
+		compiler.error(fmt.Sprint("Too many arguments in function call, limit is ", maxArguments))
+	}
+
+	return arity
 }
 
-func (call *Call) printTree(indent int) {
-	printIndent(indent, "Call")
-	call.base.printTree(indent + 1)
+func (call *Call) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "Call")
+	call.base.printTree(out, indent+1)
 
 	if len(call.arguments) > 0 {
-		printIndent(indent+1, "Arguments")
+		printIndent(out, indent+1, "Arguments")
 	}
 
 	for _, arg := range call.arguments {
-		arg.printTree(indent + 2)
+		arg.printTree(out, indent+2)
 	}
 }
 
@@ -975,15 +1710,19 @@ func (call *Call) assign(compiler *compiler) Node {
 
 type LiteralPrimary struct {
 	value value.Value
+	span  glerror.Span
 }
 
 func (primary LiteralPrimary) Emit(compiler *compiler) {
-	b := compiler.makeConstant(primary.value)
-	compiler.emitBytes(OpConstant, b)
+	compiler.emitTo(primary, compiler.allocate(1))
 }
 
-func (primary LiteralPrimary) printTree(indent int) {
-	printIndent(indent, primary.value)
+func (primary LiteralPrimary) emitTo(compiler *compiler, register int) {
+	compiler.emitLoadConstant(register, primary.value, compiler.literalSpan(primary))
+}
+
+func (primary LiteralPrimary) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, primary.value)
 }
 
 func (primary LiteralPrimary) assign(compiler *compiler) Node {
@@ -997,6 +1736,12 @@ func NumberPrimary(f float64) LiteralPrimary {
 	}
 }
 
+func IntegerPrimary(i int64) LiteralPrimary {
+	return LiteralPrimary{
+		value: value.Integer(i),
+	}
+}
+
 func BooleanPrimary(b bool) LiteralPrimary {
 	return LiteralPrimary{
 		value: value.Boolean(b),
@@ -1011,38 +1756,80 @@ func StringPrimary(s string) LiteralPrimary {
 
 func NilPrimary() LiteralPrimary {
 	return LiteralPrimary{
-		value: value.Nil{},
+		value: value.Nil(),
 	}
 }
 
 type VariablePrimary struct {
 	name Identifier
+	span glerror.Span
 }
 
 func (primary VariablePrimary) Emit(compiler *compiler) {
+	compiler.emitTo(primary, compiler.allocate(1))
+}
+
+func (primary VariablePrimary) emitTo(compiler *compiler, register int) {
 	name := primary.name
+	compiler.at(primary.span)
 
 	local := compiler.getLocal(name)
+	if local != -1 && compiler.locals[local].constant != nil {
+		LiteralPrimary{value: *compiler.locals[local].constant}.emitTo(compiler, register)
+		return
+	}
+
 	if local != -1 {
-		compiler.emitBytes(OpGetLocal, byte(local))
+		compiler.emitMove(register, local)
 		return
 	}
 
 	upvalue := compiler.getUpvalue(name)
+	if upvalue != -1 && compiler.upvalues[upvalue].constant != nil {
+		LiteralPrimary{value: *compiler.upvalues[upvalue].constant}.emitTo(compiler, register)
+		return
+	}
+
 	if upvalue != -1 {
-		compiler.emitBytes(OpGetUpvalue, byte(upvalue))
+		compiler.emitABC(OpGetUpvalue, register, upvalue, 0)
+		return
+	}
+
+	if name == envName {
+		compiler.emitABC(OpGetEnv, register, 0, 0)
+		return
+	}
+
+	if compiler.hasLocalEnv() {
+		TableAccessor{VariablePrimary{envName, primary.span}, StringPrimary(string(name)), primary.span}.emitTo(compiler, register)
 		return
 	}
 
-	constant := compiler.makeConstant(value.StringVal(string(name)))
-	compiler.emitBytes(OpGetGlobal, constant)
+	compiler.emitABx(OpGetGlobal, register, compiler.makeGlobal(name))
+}
+
+// Globals are entries in the function's environment, which is the one the
+// chunk was loaded with unless a local or upvalue named _ENV is in scope
+const envName Identifier = "_ENV"
+
+func (compiler *compiler) hasLocalEnv() bool {
+	return compiler.getLocal(envName) != -1 || compiler.getUpvalue(envName) != -1
+}
+
+// Stores the register's value in the global
+func (compiler *compiler) emitSetGlobal(name Identifier, source int) {
+	if compiler.hasLocalEnv() {
+		TableAssignment{VariablePrimary{envName, compiler.position}, StringPrimary(string(name)), compiler.position}.store(compiler, source)
+		return
+	}
 
+	compiler.emitABx(OpSetGlobal, source, compiler.makeGlobal(name))
 }
 
 // todo: encode block scope and locals into types so they can be used
 // when printing not jus when emitting
-func (primary VariablePrimary) printTree(indent int) {
-	printIndent(indent, fmt.Sprintf("Identifier/%s", string(primary.name)))
+func (primary VariablePrimary) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, fmt.Sprintf("Identifier/%s", string(primary.name)))
 }
 
 func (primary VariablePrimary) assign(compiler *compiler) Node {
@@ -1053,8 +1840,11 @@ type TableLiteral struct {
 	entries []Node
 }
 
+// The table is built in the next free register, where the entries expect
+// to find it
 func (literal TableLiteral) Emit(compiler *compiler) {
-	compiler.emitByte(OpCreateTable)
+	table := compiler.allocate(1)
+	compiler.emitABC(OpCreateTable, table, 0, 0)
 
 	for _, ent := range mapPairs(literal.entries) {
 		ent.Emit(compiler)
@@ -1065,6 +1855,19 @@ func (literal TableLiteral) Emit(compiler *compiler) {
 	}
 }
 
+func (literal TableLiteral) emitTo(compiler *compiler, register int) {
+	if compiler.reusable(register) {
+		compiler.free(register)
+		literal.Emit(compiler)
+		return
+	}
+
+	top := compiler.registers
+	literal.Emit(compiler)
+	compiler.emitMove(register, top)
+	compiler.free(top)
+}
+
 func valuePairs(pairs []Node) []Node {
 	var mapPairs []Node
 
@@ -1092,11 +1895,11 @@ func mapPairs(pairs []Node) []Node {
 	return mapPairs
 }
 
-func (literal TableLiteral) printTree(indent int) {
-	printIndent(indent, "Table")
+func (literal TableLiteral) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "Table")
 
 	for _, entry := range literal.entries {
-		entry.printTree(indent + 1)
+		entry.printTree(out, indent+1)
 	}
 }
 
@@ -1109,14 +1912,18 @@ type Value struct {
 	value Node
 }
 
+// Table entries are emitted while the table is the last register in use
 func (val Value) Emit(compiler *compiler) {
-	val.value.Emit(compiler)
-	compiler.emitByte(OpInsertTable)
+	table := compiler.registers - 1
+	source := compiler.operand(val.value)
+
+	compiler.emitABC(OpInsertTable, table, source, 0)
+	compiler.free(table + 1)
 }
 
-func (val Value) printTree(indent int) {
-	printIndent(indent, "Value")
-	val.value.printTree(indent + 1)
+func (val Value) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "Value")
+	val.value.printTree(out, indent+1)
 }
 
 func (val Value) assign(compiler *compiler) Node {
@@ -1130,15 +1937,22 @@ type StringPair struct {
 }
 
 func (pair StringPair) Emit(compiler *compiler) {
-	pair.key.Emit(compiler)
-	pair.value.Emit(compiler)
-	compiler.emitByte(OpInitTable)
+	compiler.emitEntry(pair.key, pair.value)
+}
+
+func (compiler *compiler) emitEntry(key, val Node) {
+	table := compiler.registers - 1
+	k := compiler.operand(key)
+	v := compiler.operand(val)
+
+	compiler.emitABC(OpSetTable, table, k, v)
+	compiler.free(table + 1)
 }
 
-func (pair StringPair) printTree(indent int) {
-	printIndent(indent, "StringPair")
-	pair.key.printTree(indent + 1)
-	pair.value.printTree(indent + 1)
+func (pair StringPair) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "StringPair")
+	pair.key.printTree(out, indent+1)
+	pair.value.printTree(out, indent+1)
 }
 
 func (pair StringPair) assign(compiler *compiler) Node {
@@ -1152,15 +1966,13 @@ type LiteralPair struct {
 }
 
 func (pair LiteralPair) Emit(compiler *compiler) {
-	pair.key.Emit(compiler)
-	pair.value.Emit(compiler)
-	compiler.emitByte(OpInitTable)
+	compiler.emitEntry(pair.key, pair.value)
 }
 
-func (pair LiteralPair) printTree(indent int) {
-	printIndent(indent, "LiteralPair")
-	pair.key.printTree(indent + 1)
-	pair.value.printTree(indent + 1)
+func (pair LiteralPair) printTree(out io.Writer, indent int) {
+	printIndent(out, indent, "LiteralPair")
+	pair.key.printTree(out, indent+1)
+	pair.value.printTree(out, indent+1)
 }
 
 func (pair LiteralPair) assign(compiler *compiler) Node {
@@ -1170,9 +1982,9 @@ func (pair LiteralPair) assign(compiler *compiler) Node {
 
 type Identifier string
 
-func printIndent(indent int, node interface{}) {
+func printIndent(out io.Writer, indent int, node interface{}) {
 	for i := 0; i < indent; i++ {
-		fmt.Fprint(os.Stderr, "  ")
+		fmt.Fprint(out, "  ")
 	}
-	fmt.Fprintln(os.Stderr, node)
+	fmt.Fprintln(out, node)
 }
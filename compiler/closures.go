@@ -0,0 +1,1470 @@
+package compiler
+
+import (
+	"arlindohall/glua/constants"
+	"arlindohall/glua/glerror"
+	"arlindohall/glua/scanner"
+	"arlindohall/glua/value"
+	"fmt"
+)
+
+// CompiledFunction is a function as the closures backend runs it, see
+// Function.Closures
+type CompiledFunction func(frame *Frame)
+
+// A Frame is the call a compiled function runs in. Its registers are the
+// window of the VM's stack starting at Base, as they are for bytecode, so
+// compiled and bytecode functions can call each other and share upvalues.
+// The stack moves when it grows, so it's only indexed once the value stored
+// in it has been worked out. A break stops the statements it's in like a
+// return does, `breaking` tells the loop it was a break
+type Frame struct {
+	Runtime  Runtime
+	Stack    *[]value.Value
+	Base     int
+	Closure  *value.Closure
+	breaking bool
+}
+
+func (frame *Frame) get(register int) value.Value {
+	return (*frame.Stack)[frame.Base+register]
+}
+
+func (frame *Frame) set(register int, val value.Value) {
+	(*frame.Stack)[frame.Base+register] = val
+}
+
+// Whether the statements stopped for a break, which the loop that asks
+// handles
+func (frame *Frame) broke() bool {
+	breaking := frame.breaking
+	frame.breaking = false
+
+	return breaking
+}
+
+// Runtime is the VM as compiled code sees it. Positions are indexes into
+// the spans of the chunk, an error is reported at the position it's given
+// and so is a call in the traceback. Registers are the frame's. A method
+// that raises an error doesn't return
+type Runtime interface {
+	Call(position, register, arity, results int)
+	TailCall(position, register, arity int)
+	Return(position, register, count int)
+	Loop(position int)
+	AssertionFailed(position int, message value.Value)
+
+	Arithmetic(position int, name string, a, b value.Value, intOp func(int64, int64) int64, floatOp func(float64, float64) float64) value.Value
+	Compare(position int, a, b value.Value, compare func(value.Value, value.Value) bool) bool
+	Bitwise(position int, a, b value.Value, op func(int64, int64) int64) value.Value
+	BitNot(position int, val value.Value) value.Value
+	Length(position, register int, val value.Value)
+
+	NewTable(position int) value.Value
+	Insert(position int, table, val value.Value)
+	GetTable(position int, table, key value.Value) value.Value
+	SetTable(position int, table, key, val value.Value)
+
+	Closure(position int, prototype *value.Closure) *value.Closure
+	Capture(position int, closure *value.Closure, index int, isLocal bool)
+	MarkClose(position, register int, name value.Value)
+	Close(position, register int)
+}
+
+// Closures compiles the script's syntax tree into nested Go closures for the
+// closures backend. An expression becomes a closure that returns its value
+// and a statement one that runs it and says whether the function returned,
+// and a block chains the closures of its statements. The tree is walked the
+// way Emit walks it, so locals have the same registers, values are read at
+// the same moments and errors point at the same spans, but the optimizations
+// are not applied. Strings are interned in `strings`. There's nothing to
+// compile unless the script was compiled for the closures backend
+func (function Function) Closures(strings value.Strings) (value.Chunk, bool) {
+	if function.syntax == nil {
+		return value.Chunk{}, false
+	}
+
+	builder := &closureBuilder{
+		strings: strings,
+		mode:    function.syntax.mode,
+		source:  function.Chunk.Source,
+	}
+
+	return builder.script(function.syntax.tree), true
+}
+
+type expressionClosure func(frame *Frame) value.Value
+
+// True once the function has returned or tail called, or a break has to
+// leave the loop
+type statementClosure func(frame *Frame) bool
+
+type conditionClosure func(frame *Frame) bool
+
+// Both operands of an operation, in the order they are evaluated
+type pairClosure func(frame *Frame) (value.Value, value.Value)
+
+// Positions are tracked like compiler.position, each function has its own
+// table of the spans they point at
+type closureBuilder struct {
+	function *builtFunction
+	strings  value.Strings
+	mode     ReturnMode
+	source   *glerror.Source
+	position glerror.Span
+}
+
+// Registers are allocated as the compiler allocates them, locals first in
+// the order they're declared. `result` is where the REPL keeps the value of
+// an expression statement
+type builtFunction struct {
+	parent    *builtFunction
+	locals    []Local
+	upvalues  []*Upvalue
+	scope     int
+	loops     []int
+	registers int
+	size      int
+	spans     []glerror.Span
+	spanIndex map[glerror.Span]int
+	result    int
+}
+
+// Like compiler.operand, a local or a constant is read when the operation
+// uses it and anything else is evaluated before. `local` is the local's
+// register, or -1
+type builtOperand struct {
+	get      expressionClosure
+	local    int
+	constant bool
+}
+
+func (operand builtOperand) late() bool {
+	return operand.local != -1 || operand.constant
+}
+
+func newBuiltFunction(parent *builtFunction) *builtFunction {
+	return &builtFunction{
+		parent:    parent,
+		locals:    []Local{{name: ""}},
+		spanIndex: map[glerror.Span]int{},
+		result:    -1,
+	}
+}
+
+func (function *builtFunction) allocate(count int) int {
+	register := function.registers
+	function.registers += count
+
+	if function.registers > function.size {
+		function.size = function.registers
+	}
+
+	return register
+}
+
+func (function *builtFunction) free(register int) {
+	function.registers = register
+}
+
+func (function *builtFunction) addLocal(name Identifier, attrib Attribute, constant *value.Value) {
+	function.locals = append(function.locals, Local{name: name, scope: function.scope, attrib: attrib, constant: constant})
+}
+
+// Like compiler.getLocal, the first local with the name
+func (function *builtFunction) local(name Identifier) int {
+	for i, local := range function.locals {
+		if local.name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Like compiler.getUpvalue, a local of the enclosing function that is found
+// is marked as captured
+func (function *builtFunction) upvalue(name Identifier) int {
+	for i, upvalue := range function.upvalues {
+		if upvalue.name == name {
+			return i
+		}
+	}
+
+	if function.parent == nil {
+		return -1
+	}
+
+	for i, local := range function.parent.locals {
+		if local.name == name {
+			function.parent.locals[i].captured = true
+			return function.addUpvalue(name, i, true, local.attrib, local.constant)
+		}
+	}
+
+	upvalue := function.parent.upvalue(name)
+	if upvalue == -1 {
+		return -1
+	}
+
+	enclosing := function.parent.upvalues[upvalue]
+	return function.addUpvalue(name, upvalue, false, enclosing.attrib, enclosing.constant)
+}
+
+func (function *builtFunction) addUpvalue(name Identifier, index int, isLocal bool, attrib Attribute, constant *value.Value) int {
+	function.upvalues = append(function.upvalues, &Upvalue{
+		name:     name,
+		index:    index,
+		isLocal:  isLocal,
+		attrib:   attrib,
+		constant: constant,
+	})
+
+	return len(function.upvalues) - 1
+}
+
+func (function *builtFunction) variableConstant(name Identifier) *value.Value {
+	if local := function.local(name); local != -1 {
+		return function.locals[local].constant
+	}
+
+	if upvalue := function.upvalue(name); upvalue != -1 {
+		return function.upvalues[upvalue].constant
+	}
+
+	return nil
+}
+
+// The register of a local that isn't a constant
+func (function *builtFunction) localRegister(node Node) (int, bool) {
+	primary, ok := node.(VariablePrimary)
+	if !ok {
+		return 0, false
+	}
+
+	local := function.local(primary.name)
+	if local == -1 || function.locals[local].constant != nil {
+		return 0, false
+	}
+
+	return local, true
+}
+
+func (function *builtFunction) hasLocalEnv() bool {
+	return function.local(envName) != -1 || function.upvalue(envName) != -1
+}
+
+func (function *builtFunction) hasCloseVariables() bool {
+	for _, local := range function.locals {
+		if local.attrib == AttribClose {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (builder *closureBuilder) at(span glerror.Span) {
+	builder.position = span
+}
+
+// The index of the current position in the function's spans
+func (builder *closureBuilder) mark() int {
+	function := builder.function
+
+	index, ok := function.spanIndex[builder.position]
+	if !ok {
+		index = len(function.spans)
+		function.spans = append(function.spans, builder.position)
+		function.spanIndex[builder.position] = index
+	}
+
+	return index
+}
+
+func (builder *closureBuilder) chunk(arity int, body statementClosure) value.Chunk {
+	function := builder.function
+
+	return value.Chunk{
+		Source:    builder.source,
+		Spans:     function.spans,
+		Registers: function.size,
+		Arity:     arity,
+		Compiled:  CompiledFunction(func(frame *Frame) { body(frame) }),
+	}
+}
+
+// In the REPL the script returns the value of its last declaration when
+// that is an expression statement
+func (builder *closureBuilder) script(tree []declaration) value.Chunk {
+	builder.function = newBuiltFunction(nil)
+	builder.function.allocate(1)
+
+	var statements []statementClosure
+	result := -1
+
+	for _, decl := range tree {
+		builder.function.result = -1
+		builder.at(decl.span)
+
+		statement := builder.statement(decl.node)
+		if statement == nil {
+			continue
+		}
+
+		statements = append(statements, statement)
+		result = -1
+
+		if _, ok := decl.node.(Expression); ok {
+			result = builder.function.result
+		}
+	}
+
+	statements = append(statements, builder.functionEnd(result))
+
+	return builder.chunk(0, sequence(statements))
+}
+
+// The implicit return at the end of every function
+func (builder *closureBuilder) functionEnd(result int) statementClosure {
+	position := builder.mark()
+
+	if result != -1 {
+		return func(frame *Frame) bool {
+			frame.Runtime.Return(position, result, 1)
+			return true
+		}
+	}
+
+	return func(frame *Frame) bool {
+		frame.Runtime.Return(position, 0, 0)
+		return true
+	}
+}
+
+// Runs the statements in order until one of them returns, statements that
+// do nothing are nil and left out
+func sequence(statements []statementClosure) statementClosure {
+	var kept []statementClosure
+	for _, statement := range statements {
+		if statement != nil {
+			kept = append(kept, statement)
+		}
+	}
+
+	switch len(kept) {
+	case 0:
+		return nil
+	case 1:
+		return kept[0]
+	case 2:
+		first, second := kept[0], kept[1]
+		return func(frame *Frame) bool {
+			return first(frame) || second(frame)
+		}
+	}
+
+	return func(frame *Frame) bool {
+		for _, statement := range kept {
+			if statement(frame) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// A statement that may be nil, for a body that must run something
+func orNothing(statement statementClosure) statementClosure {
+	if statement == nil {
+		return func(*Frame) bool { return false }
+	}
+
+	return statement
+}
+
+func (builder *closureBuilder) constant(val value.Value) value.Value {
+	return builder.strings.Intern(val)
+}
+
+func (builder *closureBuilder) statement(node Node) statementClosure {
+	function := builder.function
+
+	switch node := node.(type) {
+	case FunctionNode:
+		return builder.functionDeclaration(node)
+	case GlobalDeclaration:
+		register := function.registers
+		statements := builder.values(node.values, len(node.names))
+
+		for i, name := range node.names {
+			statements = append(statements, builder.setGlobal(name, builder.registerOperand(register+i)))
+		}
+
+		function.free(register)
+		return sequence(statements)
+	case LocalDeclaration:
+		register := function.registers
+		statements := builder.values(node.values, len(node.names))
+
+		constants := make([]*value.Value, len(node.names))
+		for i := range node.names {
+			constants[i] = node.constant(i, function.variableConstant)
+		}
+
+		for i, name := range node.names {
+			function.addLocal(name, node.attribute(i), constants[i])
+		}
+
+		for i, name := range node.names {
+			if node.attribute(i) == AttribClose {
+				statements = append(statements, builder.markClose(register+i, name))
+			}
+		}
+
+		return sequence(statements)
+	case WhileStatement:
+		condition := builder.condition(node.condition)
+		body := orNothing(builder.loop(node.body))
+		position := builder.mark()
+
+		return func(frame *Frame) bool {
+			for condition(frame) {
+				if body(frame) {
+					return !frame.broke()
+				}
+
+				frame.Runtime.Loop(position)
+			}
+
+			return false
+		}
+	case NumericForStatement:
+		var statements []statementClosure
+
+		function.loops = append(function.loops, function.scope)
+		for _, val := range node.values {
+			builder.startScope()
+			_, push := builder.push(val)
+			function.addLocal(node.variable, AttribNone, nil)
+
+			statements = append(statements, push, builder.statement(node.body), builder.endScope())
+		}
+		function.loops = function.loops[:len(function.loops)-1]
+
+		loop := sequence(statements)
+		if loop == nil {
+			return nil
+		}
+
+		return func(frame *Frame) bool {
+			return loop(frame) && !frame.broke()
+		}
+	case GenericForStatement:
+		builder.startScope()
+		block := builder.statement(node.transform())
+
+		return sequence([]statementClosure{block, builder.endScope()})
+	case IfStatement:
+		condition := builder.condition(node.condition)
+		body := orNothing(builder.statement(node.body))
+
+		counterfactual := orNothing(nil)
+		if node.counterfactual != nil {
+			counterfactual = orNothing(builder.statement(node.counterfactual))
+		}
+
+		return func(frame *Frame) bool {
+			if condition(frame) {
+				return body(frame)
+			}
+
+			return counterfactual(frame)
+		}
+	case ReturnStatement:
+		return builder.returnStatement(node)
+	case BreakStatement:
+		return builder.breakStatement()
+	case BlockStatement:
+		builder.startScope()
+
+		var statements []statementClosure
+		for _, statement := range node.statements {
+			statements = append(statements, builder.statement(statement))
+		}
+
+		return sequence(append(statements, builder.endScope()))
+	case AssertStatement:
+		top := function.registers
+		val := builder.register(node.value)
+		message := builder.operand(node.message)
+
+		builder.at(node.span)
+		position := builder.mark()
+		function.free(top)
+
+		operands := builder.pair(val, message)
+		return func(frame *Frame) bool {
+			val, message := operands(frame)
+			if !val.AsBoolean() {
+				frame.Runtime.AssertionFailed(position, message)
+			}
+
+			return false
+		}
+	case MultipleAssignment:
+		return builder.assignment(node)
+	case Expression:
+		return builder.expressionStatement(node)
+	default:
+		panic(fmt.Sprintf("Internal error: cannot compile %T to closures", node))
+	}
+}
+
+func (builder *closureBuilder) markClose(register int, name Identifier) statementClosure {
+	position := builder.mark()
+	constant := builder.constant(value.StringVal(string(name)))
+
+	return func(frame *Frame) bool {
+		frame.Runtime.MarkClose(position, register, constant)
+		return false
+	}
+}
+
+// Like FunctionNode.Emit, the function is built with the position of its
+// declaration, which is left as it was for the one declaring it. The
+// closure is made from a prototype and then captures its upvalues
+func (builder *closureBuilder) functionDeclaration(node FunctionNode) statementClosure {
+	builder.at(node.span)
+	position := builder.position
+	enclosing := builder.function
+
+	child := newBuiltFunction(enclosing)
+	for _, parameter := range node.parameters {
+		child.addLocal(parameter, AttribNone, nil)
+	}
+	child.allocate(len(child.locals))
+
+	builder.function = child
+	body := builder.statement(node.body)
+
+	result := -1
+	if _, ok := node.body.(Expression); ok {
+		result = child.result
+	}
+
+	prototype := &value.Closure{
+		Chunk: builder.chunk(len(node.parameters), sequence([]statementClosure{body, builder.functionEnd(result)})),
+		Name:  string(node.name),
+	}
+
+	builder.function = enclosing
+	builder.position = position
+
+	create := builder.mark()
+	upvalues := child.upvalues
+	register := enclosing.allocate(1)
+
+	statements := []statementClosure{func(frame *Frame) bool {
+		closure := frame.Runtime.Closure(create, prototype)
+		frame.set(register, value.ClosureValue(closure))
+
+		for _, upvalue := range upvalues {
+			frame.Runtime.Capture(create, closure, upvalue.index, upvalue.isLocal)
+		}
+
+		return false
+	}}
+
+	if enclosing.scope > 0 {
+		enclosing.addLocal(node.name, AttribNone, nil)
+	} else {
+		statements = append(statements, builder.setGlobal(node.name, builder.registerOperand(register)))
+		enclosing.free(register)
+	}
+
+	return sequence(statements)
+}
+
+// The body of a loop, which breaks leave
+func (builder *closureBuilder) loop(body Node) statementClosure {
+	function := builder.function
+
+	function.loops = append(function.loops, function.scope)
+	statement := builder.statement(body)
+	function.loops = function.loops[:len(function.loops)-1]
+
+	return statement
+}
+
+// Like BreakStatement.Emit, the locals of the loop that were captured or
+// are to be closed are closed first
+func (builder *closureBuilder) breakStatement() statementClosure {
+	function := builder.function
+	scope := function.loops[len(function.loops)-1]
+
+	top := 0
+	for top < len(function.locals) && function.locals[top].scope <= scope {
+		top += 1
+	}
+
+	for _, local := range function.locals[top:] {
+		if local.captured || local.attrib == AttribClose {
+			position := builder.mark()
+			return func(frame *Frame) bool {
+				frame.Runtime.Close(position, top)
+				frame.breaking = true
+				return true
+			}
+		}
+	}
+
+	return func(frame *Frame) bool {
+		frame.breaking = true
+		return true
+	}
+}
+
+func (builder *closureBuilder) startScope() {
+	builder.function.scope += 1
+}
+
+// Like compiler.endScope, the locals of the scope are forgotten and if any
+// of them were captured or are to be closed the scope ends by closing them
+func (builder *closureBuilder) endScope() statementClosure {
+	function := builder.function
+	function.scope -= 1
+
+	top := 0
+	for top < len(function.locals) && function.locals[top].scope <= function.scope {
+		top += 1
+	}
+
+	var statement statementClosure
+	for _, local := range function.locals[top:] {
+		if local.captured || local.attrib == AttribClose {
+			position := builder.mark()
+			statement = func(frame *Frame) bool {
+				frame.Runtime.Close(position, top)
+				return false
+			}
+			break
+		}
+	}
+
+	function.locals = function.locals[:top]
+	function.free(top)
+
+	return statement
+}
+
+// Like ReturnStatement.Emit, a call is a tail call unless there are
+// variables to close, a single local is returned from its register and
+// anything else is evaluated into new ones
+func (builder *closureBuilder) returnStatement(statement ReturnStatement) statementClosure {
+	function := builder.function
+
+	if call, ok := statement.tailCall(); ok && !function.hasCloseVariables() {
+		return builder.tailCall(call)
+	}
+
+	if len(statement.values) == 1 {
+		if local, ok := function.localRegister(statement.values[0]); ok {
+			position := builder.mark()
+
+			return func(frame *Frame) bool {
+				frame.Runtime.Return(position, local, 1)
+				return true
+			}
+		}
+	}
+
+	register := function.registers
+	var statements []statementClosure
+
+	for _, val := range statement.values {
+		_, push := builder.push(val)
+		statements = append(statements, push)
+	}
+
+	position := builder.mark()
+	count := len(statement.values)
+	function.free(register)
+
+	return sequence(append(statements, func(frame *Frame) bool {
+		frame.Runtime.Return(position, register, count)
+		return true
+	}))
+}
+
+// Like Expression.Emit, in the REPL the value is kept in the register that
+// was next when the statement started
+func (builder *closureBuilder) expressionStatement(statement Expression) statementClosure {
+	function := builder.function
+	register := function.registers
+	keep := builder.mode == constants.ReplMode && function.scope == 0
+
+	var run statementClosure
+	if call, ok := statement.expression.(*Call); ok && !keep {
+		_, run = builder.call(call, 0)
+	} else {
+		_, run = builder.push(statement.expression)
+	}
+
+	if keep {
+		function.result = register
+	}
+
+	function.free(register)
+	return run
+}
+
+// Like compiler.emitValues, `want` values in the registers starting at the
+// next free one, where a call in the last position fills the ones that are
+// left, missing values are nil and extra values are evaluated and dropped
+func (builder *closureBuilder) values(values []Node, want int) []statementClosure {
+	function := builder.function
+	register := function.registers
+	var statements []statementClosure
+
+	for i, val := range values {
+		call, ok := val.(*Call)
+
+		var push statementClosure
+		if ok && call.isAssignment && i == len(values)-1 && i < want {
+			_, push = builder.call(call, want-i)
+		} else {
+			_, push = builder.push(val)
+		}
+
+		statements = append(statements, push)
+	}
+
+	if missing := want - (function.registers - register); missing > 0 {
+		first := function.allocate(missing)
+
+		statements = append(statements, func(frame *Frame) bool {
+			for i := first; i < first+missing; i++ {
+				frame.set(i, value.Nil())
+			}
+
+			return false
+		})
+	}
+
+	function.free(register + want)
+	return statements
+}
+
+// Like MultipleAssignment.Emit, every value is evaluated before any variable
+// is assigned. A single value for a local goes straight into its register,
+// and for anything else it's an operand of the store
+func (builder *closureBuilder) assignment(assignment MultipleAssignment) statementClosure {
+	function := builder.function
+	register := function.registers
+
+	if len(assignment.variables) == 1 && len(assignment.values) == 1 {
+		target := assignment.variables[0]
+
+		if primary, ok := target.(VariablePrimary); ok {
+			if slot := function.local(primary.name); slot != -1 {
+				builder.at(primary.span)
+				val := builder.expression(assignment.values[0])
+
+				return func(frame *Frame) bool {
+					val := val(frame)
+					frame.set(slot, val)
+					return false
+				}
+			}
+		}
+
+		statement := builder.store(target, builder.operand(assignment.values[0]))
+		function.free(register)
+		return statement
+	}
+
+	statements := builder.values(assignment.values, len(assignment.variables))
+	for i, variable := range assignment.variables {
+		statements = append(statements, builder.store(variable, builder.registerOperand(register+i)))
+	}
+
+	function.free(register)
+	return sequence(statements)
+}
+
+// Like VariableAssignment.store and TableAssignment.store. A source that
+// isn't read late is evaluated before the table and key
+func (builder *closureBuilder) store(target Node, source builtOperand) statementClosure {
+	function := builder.function
+	val := source.get
+
+	switch target := target.(type) {
+	case VariablePrimary:
+		builder.at(target.span)
+
+		if local := function.local(target.name); local != -1 {
+			return func(frame *Frame) bool {
+				val := val(frame)
+				frame.set(local, val)
+				return false
+			}
+		}
+
+		if upvalue := function.upvalue(target.name); upvalue != -1 {
+			return func(frame *Frame) bool {
+				val := val(frame)
+				upvalue := frame.Closure.Upvalues[upvalue]
+
+				if upvalue.Open {
+					(*frame.Stack)[upvalue.Slot] = val
+				} else {
+					upvalue.Value = val
+				}
+
+				return false
+			}
+		}
+
+		return builder.setGlobal(target.name, source)
+	case TableAccessor:
+		top := function.registers
+		table := builder.register(target.table)
+		key := builder.operand(target.attribute)
+
+		builder.at(target.span)
+		position := builder.mark()
+		function.free(top)
+
+		operands := builder.pair(table, key)
+		late := source.late()
+
+		return func(frame *Frame) bool {
+			var v value.Value
+			if !late {
+				v = val(frame)
+			}
+
+			table, key := operands(frame)
+			if late {
+				v = val(frame)
+			}
+
+			frame.Runtime.SetTable(position, table, key, v)
+			return false
+		}
+	default:
+		panic(fmt.Sprintf("Internal error: cannot assign to %T", target))
+	}
+}
+
+// Through _ENV when a local one is in scope, as in compiler.emitSetGlobal
+func (builder *closureBuilder) setGlobal(name Identifier, source builtOperand) statementClosure {
+	if builder.function.hasLocalEnv() {
+		return builder.store(TableAccessor{VariablePrimary{envName, builder.position}, StringPrimary(string(name)), builder.position}, source)
+	}
+
+	position := builder.mark()
+	key := builder.constant(value.StringVal(string(name)))
+	val := source.get
+
+	return func(frame *Frame) bool {
+		val := val(frame)
+		frame.Runtime.SetTable(position, value.TableValue(frame.Closure.Env), key, val)
+		return false
+	}
+}
+
+// Like Call.emitCall, the function and its arguments go in the registers
+// starting at the next free one, which is where the results are left
+func (builder *closureBuilder) call(call *Call, results int) (int, statementClosure) {
+	register, arity, arguments := builder.arguments(call)
+	position := builder.mark()
+
+	function := builder.function
+	function.free(register)
+	function.allocate(results)
+
+	return register, func(frame *Frame) bool {
+		arguments(frame)
+		frame.Runtime.Call(position, register, arity, results)
+		return false
+	}
+}
+
+func (builder *closureBuilder) tailCall(call *Call) statementClosure {
+	register, arity, arguments := builder.arguments(call)
+	position := builder.mark()
+	builder.function.free(register)
+
+	return func(frame *Frame) bool {
+		arguments(frame)
+		frame.Runtime.TailCall(position, register, arity)
+		return true
+	}
+}
+
+// Puts the function and its arguments in place and moves to the call
+func (builder *closureBuilder) arguments(call *Call) (int, int, statementClosure) {
+	register := builder.function.allocate(1)
+	base := builder.expression(call.base)
+
+	statements := []statementClosure{func(frame *Frame) bool {
+		function := base(frame)
+		frame.set(register, function)
+		return false
+	}}
+
+	for _, argument := range call.arguments {
+		_, push := builder.push(argument)
+		statements = append(statements, push)
+	}
+
+	builder.at(call.span)
+
+	return register, len(call.arguments), sequence(statements)
+}
+
+// Like Emit, the node's value is put in the next free register, which is
+// left allocated
+func (builder *closureBuilder) push(node Node) (int, statementClosure) {
+	switch node := node.(type) {
+	case *Call:
+		return builder.call(node, 1)
+	case TableLiteral:
+		return builder.table(node)
+	}
+
+	register := builder.function.allocate(1)
+	val := builder.expression(node)
+
+	return register, func(frame *Frame) bool {
+		val := val(frame)
+		frame.set(register, val)
+		return false
+	}
+}
+
+// An operand that is read from a register when it's used
+func (builder *closureBuilder) registerOperand(register int) builtOperand {
+	return builtOperand{
+		get:   func(frame *Frame) value.Value { return frame.get(register) },
+		local: register,
+	}
+}
+
+func (builder *closureBuilder) constantOperand(val value.Value) builtOperand {
+	val = builder.constant(val)
+
+	return builtOperand{
+		get:      func(*Frame) value.Value { return val },
+		local:    -1,
+		constant: true,
+	}
+}
+
+// Like compiler.operand, literals and <const> variables are constants
+func (builder *closureBuilder) operand(node Node) builtOperand {
+	switch node := node.(type) {
+	case LiteralPrimary:
+		return builder.constantOperand(node.value)
+	case VariablePrimary:
+		if constant := builder.function.variableConstant(node.name); constant != nil {
+			return builder.constantOperand(*constant)
+		}
+	}
+
+	return builder.register(node)
+}
+
+// Like compiler.register, a local is read when it's used and anything else
+// is evaluated now. Values that can be tables or functions are kept in a
+// register until the caller frees it, as they would be by the bytecode, so
+// that the VM counts their memory while the operation is being worked out
+func (builder *closureBuilder) register(node Node) builtOperand {
+	function := builder.function
+
+	if local, ok := function.localRegister(node); ok {
+		return builder.registerOperand(local)
+	}
+
+	switch node.(type) {
+	case *Call, TableLiteral:
+		register, push := builder.push(node)
+
+		return builtOperand{
+			get: func(frame *Frame) value.Value {
+				push(frame)
+				return frame.get(register)
+			},
+			local: -1,
+		}
+	case TableAccessor, VariablePrimary:
+		register := function.allocate(1)
+		val := builder.expression(node)
+
+		return builtOperand{
+			get: func(frame *Frame) value.Value {
+				val := val(frame)
+				frame.set(register, val)
+				return val
+			},
+			local: -1,
+		}
+	}
+
+	return builtOperand{get: builder.expression(node), local: -1}
+}
+
+// Evaluates both operands, one that is read late after the other
+func (builder *closureBuilder) pair(a, b builtOperand) pairClosure {
+	getA, getB := a.get, b.get
+
+	switch {
+	case a.local != -1 && b.constant:
+		register, constant := a.local, b.get(nil)
+		return func(frame *Frame) (value.Value, value.Value) {
+			return frame.get(register), constant
+		}
+	case a.local != -1 && b.local != -1:
+		first, second := a.local, b.local
+		return func(frame *Frame) (value.Value, value.Value) {
+			return frame.get(first), frame.get(second)
+		}
+	case b.constant:
+		constant := b.get(nil)
+		return func(frame *Frame) (value.Value, value.Value) {
+			return getA(frame), constant
+		}
+	case a.late():
+		return func(frame *Frame) (value.Value, value.Value) {
+			b := getB(frame)
+			return getA(frame), b
+		}
+	}
+
+	return func(frame *Frame) (value.Value, value.Value) {
+		a := getA(frame)
+		return a, getB(frame)
+	}
+}
+
+// Like compiler.emitChain, from left to right with the result so far on
+// the left. The registers of each operand are freed after its operation
+func (builder *closureBuilder) chain(first Node, operands []Node, operation func(i int, operands pairClosure) expressionClosure) expressionClosure {
+	function := builder.function
+	top := function.registers
+
+	left := builder.operand(first)
+	mark := function.registers
+
+	for i, operand := range operands {
+		right := builder.operand(operand)
+		left = builtOperand{get: operation(i, builder.pair(left, right)), local: -1}
+		function.free(mark)
+	}
+
+	function.free(top)
+	return left.get
+}
+
+// A condition that is a single comparison gives its result without making
+// a boolean value, anything else is tested like OpTest
+func (builder *closureBuilder) condition(node Node) conditionClosure {
+	function := builder.function
+	top := function.registers
+
+	if comparison, ok := node.(Comparison); ok && len(comparison.items) == 1 {
+		left := builder.operand(comparison.term)
+		item := comparison.items[0]
+		right := builder.operand(item.term)
+
+		builder.at(item.span)
+		position := builder.mark()
+		function.free(top)
+
+		return builder.compare(item.compareOp, position, builder.pair(left, right))
+	}
+
+	val := builder.register(node).get
+	function.free(top)
+
+	return func(frame *Frame) bool {
+		return val(frame).AsBoolean()
+	}
+}
+
+// Returns a closure that evaluates the node like emitTo, the registers it
+// uses are free again afterwards
+func (builder *closureBuilder) expression(node Node) expressionClosure {
+	function := builder.function
+
+	switch node := node.(type) {
+	case LiteralPrimary:
+		return builder.constantOperand(node.value).get
+	case VariablePrimary:
+		return builder.variable(node)
+	case TableAccessor:
+		top := function.registers
+		table := builder.register(node.table)
+		key := builder.operand(node.attribute)
+
+		builder.at(node.span)
+		position := builder.mark()
+		function.free(top)
+
+		operands := builder.pair(table, key)
+		return func(frame *Frame) value.Value {
+			table, key := operands(frame)
+			if table.IsTable() {
+				return table.AsTable().Get(key)
+			}
+
+			return frame.Runtime.GetTable(position, table, key)
+		}
+	case *Call, TableLiteral:
+		top := function.registers
+		register, push := builder.push(node)
+		function.free(top)
+
+		return func(frame *Frame) value.Value {
+			push(frame)
+			return frame.get(register)
+		}
+	case LogicOr:
+		return builder.chain(node.value, node.or, func(i int, operands pairClosure) expressionClosure {
+			return func(frame *Frame) value.Value {
+				a, b := operands(frame)
+				return value.Boolean(a.AsBoolean() || b.AsBoolean())
+			}
+		})
+	case LogicAnd:
+		return builder.chain(node.value, node.and, func(i int, operands pairClosure) expressionClosure {
+			return func(frame *Frame) value.Value {
+				a, b := operands(frame)
+				return value.Boolean(a.AsBoolean() && b.AsBoolean())
+			}
+		})
+	case Comparison:
+		return builder.chain(node.term, node.operands(), func(i int, operands pairClosure) expressionClosure {
+			item := node.items[i]
+			builder.at(item.span)
+
+			compare := builder.compare(item.compareOp, builder.mark(), operands)
+			return func(frame *Frame) value.Value {
+				return value.Boolean(compare(frame))
+			}
+		})
+	case Bitwise:
+		return builder.chain(node.operand, node.operands(), func(i int, operands pairClosure) expressionClosure {
+			item := node.items[i]
+			builder.at(item.span)
+
+			position, op := builder.mark(), bitwiseOperation(item.bitwiseOp)
+			return func(frame *Frame) value.Value {
+				a, b := operands(frame)
+				return frame.Runtime.Bitwise(position, a, b, op)
+			}
+		})
+	case Term:
+		return builder.chain(node.factor, node.operands(), func(i int, operands pairClosure) expressionClosure {
+			item := node.items[i]
+			builder.at(item.span)
+
+			return builder.arithmetic(item.termOp, operands)
+		})
+	case Factor:
+		return builder.chain(node.unary, node.operands(), func(i int, operands pairClosure) expressionClosure {
+			item := node.items[i]
+			builder.at(item.span)
+
+			return builder.arithmetic(item.factorOp, operands)
+		})
+	case NegateUnary:
+		val, _ := builder.unary(node.unary, node.span)
+		return func(frame *Frame) value.Value {
+			val := val(frame)
+			if val.IsInteger() {
+				return value.Integer(-val.AsInteger())
+			}
+
+			return value.Number(-val.AsNumber())
+		}
+	case NotUnary:
+		val, _ := builder.unary(node.unary, node.span)
+		return func(frame *Frame) value.Value {
+			return value.Boolean(!val(frame).AsBoolean())
+		}
+	case BitwiseNotUnary:
+		val, position := builder.unary(node.unary, node.span)
+		return func(frame *Frame) value.Value {
+			return frame.Runtime.BitNot(position, val(frame))
+		}
+	case LengthUnary:
+		// The length is worked out by the VM, which leaves it in a register
+		top := function.registers
+		register := function.allocate(1)
+		val, position := builder.unary(node.unary, node.span)
+		function.free(top)
+
+		return func(frame *Frame) value.Value {
+			frame.Runtime.Length(position, register, val(frame))
+			return frame.get(register)
+		}
+	case Exponent:
+		// Like Exponent.emitTo, the exponent is a compile error and the
+		// function is never built
+		return builder.expression(node.base)
+	default:
+		panic(fmt.Sprintf("Internal error: cannot compile %T to closures", node))
+	}
+}
+
+// Like compiler.emitUnary, the operand and then the position of the operator
+func (builder *closureBuilder) unary(operand Node, span glerror.Span) (expressionClosure, int) {
+	function := builder.function
+	top := function.registers
+
+	val := builder.operand(operand).get
+	builder.at(span)
+	function.free(top)
+
+	return val, builder.mark()
+}
+
+// Like VariablePrimary.emitTo, the variable is looked up while compiling
+func (builder *closureBuilder) variable(primary VariablePrimary) expressionClosure {
+	name := primary.name
+	function := builder.function
+	builder.at(primary.span)
+
+	if local := function.local(name); local != -1 {
+		if constant := function.locals[local].constant; constant != nil {
+			return builder.constantOperand(*constant).get
+		}
+
+		return builder.registerOperand(local).get
+	}
+
+	if upvalue := function.upvalue(name); upvalue != -1 {
+		if constant := function.upvalues[upvalue].constant; constant != nil {
+			return builder.constantOperand(*constant).get
+		}
+
+		return func(frame *Frame) value.Value {
+			upvalue := frame.Closure.Upvalues[upvalue]
+			if upvalue.Open {
+				return (*frame.Stack)[upvalue.Slot]
+			}
+
+			return upvalue.Value
+		}
+	}
+
+	if name == envName {
+		return func(frame *Frame) value.Value {
+			return value.TableValue(frame.Closure.Env)
+		}
+	}
+
+	if function.hasLocalEnv() {
+		return builder.expression(TableAccessor{VariablePrimary{envName, primary.span}, StringPrimary(string(name)), primary.span})
+	}
+
+	global := value.NewGlobal(builder.constant(value.StringVal(string(name))))
+	return func(frame *Frame) value.Value {
+		return frame.Closure.Env.GetGlobal(&global)
+	}
+}
+
+// Like TableLiteral.Emit, keyed entries are set before the values in the
+// list are inserted, into the table in the register it's made in
+func (builder *closureBuilder) table(literal TableLiteral) (int, statementClosure) {
+	function := builder.function
+	register := function.allocate(1)
+	create := builder.mark()
+
+	statements := []statementClosure{func(frame *Frame) bool {
+		table := frame.Runtime.NewTable(create)
+		frame.set(register, table)
+		return false
+	}}
+
+	for _, entry := range mapPairs(literal.entries) {
+		var key, val Node
+		switch entry := entry.(type) {
+		case StringPair:
+			key, val = entry.key, entry.value
+		case LiteralPair:
+			key, val = entry.key, entry.value
+		}
+
+		operands := builder.pair(builder.operand(key), builder.operand(val))
+		position := builder.mark()
+		function.free(register + 1)
+
+		statements = append(statements, func(frame *Frame) bool {
+			key, val := operands(frame)
+			frame.Runtime.SetTable(position, frame.get(register), key, val)
+			return false
+		})
+	}
+
+	for _, entry := range valuePairs(literal.entries) {
+		val := builder.operand(entry.(Value).value).get
+		position := builder.mark()
+		function.free(register + 1)
+
+		statements = append(statements, func(frame *Frame) bool {
+			val := val(frame)
+			frame.Runtime.Insert(position, frame.get(register), val)
+			return false
+		})
+	}
+
+	return register, sequence(statements)
+}
+
+// Greater than comparisons swap the operands of less than. Two integers are
+// compared without going through the VM
+func (builder *closureBuilder) compare(op scanner.TokenType, position int, operands pairClosure) conditionClosure {
+	switch op {
+	case scanner.TokenEqualEqual:
+		return func(frame *Frame) bool {
+			a, b := operands(frame)
+			return value.Equal(a, b)
+		}
+	case scanner.TokenTildeEqual:
+		return func(frame *Frame) bool {
+			a, b := operands(frame)
+			return !value.Equal(a, b)
+		}
+	case scanner.TokenLess:
+		return func(frame *Frame) bool {
+			a, b := operands(frame)
+			if a.IsInteger() && b.IsInteger() {
+				return a.AsInteger() < b.AsInteger()
+			}
+
+			return frame.Runtime.Compare(position, a, b, value.NumberLess)
+		}
+	case scanner.TokenLessEqual:
+		return func(frame *Frame) bool {
+			a, b := operands(frame)
+			if a.IsInteger() && b.IsInteger() {
+				return a.AsInteger() <= b.AsInteger()
+			}
+
+			return frame.Runtime.Compare(position, a, b, value.NumberLessEqual)
+		}
+	case scanner.TokenGreater:
+		return func(frame *Frame) bool {
+			a, b := operands(frame)
+			if a.IsInteger() && b.IsInteger() {
+				return b.AsInteger() < a.AsInteger()
+			}
+
+			return frame.Runtime.Compare(position, b, a, value.NumberLess)
+		}
+	case scanner.TokenGreaterEqual:
+		return func(frame *Frame) bool {
+			a, b := operands(frame)
+			if a.IsInteger() && b.IsInteger() {
+				return b.AsInteger() <= a.AsInteger()
+			}
+
+			return frame.Runtime.Compare(position, b, a, value.NumberLessEqual)
+		}
+	default:
+		panic(fmt.Sprint("Internal error: unknown comparator operator: ", op))
+	}
+}
+
+// Integers and floats are added, subtracted and multiplied without going
+// through the VM. Division always produces a float
+func (builder *closureBuilder) arithmetic(op scanner.TokenType, operands pairClosure) expressionClosure {
+	position := builder.mark()
+
+	switch op {
+	case scanner.TokenPlus:
+		return func(frame *Frame) value.Value {
+			a, b := operands(frame)
+
+			switch {
+			case a.IsInteger() && b.IsInteger():
+				return value.Integer(a.AsInteger() + b.AsInteger())
+			case a.Kind() == value.KindNumber && b.Kind() == value.KindNumber:
+				return value.Number(a.AsNumber() + b.AsNumber())
+			}
+
+			return frame.Runtime.Arithmetic(
+				position, "add", a, b,
+				func(a, b int64) int64 { return a + b },
+				func(a, b float64) float64 { return a + b },
+			)
+		}
+	case scanner.TokenMinus:
+		return func(frame *Frame) value.Value {
+			a, b := operands(frame)
+
+			switch {
+			case a.IsInteger() && b.IsInteger():
+				return value.Integer(a.AsInteger() - b.AsInteger())
+			case a.Kind() == value.KindNumber && b.Kind() == value.KindNumber:
+				return value.Number(a.AsNumber() - b.AsNumber())
+			}
+
+			return frame.Runtime.Arithmetic(
+				position, "subtract", a, b,
+				func(a, b int64) int64 { return a - b },
+				func(a, b float64) float64 { return a - b },
+			)
+		}
+	case scanner.TokenStar:
+		return func(frame *Frame) value.Value {
+			a, b := operands(frame)
+
+			switch {
+			case a.IsInteger() && b.IsInteger():
+				return value.Integer(a.AsInteger() * b.AsInteger())
+			case a.Kind() == value.KindNumber && b.Kind() == value.KindNumber:
+				return value.Number(a.AsNumber() * b.AsNumber())
+			}
+
+			return frame.Runtime.Arithmetic(
+				position, "multiply", a, b,
+				func(a, b int64) int64 { return a * b },
+				func(a, b float64) float64 { return a * b },
+			)
+		}
+	case scanner.TokenSlash:
+		return func(frame *Frame) value.Value {
+			a, b := operands(frame)
+			if a.IsNumber() && b.IsNumber() {
+				return value.Number(a.AsNumber() / b.AsNumber())
+			}
+
+			return frame.Runtime.Arithmetic(position, "divide", a, b, nil, func(a, b float64) float64 { return a / b })
+		}
+	default:
+		panic(fmt.Sprint("Internal error: unknown arithmetic operator: ", op))
+	}
+}
+
+func bitwiseOperation(op scanner.TokenType) func(int64, int64) int64 {
+	switch op {
+	case scanner.TokenPipe:
+		return func(a, b int64) int64 { return a | b }
+	case scanner.TokenTilde:
+		return func(a, b int64) int64 { return a ^ b }
+	case scanner.TokenAmpersand:
+		return func(a, b int64) int64 { return a & b }
+	case scanner.TokenLessLess:
+		return value.ShiftLeft
+	case scanner.TokenGreaterGreater:
+		return value.ShiftRight
+	default:
+		panic(fmt.Sprint("Internal error: unknown bitwise operator: ", op))
+	}
+}
@@ -3,18 +3,57 @@ package compiler
 import (
 	"arlindohall/glua/constants"
 	"arlindohall/glua/glerror"
+	"arlindohall/glua/options"
 	"arlindohall/glua/scanner"
 	"arlindohall/glua/value"
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
 )
 
+// Instructions work on the registers of the running function, which are its
+// slots on the VM's stack. R(x) is register x, K(x) is constant x and RK(x) is
+// either one, see IsConstant. The operands each instruction uses:
+//
+//	OpAdd, OpSubtract, OpMult, OpDivide   A B C   R(A) := RK(B) op RK(C)
+//	OpBitAnd, OpBitOr, OpBitXor           A B C   R(A) := RK(B) op RK(C)
+//	OpShiftLeft, OpShiftRight             A B C   R(A) := RK(B) op RK(C)
+//	OpEquals, OpLess, OpLessEqual         A B C   R(A) := RK(B) op RK(C)
+//	OpAnd, OpOr                           A B C   R(A) := RK(B) op RK(C)
+//	OpNegate, OpNot, OpBitNot, OpLength   A B     R(A) := op RK(B)
+//	OpAssert                              A B     error RK(B) unless R(A)
+//	OpMove                                A B     R(A) := R(B)
+//	OpConstant                            A Bx    R(A) := K(Bx)
+//	OpNil                                 A B     R(A), ..., R(A+B-1) := nil
+//	OpGetGlobal                           A Bx    R(A) := Env[G(Bx)]
+//	OpSetGlobal                           A Bx    Env[G(Bx)] := R(A)
+//	OpGetEnv                              A       R(A) := Env
+//	OpGetUpvalue                          A B     R(A) := Upvalue[B]
+//	OpSetUpvalue                          A B     Upvalue[B] := R(A)
+//	OpCreateTable                         A       R(A) := {}
+//	OpGetTable                            A B C   R(A) := R(B)[RK(C)]
+//	OpSetTable                            A B C   R(A)[RK(B)] := RK(C)
+//	OpInsertTable                         A B     append RK(B) to R(A)
+//	OpClosure                             A Bx    R(A) := closure of K(Bx)
+//	OpCreateUpvalue                       A B C   capture local (C=1) or upvalue B for R(A)
+//	OpCloseUpvalues                       A       close variables in R(A) and above
+//	OpMarkClose                           A Bx    R(A) is to-be-closed, named K(Bx)
+//	OpJump                                sJ      ip += sJ
+//	OpTest                                A C     skip the next instruction unless R(A) is C
+//	OpTestEquals, OpTestLess, ...         A B C   skip the next instruction unless (RK(B) op RK(C)) is A
+//	OpCall                                A B C   R(A), ..., R(A+C-2) := R(A)(R(A+1), ..., R(A+B-1))
+//	OpTailCall                            A B     return R(A)(R(A+1), ..., R(A+B-1))
+//	OpReturn                              A B     return R(A), ..., R(A+B-2)
 const (
 	OpAdd = iota
-	OpAssert
-	OpAssignCleanup
-	OpAssignStart
 	OpAnd
+	OpAssert
+	OpBitAnd
+	OpBitNot
+	OpBitOr
+	OpBitXor
 	OpCall
 	OpCloseUpvalues
 	OpClosure
@@ -23,116 +62,233 @@ const (
 	OpCreateUpvalue
 	OpDivide
 	OpEquals
+	OpGetEnv
 	OpGetGlobal
-	OpGetLocal
 	OpGetTable
 	OpGetUpvalue
-	OpGreater
-	OpJumpIfFalse
+	OpInsertTable
+	OpJump
+	OpLength
 	OpLess
-	OpLocalAllocate
-	OpLocalCleanup
-	OpLoop
+	OpLessEqual
+	OpMarkClose
+	OpMove
 	OpMult
 	OpNegate
 	OpNil
 	OpNot
 	OpOr
-	OpPop
 	OpReturn
 	OpSetGlobal
-	OpSetLocal
 	OpSetTable
 	OpSetUpvalue
-	OpInitTable
-	OpInsertTable
+	OpShiftLeft
+	OpShiftRight
 	OpSubtract
-	OpZero
+	OpTailCall
+	OpTest
+	OpTestEquals
+	OpTestLess
+	OpTestLessEqual
+)
+
+// Every local has its own register and temporaries are allocated above them,
+// a function can use as many registers as operand A can address
+const (
+	maxRegisters = MaxRegister + 1
+	maxLocals    = 200
+	maxUpvalues  = MaxRegister + 1
+	maxArguments = MaxRegister - 1
+	maxConstants = MaxBx + 1
+	maxGlobals   = MaxBx + 1
 )
 
+// Compilation stops after this many errors, past that they are mostly noise
+const maxErrors = 10
+
 type ReturnMode int
 
+type Attribute int
+
+const (
+	AttribNone Attribute = iota
+	AttribConst
+	AttribClose
+)
+
+// Locals declared <const> with a constant initializer keep its value so
+// reads can be folded into a constant instead of a register access. Captured
+// locals have to be closed when they go out of scope
 type Local struct {
-	name  Identifier
-	scope int
+	name     Identifier
+	scope    int
+	attrib   Attribute
+	constant *value.Value
+	captured bool
 }
 
+// Registers below `registers` are in use, the locals in order followed by
+// temporaries. In the REPL the value of an expression statement is returned
+// if it's the last thing the script does, `result` is where it was left.
+// `loopDepth` counts the loops around what is being parsed in the current
+// function and `loops` the ones around what is being emitted
 type compiler struct {
-	text     []scanner.Token
-	curr     int
-	chunk    value.Chunk
-	name     string
-	locals   []Local
-	upvalues []*Upvalue
-	scope    int
-	err      glerror.GluaErrorChain
-	mode     ReturnMode
-	parent   *compiler
+	tokens    *scanner.TokenStream
+	chunk     value.Chunk
+	name      string
+	locals    []Local
+	upvalues  []*Upvalue
+	scope     int
+	loopDepth int
+	loops     []loop
+	registers int
+	result    replResult
+	err       glerror.GluaErrorChain
+	mode      ReturnMode
+	parent    *compiler
+	constants map[constantKey]int
+	globals   map[Identifier]int
+	strings   map[string]value.Value
+	position  glerror.Span
+	emitting  bool
+	panicking bool
+	exhausted bool
+	options   options.Options
+	keepTree  bool
+	tree      []declaration
+}
+
+// A top-level declaration and where it starts, kept for GenerateGo and the
+// closures backend
+type declaration struct {
+	node Node
+	span glerror.Span
+}
+
+type replResult struct {
+	register int
+	end      int
+}
+
+type constantKind int
+
+const (
+	constantNil constantKind = iota
+	constantBoolean
+	constantInteger
+	constantFloat
+	constantString
+)
+
+// Constants are indexed by their kind and exact bits, so 1 and 1.0 or 0.0
+// and -0.0 are kept apart and a NaN can still be found again
+type constantKey struct {
+	kind constantKind
+	bits uint64
+	text string
 }
 
+// A script compiled for the closures backend keeps its syntax tree, see
+// Closures
 type Function struct {
 	Chunk    value.Chunk
 	Name     string
 	Upvalues []*Upvalue
+	syntax   *syntax
+}
+
+type syntax struct {
+	tree []declaration
+	mode ReturnMode
 }
 
 type Upvalue struct {
-	index   int
-	name    Identifier
-	isLocal bool
+	index    int
+	name     Identifier
+	isLocal  bool
+	attrib   Attribute
+	constant *value.Value
+}
+
+// The source is the one the scanner builds while reading the tokens, it is
+// kept on the chunk so errors can show the offending line. Each declaration
+// is emitted once it's parsed, so only the tokens of the one being parsed
+// are needed at a time
+func Compile(tokens *scanner.TokenStream, mode ReturnMode, source *glerror.Source, options options.Options) (Function, glerror.GluaErrorChain) {
+	compiler := newCompiler(tokens, mode, source, options)
+	compiler.keepTree = options.Closures()
+	compiler.compile()
+
+	return compiler.end()
 }
 
-func Compile(text []scanner.Token, mode ReturnMode) (Function, glerror.GluaErrorChain) {
-	compiler := compiler{
-		text:   text,
-		curr:   0,
-		chunk:  value.Chunk{},
-		name:   "",
-		locals: []Local{{"", 0}}, // Top-level function has no name
-		scope:  0,
-		err:    glerror.GluaErrorChain{},
-		mode:   mode,
+func newCompiler(tokens *scanner.TokenStream, mode ReturnMode, source *glerror.Source, options options.Options) *compiler {
+	compiler := &compiler{
+		tokens:  tokens,
+		chunk:   value.Chunk{Source: source},
+		name:    "",
+		locals:  []Local{{name: "", scope: 0}}, // Top-level function has no name
+		scope:   0,
+		err:     glerror.GluaErrorChain{},
+		mode:    mode,
+		options: options,
 	}
 
-	compiler.compile()
+	compiler.allocate(len(compiler.locals))
 
-	return compiler.end()
+	return compiler
 }
 
 func (compiler *compiler) compile() {
 	for compiler.current().Type != scanner.TokenEof {
+		if compiler.err.Len() >= maxErrors {
+			compiler.err.Append(CompileError{
+				message: "Too many errors, stopping",
+				span:    compiler.current().Span(),
+				source:  compiler.chunk.Source,
+			})
+			return
+		}
+
+		span := compiler.current().Span()
+		errors, panicking := compiler.err.Len(), compiler.panicking
 		decl := compiler.declaration()
-		if constants.DebugAst {
+		if compiler.options.DumpAst {
 			var node Node = decl
-			PrintTree(&node)
+			PrintTree(compiler.options.Writer(), &node)
+		}
+
+		// A declaration with syntax errors may be missing parts, don't emit it
+		if panicking || compiler.err.Len() > errors {
+			continue
 		}
+
+		compiler.emitting = true
+		compiler.at(span)
 		decl.Emit(compiler)
-	}
-}
+		compiler.emitting = false
 
-func (compiler *compiler) peek() scanner.Token {
-	if compiler.curr+1 >= len(compiler.text) {
-		// todo: when pulling one token at a time use the line of the last token
-		return scanner.Token{
-			Type: scanner.TokenEof,
-			Text: "",
-			Line: -1,
+		if compiler.keepTree {
+			compiler.tree = append(compiler.tree, declaration{decl, span})
 		}
 	}
+}
 
-	return compiler.text[compiler.curr+1]
+func (compiler *compiler) peek() scanner.Token {
+	return compiler.tokens.Peek()
 }
 
 func (compiler *compiler) current() scanner.Token {
-	if compiler.curr >= len(compiler.text) {
-		return scanner.Token{
-			Type: scanner.TokenEof,
-			Text: "",
-			Line: -1,
-		}
-	}
+	return compiler.tokens.Current()
+}
 
-	return compiler.text[compiler.curr]
+// Bytes emitted after this are attributed to the span until it is moved again
+func (compiler *compiler) at(span glerror.Span) {
+	compiler.position = span
+}
+
+func (compiler *compiler) previous() scanner.Token {
+	return compiler.tokens.Previous()
 }
 
 func (compiler *compiler) check(tt scanner.TokenType) bool {
@@ -155,13 +311,54 @@ func (compiler *compiler) declaration() Node {
 		compiler.consume(scanner.TokenSemicolon)
 	}
 
+	if compiler.panicking {
+		compiler.synchronize()
+	}
+
 	return state
 }
 
+// After a syntax error skip ahead to the start of the next statement so the
+// rest of the source is still checked. Block terminators stop the skipping
+// but leave the compiler panicking, the enclosing statement will consume them
+// and anything it reports about them would only repeat the first error.
+func (compiler *compiler) synchronize() {
+	for !compiler.check(scanner.TokenEof) {
+		switch compiler.current().Type {
+		case scanner.TokenEnd, scanner.TokenElse:
+			return
+		case scanner.TokenGlobal, scanner.TokenLocal, scanner.TokenFunction,
+			scanner.TokenIf, scanner.TokenWhile, scanner.TokenFor, scanner.TokenDo,
+			scanner.TokenReturn, scanner.TokenBreak, scanner.TokenAssert:
+			compiler.panicking = false
+			return
+		case scanner.TokenSemicolon:
+			compiler.advance()
+			compiler.panicking = false
+			return
+		case scanner.TokenIdentifier:
+			// Statements don't need a separator, a name at the start of a
+			// line most likely starts the next one
+			if compiler.current().Line > compiler.previous().Line {
+				compiler.panicking = false
+				return
+			}
+		}
+
+		compiler.advance()
+	}
+}
+
 func (compiler *compiler) global() Node {
 	compiler.consume(scanner.TokenGlobal)
 
-	return compiler.variableDeclaration(func(names []Identifier, values []Node) Node {
+	return compiler.variableDeclaration(func(names []Identifier, attribs []Attribute, values []Node) Node {
+		for _, attrib := range attribs {
+			if attrib != AttribNone {
+				compiler.error("Attributes are only allowed on local variables")
+			}
+		}
+
 		return GlobalDeclaration{
 			names:  names,
 			values: values,
@@ -172,24 +369,38 @@ func (compiler *compiler) global() Node {
 func (compiler *compiler) local() Node {
 	compiler.consume(scanner.TokenLocal)
 
-	return compiler.variableDeclaration(func(names []Identifier, values []Node) Node {
+	return compiler.variableDeclaration(func(names []Identifier, attribs []Attribute, values []Node) Node {
+		closing := 0
+		for _, attrib := range attribs {
+			if attrib == AttribClose {
+				closing += 1
+			}
+		}
+
+		if closing > 1 {
+			compiler.error("Multiple to-be-closed variables in local list")
+		}
+
 		return LocalDeclaration{
-			names:  names,
-			values: values,
+			names:   names,
+			attribs: attribs,
+			values:  values,
 		}
 	})
 }
 
-func (compiler *compiler) variableDeclaration(constructor func([]Identifier, []Node) Node) Node {
+func (compiler *compiler) variableDeclaration(constructor func([]Identifier, []Attribute, []Node) Node) Node {
 	names := []Identifier{compiler.identifier()}
+	attribs := []Attribute{compiler.attribute()}
 
 	for compiler.check(scanner.TokenComma) {
 		compiler.consume(scanner.TokenComma)
 		names = append(names, compiler.identifier())
+		attribs = append(attribs, compiler.attribute())
 	}
 
 	if !compiler.check(scanner.TokenEqual) {
-		return constructor(names, nil)
+		return constructor(names, attribs, nil)
 	}
 
 	compiler.consume(scanner.TokenEqual)
@@ -197,19 +408,38 @@ func (compiler *compiler) variableDeclaration(constructor func([]Identifier, []N
 	values := []Node{compiler.rightHandSideExpression()}
 
 	for compiler.check(scanner.TokenComma) {
+		compiler.consume(scanner.TokenComma)
 		values = append(values, compiler.rightHandSideExpression())
 	}
 
-	return constructor(names, values)
+	return constructor(names, attribs, values)
+}
+
+// Attributes follow the name in a local declaration: `local x <const> = 1`
+func (compiler *compiler) attribute() Attribute {
+	if !compiler.check(scanner.TokenLess) {
+		return AttribNone
+	}
+
+	compiler.consume(scanner.TokenLess)
+	name := compiler.identifier()
+	compiler.expect(scanner.TokenGreater, "after attribute name")
+
+	switch name {
+	case "const":
+		return AttribConst
+	case "close":
+		return AttribClose
+	default:
+		compiler.error(fmt.Sprintf("Unknown attribute '%s'", name))
+		return AttribNone
+	}
 }
 
 func (compiler *compiler) statement() Node {
 	switch compiler.current().Type {
 	case scanner.TokenAssert:
-		compiler.consume(scanner.TokenAssert)
-		return AssertStatement{
-			value: compiler.expression(),
-		}
+		return compiler.assertStatement()
 	case scanner.TokenFunction:
 		return compiler.function()
 	case scanner.TokenWhile:
@@ -219,32 +449,71 @@ func (compiler *compiler) statement() Node {
 	case scanner.TokenIf:
 		return compiler.ifStatement()
 	case scanner.TokenDo:
+		opener := compiler.current()
 		compiler.consume(scanner.TokenDo)
 		block := compiler.block()
-		compiler.consume(scanner.TokenEnd)
+		compiler.closeBlock(opener)
 
 		return block
 	case scanner.TokenReturn:
 		return compiler.returnStatement()
+	case scanner.TokenBreak:
+		return compiler.breakStatement()
 	default:
 		return compiler.assignment()
 	}
 }
 
+// A failed assertion reports the asserted expression as it was written, or
+// the message if one is given: `assert x > 0, "x must be positive"`
+func (compiler *compiler) assertStatement() Node {
+	compiler.consume(scanner.TokenAssert)
+
+	start := compiler.current()
+	value := compiler.expression()
+	end := compiler.previous()
+
+	var message Node
+	if compiler.check(scanner.TokenComma) {
+		compiler.consume(scanner.TokenComma)
+		message = compiler.expression()
+	} else {
+		text := compiler.chunk.Source.Text(start.Span(), end.Span())
+		message = StringPrimary("assertion failed: " + text)
+	}
+
+	span := start.Span()
+	if end.Line == start.Line {
+		span.Length = end.Column + end.Length - start.Column
+	}
+
+	return AssertStatement{
+		value:   value,
+		message: message,
+		span:    span,
+	}
+}
+
 func (compiler *compiler) function() Node {
+	opener := compiler.current()
 	compiler.consume(scanner.TokenFunction)
 
+	span := compiler.current().Span()
 	name := compiler.identifier()
 
 	parameters := compiler.parameters()
 	var declarations []Node
 
-	// todo: better error messages about non-terminated function
+	// A break can't leave the function for a loop around it
+	loopDepth := compiler.loopDepth
+	compiler.loopDepth = 0
+
 	for !compiler.check(scanner.TokenEnd) && !compiler.check(scanner.TokenEof) {
 		declarations = append(declarations, compiler.declaration())
 	}
 
-	compiler.consume(scanner.TokenEnd)
+	compiler.loopDepth = loopDepth
+	compiler.closeBlock(opener)
 
 	var body Node
 	if len(declarations) == 1 {
@@ -253,11 +522,11 @@ func (compiler *compiler) function() Node {
 		body = BlockStatement{declarations}
 	}
 
-	return FunctionNode{name, parameters, body}
+	return FunctionNode{name, parameters, body, span}
 }
 
 func (compiler *compiler) parameters() []Identifier {
-	compiler.consume(scanner.TokenLeftParen)
+	compiler.expect(scanner.TokenLeftParen, "after function name")
 
 	var identifiers []Identifier
 	for !compiler.check(scanner.TokenEof) && !compiler.check(scanner.TokenRightParen) {
@@ -270,7 +539,7 @@ func (compiler *compiler) parameters() []Identifier {
 		}
 	}
 
-	compiler.consume(scanner.TokenRightParen)
+	compiler.expect(scanner.TokenRightParen, "after parameters")
 
 	return identifiers
 }
@@ -290,21 +559,31 @@ func (compiler *compiler) block() BlockStatement {
 // allow, for example: `do x = 1 then`
 func (compiler *compiler) terminateBlock() bool {
 	switch compiler.current().Type {
-	case scanner.TokenEnd, scanner.TokenElse:
+	case scanner.TokenEnd, scanner.TokenElse, scanner.TokenEof:
 		return true
 	default:
 		return false
 	}
 }
 
+// A block that a break can leave
+func (compiler *compiler) loopBody() BlockStatement {
+	compiler.loopDepth += 1
+	body := compiler.block()
+	compiler.loopDepth -= 1
+
+	return body
+}
+
 func (compiler *compiler) whileStatement() Node {
+	opener := compiler.current()
 	compiler.consume(scanner.TokenWhile)
 
 	expression := compiler.expression()
 
-	compiler.consume(scanner.TokenDo)
-	body := compiler.block()
-	compiler.consume(scanner.TokenEnd)
+	compiler.expectBlock(scanner.TokenDo, "after while condition")
+	body := compiler.loopBody()
+	compiler.closeBlock(opener)
 
 	return WhileStatement{
 		condition: expression,
@@ -313,21 +592,22 @@ func (compiler *compiler) whileStatement() Node {
 }
 
 func (compiler *compiler) forStatement() Node {
+	opener := compiler.current()
 	compiler.consume(scanner.TokenFor)
 
 	variable := compiler.identifier()
 
 	if compiler.check(scanner.TokenEqual) {
-		return compiler.numericFor(variable)
+		return compiler.numericFor(opener, variable)
 	} else if compiler.check(scanner.TokenComma) || compiler.check(scanner.TokenIn) {
-		return compiler.genericFor(variable)
+		return compiler.genericFor(opener, variable)
 	} else {
-		compiler.error("Expected '=' or 'in' in for statement.")
+		compiler.syntaxError(fmt.Sprint("Expected '=' or 'in' after for variable, found ", compiler.current().Describe()))
 		return NumericForStatement{variable, nil, nil}
 	}
 }
 
-func (compiler *compiler) genericFor(variable Identifier) Node {
+func (compiler *compiler) genericFor(opener scanner.Token, variable Identifier) Node {
 	targets := []Identifier{variable}
 
 	for compiler.check(scanner.TokenComma) {
@@ -335,7 +615,8 @@ func (compiler *compiler) genericFor(variable Identifier) Node {
 		targets = append(targets, compiler.identifier())
 	}
 
-	compiler.consume(scanner.TokenIn)
+	compiler.expect(scanner.TokenIn, "after for variables")
+	span := compiler.current().Span()
 
 	// Use rightHandSideExpression because we actually do a
 	// multiple assignment with these
@@ -347,18 +628,19 @@ func (compiler *compiler) genericFor(variable Identifier) Node {
 		iterator = append(iterator, compiler.rightHandSideExpression())
 	}
 
-	compiler.consume(scanner.TokenDo)
-	body := compiler.block()
-	compiler.consume(scanner.TokenEnd)
+	compiler.expectBlock(scanner.TokenDo, "after for iterator")
+	body := compiler.loopBody()
+	compiler.closeBlock(opener)
 
 	return GenericForStatement{
 		targets:  targets,
 		iterator: iterator,
 		body:     body,
+		span:     span,
 	}
 }
 
-func (compiler *compiler) numericFor(variable Identifier) Node {
+func (compiler *compiler) numericFor(opener scanner.Token, variable Identifier) Node {
 	compiler.consume(scanner.TokenEqual)
 
 	// Doesn't use rightHandSideExpression because we only
@@ -370,9 +652,9 @@ func (compiler *compiler) numericFor(variable Identifier) Node {
 		values = append(values, compiler.expression())
 	}
 
-	compiler.consume(scanner.TokenDo)
-	body := compiler.block()
-	compiler.consume(scanner.TokenEnd)
+	compiler.expectBlock(scanner.TokenDo, "after for range")
+	body := compiler.loopBody()
+	compiler.closeBlock(opener)
 
 	return NumericForStatement{
 		variable: variable,
@@ -382,17 +664,18 @@ func (compiler *compiler) numericFor(variable Identifier) Node {
 }
 
 func (compiler *compiler) ifStatement() Node {
+	opener := compiler.current()
 	compiler.consume(scanner.TokenIf)
 
 	condition := compiler.expression()
 
-	compiler.consume(scanner.TokenThen)
+	compiler.expectBlock(scanner.TokenThen, "after if condition")
 	body := compiler.block()
 
 	if compiler.check(scanner.TokenElse) {
 		compiler.consume(scanner.TokenElse)
 		counterfactual := compiler.block()
-		compiler.consume(scanner.TokenEnd)
+		compiler.closeBlock(opener)
 
 		return IfStatement{
 			condition:      condition,
@@ -400,7 +683,7 @@ func (compiler *compiler) ifStatement() Node {
 			counterfactual: counterfactual,
 		}
 	} else {
-		compiler.consume(scanner.TokenEnd)
+		compiler.closeBlock(opener)
 
 		return IfStatement{
 			condition: condition,
@@ -414,7 +697,6 @@ func (compiler *compiler) returnStatement() Node {
 
 	if compiler.check(scanner.TokenEnd) || compiler.check(scanner.TokenElse) {
 		return ReturnStatement{
-			arity:  1,
 			values: []Node{NilPrimary()},
 		}
 	}
@@ -426,13 +708,25 @@ func (compiler *compiler) returnStatement() Node {
 		expressions = append(expressions, compiler.expression())
 	}
 
-	// todo: overflow
+	if len(expressions) > maxArguments {
+		compiler.error(fmt.Sprint("Too many return values, limit is ", maxArguments))
+	}
+
 	return ReturnStatement{
-		arity:  byte(len(expressions)),
 		values: expressions,
 	}
 }
 
+func (compiler *compiler) breakStatement() Node {
+	compiler.consume(scanner.TokenBreak)
+
+	if compiler.loopDepth == 0 {
+		compiler.errorAt(compiler.previous().Span(), "Break outside a loop")
+	}
+
+	return BreakStatement{}
+}
+
 func (compiler *compiler) assignment() Node {
 	expression := compiler.expression()
 	if compiler.check(scanner.TokenEqual) || compiler.check(scanner.TokenComma) {
@@ -451,7 +745,7 @@ func (compiler *compiler) multipleAssignment(node Node) Node {
 		variables = append(variables, compiler.expression())
 	}
 
-	compiler.consume(scanner.TokenEqual)
+	compiler.expect(scanner.TokenEqual, "in assignment")
 
 	values := []Node{compiler.rightHandSideExpression()}
 
@@ -484,6 +778,10 @@ func (compiler *compiler) rightHandSideExpression() Node {
 
 func (compiler *compiler) identifier() Identifier {
 	ident := compiler.current().Text
+	if !compiler.check(scanner.TokenIdentifier) {
+		ident = ""
+	}
+
 	compiler.consume(scanner.TokenIdentifier)
 	return Identifier(ident)
 }
@@ -531,7 +829,7 @@ func (compiler *compiler) logicAnd() Node {
 }
 
 func (compiler *compiler) comparison() Node {
-	term := compiler.term()
+	term := compiler.bitwiseOr()
 
 	if !compiler.isComparison() {
 		return term
@@ -540,11 +838,12 @@ func (compiler *compiler) comparison() Node {
 	compare := Comparison{term, nil}
 
 	for compiler.isComparison() {
-		token := compiler.current().Type
+		token := compiler.current()
 		compiler.advance()
 		compItem := ComparisonItem{
-			term:      compiler.term(),
-			compareOp: token,
+			term:      compiler.bitwiseOr(),
+			compareOp: token.Type,
+			span:      token.Span(),
 		}
 		compare.items = append(compare.items, compItem)
 	}
@@ -562,6 +861,57 @@ func (compiler *compiler) isComparison() bool {
 	}
 }
 
+// Bitwise operators bind tighter than comparison and looser than
+// arithmetic, from lowest to highest: '|', '~', '&', then shifts
+func (compiler *compiler) bitwiseOr() Node {
+	return compiler.bitwise(compiler.bitwiseXor, scanner.TokenPipe)
+}
+
+func (compiler *compiler) bitwiseXor() Node {
+	return compiler.bitwise(compiler.bitwiseAnd, scanner.TokenTilde)
+}
+
+func (compiler *compiler) bitwiseAnd() Node {
+	return compiler.bitwise(compiler.shift, scanner.TokenAmpersand)
+}
+
+func (compiler *compiler) shift() Node {
+	return compiler.bitwise(compiler.term, scanner.TokenLessLess, scanner.TokenGreaterGreater)
+}
+
+func (compiler *compiler) bitwise(operand func() Node, operators ...scanner.TokenType) Node {
+	node := operand()
+
+	if !compiler.isBitwise(operators) {
+		return node
+	}
+
+	bitwise := Bitwise{node, nil}
+
+	for compiler.isBitwise(operators) {
+		token := compiler.current()
+		compiler.advance()
+		bitwiseItem := BitwiseItem{
+			operand:   operand(),
+			bitwiseOp: token.Type,
+			span:      token.Span(),
+		}
+		bitwise.items = append(bitwise.items, bitwiseItem)
+	}
+
+	return bitwise
+}
+
+func (compiler *compiler) isBitwise(operators []scanner.TokenType) bool {
+	for _, op := range operators {
+		if compiler.check(op) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (compiler *compiler) term() Node {
 	factor := compiler.factor()
 
@@ -572,11 +922,12 @@ func (compiler *compiler) term() Node {
 	term := Term{factor, nil}
 
 	for compiler.isTerm() {
-		token := compiler.current().Type
+		token := compiler.current()
 		compiler.advance()
 		termItem := TermItem{
 			factor: compiler.factor(),
-			termOp: token,
+			termOp: token.Type,
+			span:   token.Span(),
 		}
 		term.items = append(term.items, termItem)
 	}
@@ -604,11 +955,12 @@ func (compiler *compiler) factor() Node {
 	factor := Factor{unary, nil}
 
 	for compiler.isFactor() {
-		token := compiler.current().Type
+		token := compiler.current()
 		compiler.advance()
 		factorItem := FactorItem{
 			unary:    compiler.unary(),
-			factorOp: token,
+			factorOp: token.Type,
+			span:     token.Span(),
 		}
 		factor.items = append(factor.items, factorItem)
 	}
@@ -629,21 +981,36 @@ func (compiler *compiler) isFactor() bool {
 func (compiler *compiler) unary() Node {
 	switch compiler.current().Type {
 	case scanner.TokenMinus:
+		span := compiler.current().Span()
 		compiler.advance()
-		return NegateUnary{compiler.unary()}
+		return NegateUnary{compiler.unary(), span}
 	case scanner.TokenBang:
+		span := compiler.current().Span()
+		compiler.advance()
+		return NotUnary{compiler.unary(), span}
+	case scanner.TokenTilde:
+		span := compiler.current().Span()
 		compiler.advance()
-		return NotUnary{compiler.unary()}
+		return BitwiseNotUnary{compiler.unary(), span}
+	case scanner.TokenHash:
+		span := compiler.current().Span()
+		compiler.advance()
+		return LengthUnary{compiler.unary(), span}
 	default:
 		return compiler.exponent()
 	}
 }
 
+// None of the backends can raise to a power yet, so an exponent is parsed
+// and then reported as an error. It's right associative, `2 ^ 3 ^ 2` is
+// `2 ^ (3 ^ 2)`
 func (compiler *compiler) exponent() Node {
 	call := compiler.call()
 	if compiler.check(scanner.TokenCaret) {
+		span := compiler.current().Span()
 		compiler.consume(scanner.TokenCaret)
-		exp := compiler.call()
+		compiler.errorAt(span, "Exponentiation is not supported")
+		exp := compiler.exponent()
 		return Exponent{call, &exp}
 	} else {
 		return call
@@ -658,28 +1025,35 @@ func (compiler *compiler) call() Node {
 		case scanner.TokenDot:
 			compiler.consume(scanner.TokenDot)
 
-			attribute := compiler.identifier()
+			span := compiler.current().Span()
+			attribute := StringPrimary(string(compiler.identifier()))
+			attribute.span = span
 
 			primary = TableAccessor{
 				primary,
-				StringPrimary(string(attribute)),
+				attribute,
+				span,
 			}
 		case scanner.TokenLeftBracket:
+			span := compiler.current().Span()
 			compiler.consume(scanner.TokenLeftBracket)
 			attribute := compiler.expression()
-			compiler.consume(scanner.TokenRightBracket)
+			compiler.expect(scanner.TokenRightBracket, "after index")
 
 			primary = TableAccessor{
 				primary,
 				attribute,
+				span,
 			}
-		case scanner.TokenLeftParen:
+		case scanner.TokenLeftParen, scanner.TokenString, scanner.TokenLeftBrace:
+			span := compiler.current().Span()
 			args := compiler.arguments()
 
 			primary = &Call{
 				base:         primary,
 				arguments:    args,
 				isAssignment: false,
+				span:         span,
 			}
 		}
 	}
@@ -689,59 +1063,54 @@ func (compiler *compiler) call() Node {
 
 func (compiler *compiler) isCall() bool {
 	switch compiler.current().Type {
-	case scanner.TokenDot, scanner.TokenLeftBracket, scanner.TokenLeftParen:
+	case scanner.TokenDot, scanner.TokenLeftBracket, scanner.TokenLeftParen,
+		scanner.TokenString, scanner.TokenLeftBrace:
 		return true
 	default:
 		return false
 	}
 }
 
+// A single string literal or table constructor can be passed without
+// parentheses, as in `require "module"` or `describe { ... }`
 func (compiler *compiler) arguments() []Node {
 	var args []Node
 
+	switch compiler.current().Type {
+	case scanner.TokenString:
+		str := StringPrimary(compiler.current().Text)
+		str.span = compiler.current().Span()
+		compiler.advance()
+		return []Node{str}
+	case scanner.TokenLeftBrace:
+		return []Node{compiler.tableLiteral()}
+	}
+
 	compiler.consume(scanner.TokenLeftParen)
 
-	for !compiler.check(scanner.TokenRightParen) {
+	for !compiler.check(scanner.TokenRightParen) && !compiler.check(scanner.TokenEof) {
 		args = append(args, compiler.expression())
 
-		if !compiler.check(scanner.TokenRightParen) {
+		if compiler.check(scanner.TokenComma) {
 			compiler.consume(scanner.TokenComma)
+		} else {
+			break
 		}
 	}
 
-	compiler.consume(scanner.TokenRightParen)
+	compiler.expect(scanner.TokenRightParen, "after arguments")
 
 	return args
 }
 
 func (compiler *compiler) primary() Node {
-	switch compiler.current().Type {
-	case scanner.TokenTrue:
-		compiler.advance()
-		return BooleanPrimary(true)
-	case scanner.TokenFalse:
+	if literal, ok := compiler.literal(); ok {
+		literal.span = compiler.current().Span()
 		compiler.advance()
-		return BooleanPrimary(false)
-	case scanner.TokenNumber:
-		flt, err := strconv.ParseFloat(
-			compiler.current().Text,
-			64,
-		)
-
-		if err != nil {
-			compiler.error(fmt.Sprint("Cannot parse number: ", compiler.current().Text))
-		}
+		return literal
+	}
 
-		compiler.advance()
-		return NumberPrimary(flt)
-	case scanner.TokenString:
-		str := StringPrimary(compiler.current().Text)
-		compiler.advance()
-		return str
-	case scanner.TokenNil:
-		n := NilPrimary()
-		compiler.advance()
-		return n
+	switch compiler.current().Type {
 	case scanner.TokenIdentifier:
 		return compiler.variable()
 	case scanner.TokenLeftBrace:
@@ -749,24 +1118,85 @@ func (compiler *compiler) primary() Node {
 	case scanner.TokenLeftParen:
 		return compiler.grouping()
 	default:
-		compiler.error(fmt.Sprint("Unexpected token: ", compiler.current()))
+		compiler.syntaxError(fmt.Sprint("Expected expression, found ", compiler.current().Describe()))
 		compiler.advance()
 		return NilPrimary()
 	}
 }
 
+func (compiler *compiler) literal() (LiteralPrimary, bool) {
+	switch compiler.current().Type {
+	case scanner.TokenTrue:
+		return BooleanPrimary(true), true
+	case scanner.TokenFalse:
+		return BooleanPrimary(false), true
+	case scanner.TokenNumber:
+		return compiler.number(compiler.current().Text), true
+	case scanner.TokenString:
+		return StringPrimary(compiler.current().Text), true
+	case scanner.TokenNil:
+		return NilPrimary(), true
+	default:
+		return LiteralPrimary{}, false
+	}
+}
+
+// Decimal integers that overflow become floats and hexadecimal integers
+// wrap around, as in Lua 5.4
+func (compiler *compiler) number(text string) LiteralPrimary {
+	if strings.HasPrefix(text, "0x") {
+		integer, err := strconv.ParseUint(text[2:], 16, 64)
+
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			compiler.error(fmt.Sprint("Cannot parse number: ", text))
+		}
+
+		if errors.Is(err, strconv.ErrRange) {
+			integer = parseWrappingHex(text[2:])
+		}
+
+		return IntegerPrimary(int64(integer))
+	}
+
+	if !strings.ContainsAny(text, ".e") {
+		integer, err := strconv.ParseInt(text, 10, 64)
+
+		if err == nil {
+			return IntegerPrimary(integer)
+		}
+	}
+
+	flt, err := strconv.ParseFloat(text, 64)
+
+	if err != nil {
+		compiler.error(fmt.Sprint("Cannot parse number: ", text))
+	}
+
+	return NumberPrimary(flt)
+}
+
+func parseWrappingHex(text string) uint64 {
+	var integer uint64
+	for _, r := range text {
+		digit, _ := strconv.ParseUint(string(r), 16, 64)
+		integer = integer<<4 | digit
+	}
+
+	return integer
+}
+
 func (compiler *compiler) grouping() Node {
 	compiler.consume(scanner.TokenLeftParen)
 	node := compiler.expression()
-	compiler.consume(scanner.TokenRightParen)
+	compiler.expect(scanner.TokenRightParen, "after expression")
 
 	return node
 }
 
 func (compiler *compiler) variable() Node {
-	name := compiler.current().Text
+	token := compiler.current()
 	compiler.advance()
-	return VariablePrimary{Identifier(name)}
+	return VariablePrimary{Identifier(token.Text), token.Span()}
 }
 
 func (compiler *compiler) getLocal(name Identifier) int {
@@ -795,7 +1225,8 @@ func (compiler *compiler) getUpvalue(name Identifier) int {
 		// this won't resolve at top level because we checked in the calling context
 		if local.name == name {
 			// found one, make an upvalue pointing to the local
-			return compiler.makeUpvalue(name, i, true)
+			compiler.parent.locals[i].captured = true
+			return compiler.makeUpvalue(name, i, true, local.attrib, local.constant)
 		}
 	}
 
@@ -807,17 +1238,24 @@ func (compiler *compiler) getUpvalue(name Identifier) int {
 		return upvalue
 	} else {
 		// the enclosing scope has an upvalue, make an upvalue pointing at that one
-		return compiler.makeUpvalue(name, upvalue, false)
+		enclosing := compiler.parent.upvalues[upvalue]
+		return compiler.makeUpvalue(name, upvalue, false, enclosing.attrib, enclosing.constant)
 	}
 }
 
-func (compiler *compiler) makeUpvalue(name Identifier, index int, isLocal bool) int {
+func (compiler *compiler) makeUpvalue(name Identifier, index int, isLocal bool, attrib Attribute, constant *value.Value) int {
 	upvalue := len(compiler.upvalues)
 
+	if upvalue >= maxUpvalues {
+		compiler.error(fmt.Sprint("Too many upvalues in function, limit is ", maxUpvalues))
+	}
+
 	compiler.upvalues = append(compiler.upvalues, &Upvalue{
-		name:    name,
-		index:   index,
-		isLocal: isLocal,
+		name:     name,
+		index:    index,
+		isLocal:  isLocal,
+		attrib:   attrib,
+		constant: constant,
 	})
 
 	return upvalue
@@ -827,12 +1265,18 @@ func (compiler *compiler) tableLiteral() TableLiteral {
 	compiler.advance()
 	var pairs []Node
 
-	// todo: handle unterminated brace
-	for compiler.current().Type != scanner.TokenRightBrace {
+	// Fields are separated by ',' or ';' and the last may have a trailing separator
+	for !compiler.check(scanner.TokenRightBrace) && !compiler.check(scanner.TokenEof) {
 		pairs = append(pairs, compiler.pair())
+
+		if compiler.check(scanner.TokenComma) || compiler.check(scanner.TokenSemicolon) {
+			compiler.advance()
+		} else {
+			break
+		}
 	}
 
-	compiler.consume(scanner.TokenRightBrace)
+	compiler.expect(scanner.TokenRightBrace, "after table fields")
 
 	return TableLiteral{pairs}
 }
@@ -853,15 +1297,11 @@ func (compiler *compiler) literalPair() Node {
 
 	expr := compiler.expression()
 
-	compiler.consume(scanner.TokenRightBracket)
-	compiler.consume(scanner.TokenEqual)
+	compiler.expect(scanner.TokenRightBracket, "after table key")
+	compiler.expect(scanner.TokenEqual, "after table key")
 
 	value := compiler.expression()
 
-	if compiler.check(scanner.TokenComma) {
-		compiler.consume(scanner.TokenComma)
-	}
-
 	return LiteralPair{
 		key:   expr,
 		value: value,
@@ -869,17 +1309,15 @@ func (compiler *compiler) literalPair() Node {
 }
 
 func (compiler *compiler) stringPair() Node {
-	ident := compiler.identifier()
-	compiler.consume(scanner.TokenEqual)
+	span := compiler.current().Span()
+	key := StringPrimary(string(compiler.identifier()))
+	key.span = span
+	compiler.expect(scanner.TokenEqual, "after field name")
 
 	expr := compiler.expression()
 
-	if compiler.check(scanner.TokenComma) {
-		compiler.consume(scanner.TokenComma)
-	}
-
 	return StringPair{
-		key:   StringPrimary(string(ident)),
+		key:   key,
 		value: expr,
 	}
 }
@@ -887,107 +1325,282 @@ func (compiler *compiler) stringPair() Node {
 func (compiler *compiler) value() Node {
 	expr := compiler.expression()
 
-	if compiler.check(scanner.TokenComma) {
-		compiler.consume(scanner.TokenComma)
-	}
-
 	return Value{expr}
 }
 
 func (compiler *compiler) advance() {
-	compiler.curr += 1
+	compiler.tokens.Advance()
 }
 
 func (compiler *compiler) consume(tt scanner.TokenType) {
-	if compiler.current().Type != tt {
-		compiler.error(fmt.Sprint("Expected type ", tt, ", found ", compiler.current().Type))
+	compiler.expect(tt, "")
+}
+
+// A missing token is reported without advancing, so a forgotten 'then' does
+// not also swallow the first token of the block
+func (compiler *compiler) expect(tt scanner.TokenType, context string) {
+	if compiler.check(tt) {
+		compiler.advance()
+		return
 	}
 
-	compiler.advance()
+	expected := tt.Describe()
+	if context != "" {
+		expected += " " + context
+	}
+
+	compiler.syntaxError(fmt.Sprintf("Expected %s, found %s", expected, compiler.current().Describe()))
 }
 
-// todo: use longer values for more constants
-func (compiler *compiler) makeConstant(value value.Value) byte {
-	for i, c := range compiler.chunk.Constants {
-		if c == value {
-			return byte(i)
-		}
+// A missing 'then' or 'do' is reported and the block is parsed as if it had
+// been there, so its statements are still checked and its 'end' still
+// closes it. Writing the other one, as in `if x do`, takes its place
+func (compiler *compiler) expectBlock(tt scanner.TokenType, context string) {
+	if compiler.check(tt) {
+		compiler.advance()
+		return
+	}
+
+	compiler.error(fmt.Sprintf("Expected %s %s, found %s", tt.Describe(), context, compiler.current().Describe()))
+
+	if compiler.check(scanner.TokenThen) || compiler.check(scanner.TokenDo) {
+		compiler.advance()
+	}
+}
+
+func (compiler *compiler) closeBlock(opener scanner.Token) {
+	compiler.expect(scanner.TokenEnd, fmt.Sprintf("to close '%s' at line %d", opener.Text, opener.Line))
+}
+
+// Running out of constants is reported once, at the literal that needed one
+func (compiler *compiler) makeConstant(val value.Value, span glerror.Span) int {
+	key, shared := makeConstantKey(val)
+
+	if index, ok := compiler.constants[key]; shared && ok {
+		return index
 	}
 
 	index := len(compiler.chunk.Constants)
 
-	// todo: error if too many constants
-	compiler.chunk.Constants = append(compiler.chunk.Constants, value)
+	if index >= maxConstants {
+		if !compiler.exhausted {
+			compiler.errorAt(span, fmt.Sprint("Too many constants in one chunk, limit is ", maxConstants))
+			compiler.exhausted = true
+		}
+		return 0
+	}
+
+	if val.IsString() {
+		val = compiler.intern(val)
+	}
+
+	compiler.chunk.Constants = append(compiler.chunk.Constants, val)
+
+	if shared {
+		if compiler.constants == nil {
+			compiler.constants = make(map[constantKey]int)
+		}
+		compiler.constants[key] = index
+	}
+
+	return index
+}
+
+// Each global name a chunk uses gets a slot, G(x) in the instructions, which
+// caches the value of the global between reads
+func (compiler *compiler) makeGlobal(name Identifier) int {
+	if index, ok := compiler.globals[name]; ok {
+		return index
+	}
+
+	index := len(compiler.chunk.Globals)
+
+	if index >= maxGlobals {
+		compiler.error(fmt.Sprint("Too many global names in one chunk, limit is ", maxGlobals))
+		return 0
+	}
+
+	str := compiler.intern(value.StringVal(string(name)))
+	compiler.chunk.Globals = append(compiler.chunk.Globals, value.NewGlobal(str))
+
+	if compiler.globals == nil {
+		compiler.globals = make(map[Identifier]int)
+	}
+	compiler.globals[name] = index
+
+	return index
+}
+
+// Closures (and anything else with identity) are never shared
+func makeConstantKey(val value.Value) (constantKey, bool) {
+	switch val.Kind() {
+	case value.KindNil:
+		return constantKey{kind: constantNil}, true
+	case value.KindBoolean:
+		return constantKey{kind: constantBoolean, bits: uint64(val.AsInteger())}, true
+	case value.KindInteger:
+		return constantKey{kind: constantInteger, bits: uint64(val.AsInteger())}, true
+	case value.KindNumber:
+		return constantKey{kind: constantFloat, bits: math.Float64bits(val.AsNumber())}, true
+	case value.KindString:
+		return constantKey{kind: constantString, text: val.RawString()}, true
+	default:
+		return constantKey{}, false
+	}
+}
+
+// String constants are shared by every chunk in the compilation unit so
+// that nested functions don't keep their own copy of each name
+func (compiler *compiler) intern(str value.Value) value.Value {
+	root := compiler
+	for root.parent != nil {
+		root = root.parent
+	}
+
+	if interned, ok := root.strings[str.RawString()]; ok {
+		return interned
+	}
+
+	if root.strings == nil {
+		root.strings = make(map[string]value.Value)
+	}
+	root.strings[str.RawString()] = str
 
-	return byte(index)
+	return str
 }
 
-func (compiler *compiler) emitBytes(b1, b2 byte) {
-	compiler.emitByte(b1)
-	compiler.emitByte(b2)
+func (compiler *compiler) emit(instruction uint32) int {
+	compiler.chunk.Code = append(compiler.chunk.Code, instruction)
+	compiler.chunk.Spans = append(compiler.chunk.Spans, compiler.position)
+
+	return len(compiler.chunk.Code) - 1
 }
 
-func (compiler *compiler) emitByte(b byte) {
-	compiler.chunk.Bytecode = append(compiler.chunk.Bytecode, b)
-	compiler.chunk.Lines = append(compiler.chunk.Lines, compiler.current().Line)
+func (compiler *compiler) emitABC(op byte, a, b, c int) {
+	compiler.emit(encodeABC(op, a, b, c))
 }
 
-func (compiler *compiler) emitJump(op byte) {
-	compiler.emitByte(byte(op))
-	compiler.emitBytes(0, 0)
+func (compiler *compiler) emitABx(op byte, a, bx int) {
+	compiler.emit(encodeABx(op, a, bx))
 }
 
-func (compiler *compiler) chunkSize() int {
-	return len(compiler.chunk.Bytecode)
+// Jumps are emitted with a placeholder offset that is filled in by patchJump
+func (compiler *compiler) emitJump() int {
+	return compiler.emit(encodeJ(OpJump, 0))
 }
 
-func MergeBytes(upper, lower byte) int {
-	return int((int(upper) << 8) | int(lower))
+// Jumps back to an instruction that has already been emitted
+func (compiler *compiler) emitLoop(dest int) {
+	compiler.patchJump(compiler.emitJump(), dest)
 }
 
-func SplitBytes(num int) (upper, lower byte) {
-	upper = byte((num >> 8) & 0xff)
-	lower = byte(num & 0xff)
-	return
+func (compiler *compiler) chunkSize() int {
+	return len(compiler.chunk.Code)
 }
 
+// The offset is relative to the instruction after the jump
 func (compiler *compiler) patchJump(source, dest int) {
-	var dist int
-	if dest > source {
-		dist = dest - source - 3
-	} else {
-		dist = source - dest + 3
+	offset := dest - source - 1
+
+	if offset > MaxJump || offset < -MaxJump {
+		compiler.error(fmt.Sprint("Jump too large, limit is ", MaxJump, " instructions"))
+		return
 	}
 
-	upper, lower := SplitBytes(dist)
-	compiler.chunk.Bytecode[source+1] = upper
-	compiler.chunk.Bytecode[source+2] = lower
+	compiler.chunk.Code[source] = encodeJ(OpJump, offset)
 }
 
-func (compiler *compiler) emitReturn() {
-	if !compiler.patchReturn() {
-		compiler.emitBytes(OpNil, OpReturn)
-		compiler.emitByte(1)
+// Registers are allocated like a stack, `free` drops every register from
+// the one given upwards. The chunk records how many were ever used so that
+// the VM can make room for them when the function is called
+func (compiler *compiler) allocate(count int) int {
+	register := compiler.registers
+	compiler.registers += count
+
+	if compiler.registers > compiler.chunk.Registers {
+		if compiler.registers > maxRegisters && compiler.chunk.Registers <= maxRegisters {
+			compiler.error(fmt.Sprint("Function or expression needs too many registers, limit is ", maxRegisters))
+		}
+
+		compiler.chunk.Registers = compiler.registers
 	}
+
+	return register
+}
+
+func (compiler *compiler) free(register int) {
+	compiler.registers = register
+}
+
+// Registers above the locals hold values that no variable refers to, so an
+// expression can use them for its intermediate results
+func (compiler *compiler) isTemporary(register int) bool {
+	return register >= len(compiler.locals)
 }
 
-func (compiler *compiler) patchReturn() bool {
-	last := len(compiler.chunk.Bytecode) - 1
+// The last register allocated can be freed and pushed to again, which saves
+// a move for expressions that are built in the next free register
+func (compiler *compiler) reusable(register int) bool {
+	return register == compiler.registers-1 && compiler.isTemporary(register)
+}
+
+// Constants with a small enough index can be RK operands
+func (compiler *compiler) constantOperand(val value.Value, span glerror.Span) (int, bool) {
+	index := compiler.makeConstant(val, span)
 
-	shouldPatch := compiler.mode == constants.ReplMode &&
-		last >= 0 &&
-		compiler.chunk.Bytecode[last] == OpPop
-	if shouldPatch {
-		compiler.chunk.Bytecode[last] = OpReturn
-		compiler.emitByte(1)
+	if index > maxRKConstant {
+		return 0, false
 	}
 
-	return shouldPatch
+	return constantOperand(index), true
+}
+
+func (compiler *compiler) emitLoadConstant(register int, val value.Value, span glerror.Span) {
+	if val.IsNil() {
+		compiler.emitABC(OpNil, register, 1, 0)
+		return
+	}
+
+	compiler.emitABx(OpConstant, register, compiler.makeConstant(val, span))
+}
+
+// A constant operand is loaded into a new register for instructions that
+// only take registers
+func (compiler *compiler) toRegister(operand int) int {
+	if !IsConstant(operand) {
+		return operand
+	}
+
+	register := compiler.allocate(1)
+	compiler.emitABx(OpConstant, register, ConstantIndex(operand))
+
+	return register
+}
+
+// Functions with nothing left to return give nothing back, the caller fills
+// in nil for any results it wanted
+func (compiler *compiler) emitReturn() {
+	result := compiler.result
+	if compiler.mode == constants.ReplMode && result.end > 0 && result.end == compiler.chunkSize() {
+		compiler.emitABC(OpReturn, result.register, 2, 0)
+		return
+	}
+
+	compiler.emitABC(OpReturn, 0, 1, 0)
 }
 
 func (compiler *compiler) end() (Function, glerror.GluaErrorChain) {
+	var tree *syntax
+	if compiler.keepTree {
+		tree = &syntax{compiler.tree, compiler.mode}
+	}
+
 	compiler.emitReturn()
 
+	if compiler.optimizing(optimizeJumps) {
+		compiler.threadJumps()
+	}
+
 	if !compiler.err.IsEmpty() {
 		return Function{}, compiler.err
 	}
@@ -997,28 +1610,63 @@ func (compiler *compiler) end() (Function, glerror.GluaErrorChain) {
 		Chunk:    compiler.chunk,
 		Name:     compiler.name,
 		Upvalues: compiler.upvalues,
+		syntax:   tree,
 	}
 
-	if constants.PrintBytecode {
-		DebugPrint(function)
+	if compiler.options.DumpBytecode {
+		DebugPrint(compiler.options.Writer(), function)
 	}
 
 	return function, compiler.err
 }
 
+// While parsing errors point at the current token, the whole declaration is
+// parsed before it is emitted so emit errors use the node being emitted
 func (compiler *compiler) error(message string) {
+	span := compiler.current().Span()
+	if compiler.emitting {
+		span = compiler.position
+	}
+
+	compiler.errorAt(span, message)
+}
+
+// Past maxErrors further errors are dropped, counting the ones the enclosing
+// functions have so far
+func (compiler *compiler) errorAt(span glerror.Span, message string) {
+	if compiler.panicking || compiler.errorCount() >= maxErrors {
+		return
+	}
+
 	compiler.err.Append(CompileError{
 		message: message,
-		line:    compiler.current().Line,
+		span:    span,
+		source:  compiler.chunk.Source,
 	})
 }
 
+func (compiler *compiler) errorCount() int {
+	count := 0
+	for c := compiler; c != nil; c = c.parent {
+		count += c.err.Len()
+	}
+
+	return count
+}
+
+// Syntax errors put the compiler in panic mode, further errors are dropped
+// until it has synchronized on the next statement
+func (compiler *compiler) syntaxError(message string) {
+	compiler.error(message)
+	compiler.panicking = true
+}
+
 type CompileError struct {
 	message string
-	line    int
+	span    glerror.Span
+	source  *glerror.Source
 }
 
-// todo: track line numbers in tokens and print error line
 func (ce CompileError) Error() string {
-	return fmt.Sprintf("Compile error [line=%d] ---> %s", ce.line, ce.message)
+	return glerror.Format("Compile error", ce.message, ce.source, ce.span)
 }
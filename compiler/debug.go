@@ -2,162 +2,140 @@ package compiler
 
 import (
 	"fmt"
-	"os"
+	"io"
 )
 
-func ByteName(op byte) string {
+func OpName(op byte) string {
 	switch op {
+	case OpAdd:
+		return "OpAdd"
+	case OpAnd:
+		return "OpAnd"
 	case OpAssert:
 		return "OpAssert"
-	case OpAssignStart:
-		return "OpAssignStart"
-	case OpAssignCleanup:
-		return "OpAssignCleanup"
-	case OpNil:
-		return "OpNil"
-	case OpZero:
-		return "OpZero"
-	case OpLocalAllocate:
-		return "OpLocalAllocate"
-	case OpLocalCleanup:
-		return "OpLocalCleanup"
-	case OpGetGlobal:
-		return "OpGetGlobal"
-	case OpSetGlobal:
-		return "OpSetGlobal"
-	case OpGetLocal:
-		return "OpGetLocal"
-	case OpSetLocal:
-		return "OpSetLocal"
-	case OpCreateTable:
-		return "OpCreateTable"
-	case OpSetTable:
-		return "OpSetTable"
-	case OpInitTable:
-		return "OpInitTable"
-	case OpGetTable:
-		return "OpGetTable"
-	case OpInsertTable:
-		return "OpInsertTable"
-	case OpClosure:
-		return "OpClosure"
-	case OpCreateUpvalue:
-		return "OpCreateUpvalue"
-	case OpCloseUpvalues:
-		return "OpCloseUpvalues"
-	case OpGetUpvalue:
-		return "OpGetUpvalue"
-	case OpSetUpvalue:
-		return "OpSetUpvalue"
+	case OpBitAnd:
+		return "OpBitAnd"
+	case OpBitNot:
+		return "OpBitNot"
+	case OpBitOr:
+		return "OpBitOr"
+	case OpBitXor:
+		return "OpBitXor"
 	case OpCall:
 		return "OpCall"
+	case OpCloseUpvalues:
+		return "OpCloseUpvalues"
+	case OpClosure:
+		return "OpClosure"
 	case OpConstant:
 		return "OpConstant"
-	case OpPop:
-		return "OpPop"
-	case OpReturn:
-		return "OpReturn"
-	case OpJumpIfFalse:
-		return "OpJumpIfFalse"
-	case OpLoop:
-		return "OpLoop"
+	case OpCreateTable:
+		return "OpCreateTable"
+	case OpCreateUpvalue:
+		return "OpCreateUpvalue"
+	case OpDivide:
+		return "OpDivide"
 	case OpEquals:
 		return "OpEquals"
+	case OpGetEnv:
+		return "OpGetEnv"
+	case OpGetGlobal:
+		return "OpGetGlobal"
+	case OpGetTable:
+		return "OpGetTable"
+	case OpGetUpvalue:
+		return "OpGetUpvalue"
+	case OpInsertTable:
+		return "OpInsertTable"
+	case OpJump:
+		return "OpJump"
+	case OpLength:
+		return "OpLength"
 	case OpLess:
 		return "OpLess"
-	case OpGreater:
-		return "OpGreater"
-	case OpAdd:
-		return "OpAdd"
-	case OpSubtract:
-		return "OpSubtract"
+	case OpLessEqual:
+		return "OpLessEqual"
+	case OpMarkClose:
+		return "OpMarkClose"
+	case OpMove:
+		return "OpMove"
+	case OpMult:
+		return "OpMult"
 	case OpNegate:
 		return "OpNegate"
+	case OpNil:
+		return "OpNil"
 	case OpNot:
 		return "OpNot"
-	case OpMult:
-		return "OpMult"
-	case OpDivide:
-		return "OpDivide"
-	case OpAnd:
-		return "OpAnd"
 	case OpOr:
 		return "OpOr"
+	case OpReturn:
+		return "OpReturn"
+	case OpSetGlobal:
+		return "OpSetGlobal"
+	case OpSetTable:
+		return "OpSetTable"
+	case OpSetUpvalue:
+		return "OpSetUpvalue"
+	case OpShiftLeft:
+		return "OpShiftLeft"
+	case OpShiftRight:
+		return "OpShiftRight"
+	case OpSubtract:
+		return "OpSubtract"
+	case OpTailCall:
+		return "OpTailCall"
+	case OpTest:
+		return "OpTest"
+	case OpTestEquals:
+		return "OpTestEquals"
+	case OpTestLess:
+		return "OpTestLess"
+	case OpTestLessEqual:
+		return "OpTestLessEqual"
 	default:
 		panic(fmt.Sprint("Unrecognized Stringer for op: ", byte(op)))
 	}
 }
 
-func DebugPrint(function Function) {
-	bytecode := function.Chunk.Bytecode
+func DebugPrint(out io.Writer, function Function) {
+	code := function.Chunk.Code
 
 	if function.Name == "" {
-		fmt.Fprintln(os.Stderr, "---------- <script> ----------")
+		fmt.Fprintln(out, "---------- <script> ----------")
 	} else {
-		fmt.Fprintln(os.Stderr, "----------", function.Name, "----------")
+		fmt.Fprintln(out, "----------", function.Name, "----------")
 	}
 
-	i := 0
-	var print func(int, []byte) int
-	for i < len(bytecode) {
-		switch bytecode[i] {
-		case OpConstant, OpSetGlobal, OpGetGlobal, OpSetLocal, OpGetLocal,
-			OpCloseUpvalues, OpGetUpvalue, OpSetUpvalue, OpReturn:
-			print = printConstant
-		case OpAdd, OpSubtract, OpNot, OpNegate, OpMult, OpDivide, OpNil,
-			OpPop, OpAssert, OpEquals, OpLess, OpGreater, OpAnd, OpOr,
-			OpCreateTable, OpSetTable, OpInsertTable, OpInitTable, OpGetTable, OpZero,
-			OpClosure, OpAssignStart, OpAssignCleanup, OpLocalAllocate, OpLocalCleanup:
-			print = printInstruction
-		case OpCreateUpvalue:
-			print = printUpvalue
-		case OpCall:
-			print = printCall
-		case OpLoop:
-			print = printLoop
-		case OpJumpIfFalse:
-			print = printJump
-		default:
-			panic(fmt.Sprint("Unknown op for debug print: ", ByteName(bytecode[i])))
-		}
-		i = print(i, bytecode)
+	for i, instruction := range code {
+		fmt.Fprintln(out, FormatInstruction(i, instruction))
 	}
 
-	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(out)
 }
 
-func printInstruction(i int, bytecode []byte) int {
-	fmt.Fprintf(os.Stderr, "%04d | %-16v\n", i, ByteName(bytecode[i]))
-	return i + 1
-}
-
-func printConstant(i int, bytecode []byte) int {
-	fmt.Fprintf(os.Stderr, "%04d | %-16s %-4d\n", i, ByteName(bytecode[i]), bytecode[i+1])
-	return i + 2
-}
-
-func printCall(i int, bytecode []byte) int {
-	fmt.Fprintf(os.Stderr, "%04d | %-16s %-4d%-4v\n", i, ByteName(bytecode[i]), bytecode[i+1], bytecode[i+2] == 1)
-	return i + 3
-}
+// Formats the instruction at index i, constant operands are shown as K<n>
+// and global slots as G<n>
+func FormatInstruction(i int, instruction uint32) string {
+	op := Op(instruction)
 
-func printUpvalue(i int, bytecode []byte) int {
-	fmt.Fprintf(os.Stderr, "%04d | %-16s %-4d%-4v\n", i, ByteName(bytecode[i]), bytecode[i+1], bytecode[i+2] == 1)
-	return i + 3
+	switch op {
+	case OpJump:
+		jump := J(instruction)
+		return fmt.Sprintf("%04d | %-16v %-6d (%-6d -> %-6d)", i, OpName(op), jump, i+1, i+1+jump)
+	case OpGetGlobal, OpSetGlobal:
+		return fmt.Sprintf("%04d | %-16s %-4d G%-4d", i, OpName(op), A(instruction), Bx(instruction))
+	case OpConstant, OpClosure, OpMarkClose:
+		return fmt.Sprintf("%04d | %-16s %-4d K%-4d", i, OpName(op), A(instruction), Bx(instruction))
+	default:
+		return fmt.Sprintf("%04d | %-16s %-4d %-5s %-5s", i, OpName(op), A(instruction), formatOperand(B(instruction)), formatOperand(C(instruction)))
+	}
 }
 
-func printJump(i int, bytecode []byte) int {
-	jump := MergeBytes(byte(bytecode[i+1]), byte(bytecode[i+2]))
-	start := i + 3
-	to := start + jump
-	fmt.Fprintf(os.Stderr, "%04d | %-16v %-6d (%-6d -> %-6d)\n", i, ByteName(bytecode[i]), jump, start, to)
-	return i + 3
-}
+func formatOperand(operand int) string {
+	if IsConstant(operand) {
+		return fmt.Sprint("K", ConstantIndex(operand))
+	}
 
-func printLoop(i int, bytecode []byte) int {
-	jump := MergeBytes(byte(bytecode[i+1]), byte(bytecode[i+2]))
-	start := i + 3
-	to := start - jump
-	fmt.Fprintf(os.Stderr, "%04d | %-16v %-6d (%-6d -> %-6d)\n", i, ByteName(bytecode[i]), jump, start, to)
-	return i + 3
+	return fmt.Sprint(operand)
 }
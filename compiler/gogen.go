@@ -0,0 +1,1080 @@
+package compiler
+
+import (
+	"arlindohall/glua/constants"
+	"arlindohall/glua/glerror"
+	"arlindohall/glua/options"
+	"arlindohall/glua/scanner"
+	"arlindohall/glua/value"
+	"fmt"
+	"go/format"
+	"strconv"
+	"strings"
+)
+
+// GenerateGo translates a script to the source of a Go package that runs it
+// with interpreter.RunNative. The script is compiled first, so it has the
+// same errors it has when it's interpreted, and the syntax tree is then
+// translated walking it in the same order as Emit: values are read at the
+// same moments, errors point at the same spans and scopes end in the same
+// places. A main package also gets a main function that runs the script and
+// prints its result like `glua <file>`
+func GenerateGo(tokens *scanner.TokenStream, source *glerror.Source, options options.Options, pkg string) ([]byte, glerror.GluaErrorChain) {
+	compiler := newCompiler(tokens, constants.RunFileMode, source, options)
+	compiler.keepTree = true
+	compiler.compile()
+
+	if _, err := compiler.end(); !err.IsEmpty() {
+		return nil, err
+	}
+
+	// Errors in the generated code show lines from the script, so it needs
+	// all of them
+	text, ok := source.Contents()
+	if !ok {
+		compiler.errorAt(glerror.Span{}, "Cannot read the script's source again to embed it")
+		return nil, compiler.err
+	}
+
+	gen := &generator{
+		spanIndex:     map[glerror.Span]int{},
+		constantIndex: map[string]int{},
+		globalIndex:   map[Identifier]int{},
+	}
+	gen.script(compiler.tree)
+
+	code, err := format.Source(gen.file(pkg, source, text))
+	if err != nil {
+		panic(fmt.Sprint("Internal error: generated Go does not parse: ", err))
+	}
+
+	return code, glerror.GluaErrorChain{}
+}
+
+// The generated code is written line by line into body, functions declared
+// in the script become function literals inside the one declaring them.
+// Positions are tracked like compiler.position and put in the spans table,
+// the generated code passes their index to Native.At before anything that
+// can fail
+type generator struct {
+	function      *generatedFunction
+	out           strings.Builder
+	indent        int
+	names         int
+	position      glerror.Span
+	spans         []glerror.Span
+	spanIndex     map[glerror.Span]int
+	constants     []string
+	constantIndex map[string]int
+	globals       []Identifier
+	globalIndex   map[Identifier]int
+	terminated    bool
+}
+
+// Locals are resolved the way the compiler resolves them, the first one with
+// the name in the function wins and then those of the enclosing functions
+// `loops` has the mark to close from for each loop being generated, if a
+// break has to close anything
+type generatedFunction struct {
+	parent *generatedFunction
+	locals []generatedLocal
+	loops  []string
+	scope  int
+	closes bool
+}
+
+type generatedLocal struct {
+	name   Identifier
+	goName string
+	scope  int
+	attrib Attribute
+}
+
+func (gen *generator) line(format string, args ...interface{}) {
+	gen.out.WriteString(strings.Repeat("\t", gen.indent))
+	fmt.Fprintf(&gen.out, format, args...)
+	gen.out.WriteString("\n")
+}
+
+// A Go name that is used nowhere else, based on the glua name when there is one
+func (gen *generator) fresh(name Identifier) string {
+	gen.names += 1
+
+	var clean strings.Builder
+	for _, r := range string(name) {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			clean.WriteRune(r)
+		}
+	}
+
+	if clean.Len() == 0 {
+		return fmt.Sprint("t", gen.names)
+	}
+
+	return fmt.Sprintf("v%d_%s", gen.names, clean.String())
+}
+
+// Code after a return is still walked so positions move as they do in the
+// compiler, but Go doesn't allow it so it is thrown away
+func (gen *generator) unreachable(generate func()) {
+	out := gen.out
+	gen.out = strings.Builder{}
+	gen.terminated = false
+
+	generate()
+
+	gen.out = out
+	gen.terminated = true
+}
+
+// Assigns the Go expression to a new variable, which is returned
+func (gen *generator) temporary(expression string, args ...interface{}) string {
+	name := gen.fresh("")
+	gen.line("%s := %s", name, fmt.Sprintf(expression, args...))
+
+	return name
+}
+
+func (gen *generator) at(span glerror.Span) {
+	gen.position = span
+}
+
+// Errors raised by whatever comes next are reported at the current position
+func (gen *generator) mark() {
+	index, ok := gen.spanIndex[gen.position]
+	if !ok {
+		index = len(gen.spans)
+		gen.spans = append(gen.spans, gen.position)
+		gen.spanIndex[gen.position] = index
+	}
+
+	gen.line("n.At(%d)", index)
+}
+
+func (gen *generator) constant(val value.Value) string {
+	switch {
+	case val.IsNil():
+		return "value.Nil()"
+	case val.IsBoolean():
+		return fmt.Sprintf("value.Boolean(%t)", val.AsBoolean())
+	case val.IsInteger():
+		return fmt.Sprintf("value.Integer(%d)", val.AsInteger())
+	case val.IsNumber():
+		return fmt.Sprintf("value.Number(%s)", strconv.FormatFloat(val.AsNumber(), 'g', -1, 64))
+	}
+
+	text := val.RawString()
+	index, ok := gen.constantIndex[text]
+	if !ok {
+		index = len(gen.constants)
+		gen.constants = append(gen.constants, strconv.Quote(text))
+		gen.constantIndex[text] = index
+	}
+
+	return fmt.Sprintf("constants[%d]", index)
+}
+
+func (gen *generator) global(name Identifier) string {
+	index, ok := gen.globalIndex[name]
+	if !ok {
+		index = len(gen.globals)
+		gen.globals = append(gen.globals, name)
+		gen.globalIndex[name] = index
+	}
+
+	return fmt.Sprintf("&globals[%d]", index)
+}
+
+func (gen *generator) file(pkg string, source *glerror.Source, text string) []byte {
+	var file strings.Builder
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&file, format, args...)
+		file.WriteString("\n")
+	}
+
+	line("// Code generated by glua gen-go from %s. DO NOT EDIT.", source.Name)
+	line("")
+	line("package %s", pkg)
+	line("")
+	line("import (")
+	line("%q", "arlindohall/glua/glerror")
+	line("%q", "arlindohall/glua/interpreter")
+	line("%q", "arlindohall/glua/value")
+	line("%q", "context")
+	if pkg == "main" {
+		line("%q", "fmt")
+		line("%q", "os")
+	}
+	line(")")
+	line("")
+	line("// Run runs %s with env as its globals and returns what interpreting it would", source.Name)
+	line("func Run(ctx context.Context, vm *interpreter.VM, env *value.Table) (value.Value, glerror.GluaErrorChain) {")
+	line("return interpreter.RunNative(ctx, vm, env, script, source, spans)")
+	line("}")
+	line("")
+
+	if pkg == "main" {
+		line("func main() {")
+		line("vm := interpreter.NewVm()")
+		line("val, errs := Run(context.Background(), vm, vm.Globals())")
+		line("")
+		line("if !errs.IsEmpty() {")
+		line("fmt.Fprintln(os.Stderr, errs)")
+		line("")
+		line("code := 3")
+		line("if re, ok := errs.First().(interpreter.RuntimeError); ok {")
+		line("fmt.Fprintln(os.Stderr, interpreter.FormatTraceback(re.Traceback()))")
+		line("")
+		line("if re.Assertion() {")
+		line("code = 5")
+		line("}")
+		line("}")
+		line("")
+		line("os.Exit(code)")
+		line("}")
+		line("")
+		line("fmt.Println(\"Result: \", val)")
+		line("}")
+		line("")
+	}
+
+	line("var source = glerror.SourceText(%q, %q)", source.Name, text)
+	line("")
+
+	line("var spans = []glerror.Span{")
+	for _, span := range gen.spans {
+		line("{Line: %d, Column: %d, Offset: %d, Length: %d},", span.Line, span.Column, span.Offset, span.Length)
+	}
+	line("}")
+	line("")
+
+	line("var constants = []value.Value{")
+	for _, text := range gen.constants {
+		line("value.StringVal(%s),", text)
+	}
+	line("}")
+	line("")
+
+	// Globals cache what they last read, so each run has its own
+	line("func newGlobals() []value.Global {")
+	line("return []value.Global{")
+	for _, name := range gen.globals {
+		line("value.NewGlobal(value.StringVal(%q)),", string(name))
+	}
+	line("}")
+	line("}")
+	line("")
+
+	file.WriteString(gen.out.String())
+
+	return []byte(file.String())
+}
+
+func (gen *generator) script(tree []declaration) {
+	gen.function = &generatedFunction{
+		locals: []generatedLocal{{name: ""}},
+		closes: hasClose(declarationNodes(tree)...),
+	}
+
+	gen.line("func script(n *interpreter.Native, closure *value.Closure, args []value.Value) []value.Value {")
+	gen.indent += 1
+	gen.line("globals := newGlobals()")
+	gen.line("_ = globals")
+
+	if gen.function.closes {
+		gen.line("top := n.Closing()")
+		gen.line("_ = top")
+	}
+
+	for i, decl := range tree {
+		if gen.terminated {
+			gen.unreachable(func() {
+				for _, decl := range tree[i:] {
+					gen.at(decl.span)
+					gen.statement(decl.node)
+				}
+			})
+			break
+		}
+
+		gen.at(decl.span)
+		gen.statement(decl.node)
+	}
+
+	gen.functionEnd()
+	gen.indent -= 1
+	gen.line("}")
+}
+
+func declarationNodes(tree []declaration) []Node {
+	nodes := make([]Node, len(tree))
+	for i, decl := range tree {
+		nodes[i] = decl.node
+	}
+
+	return nodes
+}
+
+// Whether a function declares any to-be-closed variables of its own, they
+// have to be closed when it returns
+func hasClose(nodes ...Node) bool {
+	for _, node := range nodes {
+		switch node := node.(type) {
+		case LocalDeclaration:
+			for i := range node.names {
+				if node.attribute(i) == AttribClose {
+					return true
+				}
+			}
+		case BlockStatement:
+			if hasClose(node.statements...) {
+				return true
+			}
+		case WhileStatement:
+			if hasClose(node.body) {
+				return true
+			}
+		case NumericForStatement:
+			if hasClose(node.body) {
+				return true
+			}
+		case GenericForStatement:
+			if hasClose(node.body) {
+				return true
+			}
+		case IfStatement:
+			if hasClose(node.body) || node.counterfactual != nil && hasClose(node.counterfactual) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Whether a break leaves the loop with this body, breaks in loops inside
+// it leave those
+func hasBreak(nodes ...Node) bool {
+	for _, node := range nodes {
+		switch node := node.(type) {
+		case BreakStatement:
+			return true
+		case BlockStatement:
+			if hasBreak(node.statements...) {
+				return true
+			}
+		case IfStatement:
+			if hasBreak(node.body) || node.counterfactual != nil && hasBreak(node.counterfactual) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// The implicit return at the end of every function, unless it ends in one
+func (gen *generator) functionEnd() {
+	if gen.terminated {
+		gen.terminated = false
+		return
+	}
+
+	if gen.function.closes {
+		gen.mark()
+		gen.line("n.Close(top)")
+	}
+
+	gen.line("return nil")
+}
+
+func (gen *generator) startScope() {
+	gen.function.scope += 1
+}
+
+// Like compiler.endScope, the locals of the scope are forgotten and the
+// to-be-closed ones among them are closed
+func (gen *generator) endScope(closing string) {
+	function := gen.function
+	function.scope -= 1
+
+	top := 0
+	for top < len(function.locals) && function.locals[top].scope <= function.scope {
+		top += 1
+	}
+
+	if closing != "" && !gen.terminated {
+		gen.mark()
+		gen.line("n.Close(%s)", closing)
+	}
+
+	function.locals = function.locals[:top]
+}
+
+func (gen *generator) addLocal(name Identifier, attrib Attribute, goName string) {
+	function := gen.function
+	function.locals = append(function.locals, generatedLocal{name, goName, function.scope, attrib})
+}
+
+// A local of the function being generated
+func (function *generatedFunction) local(name Identifier) (generatedLocal, bool) {
+	for _, local := range function.locals {
+		if local.name == name {
+			return local, true
+		}
+	}
+
+	return generatedLocal{}, false
+}
+
+// A local of an enclosing function, which Go captures by reference just as
+// an upvalue shares the variable
+func (function *generatedFunction) upvalue(name Identifier) (generatedLocal, bool) {
+	for enclosing := function.parent; enclosing != nil; enclosing = enclosing.parent {
+		if local, ok := enclosing.local(name); ok {
+			return local, true
+		}
+	}
+
+	return generatedLocal{}, false
+}
+
+func (function *generatedFunction) variable(name Identifier) (generatedLocal, bool) {
+	if local, ok := function.local(name); ok {
+		return local, true
+	}
+
+	return function.upvalue(name)
+}
+
+func (function *generatedFunction) hasLocalEnv() bool {
+	_, ok := function.variable(envName)
+	return ok
+}
+
+func (function *generatedFunction) hasCloseVariables() bool {
+	for _, local := range function.locals {
+		if local.attrib == AttribClose {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The statements of a block in a new scope, in the Go block the caller opened
+func (gen *generator) block(statements []Node) {
+	gen.startScope()
+
+	closing := ""
+	if hasCloseDeclaration(statements) {
+		closing = gen.temporary("n.Closing()")
+		gen.line("_ = %s", closing)
+	}
+
+	gen.statements(statements)
+	gen.endScope(closing)
+}
+
+func (gen *generator) statements(statements []Node) {
+	for i, statement := range statements {
+		if gen.terminated {
+			gen.unreachable(func() { gen.statements(statements[i:]) })
+			return
+		}
+
+		gen.statement(statement)
+	}
+}
+
+func hasCloseDeclaration(statements []Node) bool {
+	for _, statement := range statements {
+		if declaration, ok := statement.(LocalDeclaration); ok && hasClose(declaration) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A body is a block unless it's a function's only declaration
+func (gen *generator) body(node Node) {
+	if block, ok := node.(BlockStatement); ok {
+		gen.block(block.statements)
+	} else {
+		gen.statement(node)
+	}
+}
+
+// Afterwards gen.terminated says whether the Go for the statement always
+// returns, by Go's rules for terminating statements, or always breaks. Only
+// a loop can end in a break and a loop doesn't terminate
+func (gen *generator) statement(node Node) {
+	gen.terminated = false
+
+	switch node := node.(type) {
+	case FunctionNode:
+		gen.functionDeclaration(node)
+	case GlobalDeclaration:
+		values := gen.values(node.values, len(node.names))
+
+		for i, name := range node.names {
+			gen.setGlobal(name, values[i])
+		}
+	case LocalDeclaration:
+		values := gen.values(node.values, len(node.names))
+		names := make([]string, len(node.names))
+
+		for i, name := range node.names {
+			names[i] = gen.fresh(name)
+			gen.line("%s := %s", names[i], values[i])
+			gen.line("_ = %s", names[i])
+			gen.addLocal(name, node.attribute(i), names[i])
+		}
+
+		for i, name := range node.names {
+			if node.attribute(i) == AttribClose {
+				gen.mark()
+				gen.line("n.MarkClose(%s, %q)", names[i], string(name))
+			}
+		}
+	case WhileStatement:
+		gen.startLoop(node.body)
+		gen.line("for {")
+		gen.indent += 1
+
+		condition := gen.expression(node.condition, false)
+		gen.line("if !%s.AsBoolean() {", condition)
+		gen.line("\tbreak")
+		gen.line("}")
+
+		gen.body(node.body)
+
+		if !gen.terminated {
+			gen.mark()
+			gen.line("n.Loop()")
+		}
+
+		gen.terminated = false
+		gen.indent -= 1
+		gen.line("}")
+		gen.endLoop()
+	case NumericForStatement:
+		if !hasBreak(node.body) {
+			gen.numericFor(node.variable, node.values, node.body)
+			break
+		}
+
+		// The values are unrolled, so for a break to leave them they run in
+		// a Go loop that only goes round once
+		gen.startLoop(node.body)
+		gen.line("for {")
+		gen.indent += 1
+		gen.numericFor(node.variable, node.values, node.body)
+
+		if !gen.terminated {
+			gen.line("break")
+		}
+
+		gen.terminated = false
+		gen.indent -= 1
+		gen.line("}")
+		gen.endLoop()
+	case GenericForStatement:
+		gen.line("{")
+		gen.indent += 1
+		gen.startScope()
+		gen.block(node.transform().statements)
+		gen.endScope("")
+		gen.indent -= 1
+		gen.line("}")
+	case IfStatement:
+		condition := gen.expression(node.condition, false)
+		gen.line("if %s.AsBoolean() {", condition)
+		gen.indent += 1
+		gen.body(node.body)
+		gen.indent -= 1
+		terminated := gen.terminated
+		gen.terminated = false
+
+		if node.counterfactual != nil {
+			gen.line("} else {")
+			gen.indent += 1
+			gen.body(node.counterfactual)
+			gen.indent -= 1
+		}
+
+		gen.terminated = terminated && gen.terminated
+
+		gen.line("}")
+	case ReturnStatement:
+		gen.returnStatement(node)
+	case BreakStatement:
+		gen.breakStatement()
+	case BlockStatement:
+		gen.line("{")
+		gen.indent += 1
+		gen.block(node.statements)
+		gen.indent -= 1
+		gen.line("}")
+	case AssertStatement:
+		val := gen.expression(node.value, false)
+		message := gen.expression(node.message, false)
+
+		gen.at(node.span)
+		gen.mark()
+		gen.line("n.Assert(%s, %s)", val, message)
+	case MultipleAssignment:
+		gen.assignment(node)
+	case Expression:
+		if call, ok := node.expression.(*Call); ok {
+			gen.line("%s", gen.call(call, "Call"))
+		} else {
+			gen.line("_ = %s", gen.expression(node.expression, true))
+		}
+	default:
+		panic(fmt.Sprintf("Internal error: cannot generate Go for %T", node))
+	}
+}
+
+func (gen *generator) numericFor(variable Identifier, values []Node, body Node) {
+	for i, val := range values {
+		if gen.terminated {
+			gen.unreachable(func() { gen.numericFor(variable, values[i:], body) })
+			break
+		}
+
+		gen.line("{")
+		gen.indent += 1
+		gen.startScope()
+
+		name := gen.fresh(variable)
+		gen.line("%s := %s", name, gen.expression(val, true))
+		gen.line("_ = %s", name)
+		gen.addLocal(variable, AttribNone, name)
+
+		gen.body(body)
+
+		gen.endScope("")
+		gen.indent -= 1
+		gen.line("}")
+	}
+}
+
+// Breaks leave the innermost Go loop, after closing the to-be-closed
+// variables marked since it started
+func (gen *generator) startLoop(body Node) {
+	closing := ""
+	if hasClose(body) && hasBreak(body) {
+		closing = gen.temporary("n.Closing()")
+		gen.line("_ = %s", closing)
+	}
+
+	gen.function.loops = append(gen.function.loops, closing)
+}
+
+func (gen *generator) endLoop() {
+	gen.function.loops = gen.function.loops[:len(gen.function.loops)-1]
+}
+
+func (gen *generator) breakStatement() {
+	if closing := gen.function.loops[len(gen.function.loops)-1]; closing != "" {
+		gen.mark()
+		gen.line("n.Close(%s)", closing)
+	}
+
+	gen.line("break")
+	gen.terminated = true
+}
+
+// The function is a literal passed to Native.Closure, with its parameters
+// taken from the arguments. It starts out where its declaration is, and
+// leaves the position of the one declaring it alone
+func (gen *generator) functionDeclaration(function FunctionNode) {
+	gen.at(function.span)
+	position := gen.position
+
+	gen.mark()
+	closure := gen.fresh("")
+	gen.line("%s := n.Closure(closure, %q, %d, func(n *interpreter.Native, closure *value.Closure, args []value.Value) []value.Value {",
+		closure, string(function.name), len(function.parameters))
+	gen.indent += 1
+
+	enclosing := gen.function
+	gen.function = &generatedFunction{
+		parent: enclosing,
+		locals: []generatedLocal{{name: ""}},
+		closes: hasClose(function.body),
+	}
+
+	for i, parameter := range function.parameters {
+		name := gen.fresh(parameter)
+		gen.line("%s := interpreter.Nth(args, %d)", name, i)
+		gen.line("_ = %s", name)
+		gen.addLocal(parameter, AttribNone, name)
+	}
+
+	if gen.function.closes {
+		gen.line("top := n.Closing()")
+		gen.line("_ = top")
+	}
+
+	gen.body(function.body)
+	gen.functionEnd()
+
+	gen.function = enclosing
+	gen.position = position
+	gen.indent -= 1
+	gen.line("})")
+
+	if enclosing.scope > 0 {
+		name := gen.fresh(function.name)
+		gen.line("%s := %s", name, closure)
+		gen.line("_ = %s", name)
+		gen.addLocal(function.name, AttribNone, name)
+	} else {
+		gen.setGlobal(function.name, closure)
+	}
+}
+
+// Tail calls take over the frame unless there are variables to close after
+// the results are worked out. A single local is returned as it is once
+// they're closed, anything else is evaluated first
+func (gen *generator) returnStatement(statement ReturnStatement) {
+	if call, ok := statement.tailCall(); ok && !gen.function.hasCloseVariables() {
+		// Its to-be-closed variables are out of scope by now, this closes
+		// anything still open the way returning would
+		if gen.function.closes {
+			gen.mark()
+			gen.line("n.Close(top)")
+		}
+
+		gen.line("return %s", gen.call(call, "TailCall"))
+		gen.terminated = true
+		return
+	}
+
+	var values []string
+	if len(statement.values) == 1 && gen.isLocal(statement.values[0]) {
+		values = []string{gen.expression(statement.values[0], false)}
+	} else {
+		for _, val := range statement.values {
+			values = append(values, gen.expression(val, true))
+		}
+	}
+
+	if gen.function.closes {
+		gen.mark()
+		gen.line("n.Close(top)")
+	}
+
+	gen.line("return n.Return(%s)", strings.Join(values, ", "))
+	gen.terminated = true
+}
+
+func (gen *generator) isLocal(node Node) bool {
+	primary, ok := node.(VariablePrimary)
+	if !ok {
+		return false
+	}
+
+	_, ok = gen.function.local(primary.name)
+	return ok
+}
+
+// Like compiler.emitValues, `want` values where a call in the last position
+// fills in the ones that are left and extra values are evaluated and dropped
+func (gen *generator) values(values []Node, want int) []string {
+	var results []string
+
+	for i, val := range values {
+		call, ok := val.(*Call)
+
+		switch {
+		case ok && call.isAssignment && i == len(values)-1 && i < want:
+			returned := gen.temporary("%s", gen.call(call, "Call"))
+
+			for j := i; j < want; j++ {
+				results = append(results, gen.temporary("interpreter.Nth(%s, %d)", returned, j-i))
+			}
+		case i < want:
+			results = append(results, gen.expression(val, true))
+		default:
+			gen.line("_ = %s", gen.expression(val, true))
+		}
+	}
+
+	for len(results) < want {
+		results = append(results, "value.Nil()")
+	}
+
+	return results
+}
+
+// Like MultipleAssignment.Emit, every value is evaluated before any variable
+// is assigned. With a single value and variable the value is read when it's
+// stored, as it is when the compiler uses it as an operand
+func (gen *generator) assignment(assignment MultipleAssignment) {
+	if len(assignment.variables) == 1 && len(assignment.values) == 1 {
+		target := assignment.variables[0]
+
+		if primary, ok := target.(VariablePrimary); ok {
+			if local, ok := gen.function.local(primary.name); ok {
+				gen.at(primary.span)
+				gen.line("%s = %s", local.goName, gen.expression(assignment.values[0], false))
+				return
+			}
+		}
+
+		gen.store(target, gen.expression(assignment.values[0], false))
+		return
+	}
+
+	values := gen.values(assignment.values, len(assignment.variables))
+	for i, target := range assignment.variables {
+		gen.store(target, values[i])
+	}
+}
+
+func (gen *generator) store(target Node, source string) {
+	switch target := target.(type) {
+	case VariablePrimary:
+		gen.at(target.span)
+
+		if local, ok := gen.function.variable(target.name); ok {
+			gen.line("%s = %s", local.goName, source)
+			return
+		}
+
+		gen.setGlobal(target.name, source)
+	case TableAccessor:
+		table := gen.expression(target.table, false)
+		key := gen.expression(target.attribute, false)
+
+		gen.at(target.span)
+		gen.mark()
+		gen.line("n.SetTable(%s, %s, %s)", table, key, source)
+	default:
+		panic(fmt.Sprintf("Internal error: cannot assign to %T", target))
+	}
+}
+
+// Through _ENV when a local one is in scope, as in compiler.emitSetGlobal
+func (gen *generator) setGlobal(name Identifier, source string) {
+	if gen.function.hasLocalEnv() {
+		gen.store(TableAccessor{VariablePrimary{envName, gen.position}, StringPrimary(string(name)), gen.position}, source)
+		return
+	}
+
+	gen.mark()
+	gen.line("n.SetGlobal(closure.Env, %s, %s)", gen.global(name), source)
+}
+
+// Evaluates the function and then its arguments, each into its own variable
+// as they would be into registers, and returns the call to make
+func (gen *generator) call(call *Call, method string) string {
+	arguments := []string{gen.expression(call.base, true)}
+	for _, argument := range call.arguments {
+		arguments = append(arguments, gen.expression(argument, true))
+	}
+
+	gen.at(call.span)
+	gen.mark()
+
+	return fmt.Sprintf("n.%s(%s)", method, strings.Join(arguments, ", "))
+}
+
+// Returns a Go expression for the node's value, after the statements that
+// work it out. A local of the function is read where the expression is
+// used, like a local used as an operand, unless `copy` asks for its value
+// now, like a local moved into another register
+func (gen *generator) expression(node Node, copy bool) string {
+	switch node := node.(type) {
+	case LiteralPrimary:
+		return gen.constant(node.value)
+	case VariablePrimary:
+		return gen.variable(node, copy)
+	case TableAccessor:
+		table := gen.expression(node.table, false)
+		key := gen.expression(node.attribute, false)
+
+		gen.at(node.span)
+		gen.mark()
+		return gen.temporary("n.GetTable(%s, %s)", table, key)
+	case *Call:
+		return gen.temporary("interpreter.Nth(%s, 0)", gen.call(node, "Call"))
+	case LogicOr:
+		return gen.chain(node.value, node.or, func(i int, left, right string) string {
+			return gen.temporary("value.Boolean(%s.AsBoolean() || %s.AsBoolean())", left, right)
+		})
+	case LogicAnd:
+		return gen.chain(node.value, node.and, func(i int, left, right string) string {
+			return gen.temporary("value.Boolean(%s.AsBoolean() && %s.AsBoolean())", left, right)
+		})
+	case Comparison:
+		return gen.chain(node.term, node.operands(), func(i int, left, right string) string {
+			item := node.items[i]
+			gen.at(item.span)
+
+			switch item.compareOp {
+			case scanner.TokenEqualEqual:
+				return gen.temporary("value.Boolean(value.Equal(%s, %s))", left, right)
+			case scanner.TokenTildeEqual:
+				return gen.temporary("value.Boolean(!value.Equal(%s, %s))", left, right)
+			case scanner.TokenLess:
+				return gen.operation("Less", left, right)
+			case scanner.TokenLessEqual:
+				return gen.operation("LessEqual", left, right)
+			case scanner.TokenGreater:
+				return gen.operation("Less", right, left)
+			default:
+				return gen.operation("LessEqual", right, left)
+			}
+		})
+	case Bitwise:
+		return gen.chain(node.operand, node.operands(), func(i int, left, right string) string {
+			item := node.items[i]
+			gen.at(item.span)
+
+			switch item.bitwiseOp {
+			case scanner.TokenPipe:
+				return gen.operation("BitOr", left, right)
+			case scanner.TokenTilde:
+				return gen.operation("BitXor", left, right)
+			case scanner.TokenAmpersand:
+				return gen.operation("BitAnd", left, right)
+			case scanner.TokenLessLess:
+				return gen.operation("ShiftLeft", left, right)
+			default:
+				return gen.operation("ShiftRight", left, right)
+			}
+		})
+	case Term:
+		return gen.chain(node.factor, node.operands(), func(i int, left, right string) string {
+			item := node.items[i]
+			gen.at(item.span)
+
+			if item.termOp == scanner.TokenPlus {
+				return gen.operation("Add", left, right)
+			}
+
+			return gen.operation("Subtract", left, right)
+		})
+	case Factor:
+		return gen.chain(node.unary, node.operands(), func(i int, left, right string) string {
+			item := node.items[i]
+			gen.at(item.span)
+
+			if item.factorOp == scanner.TokenStar {
+				return gen.operation("Multiply", left, right)
+			}
+
+			return gen.operation("Divide", left, right)
+		})
+	case NegateUnary:
+		operand := gen.expression(node.unary, false)
+		gen.at(node.span)
+		return gen.temporary("n.Negate(%s)", operand)
+	case NotUnary:
+		operand := gen.expression(node.unary, false)
+		gen.at(node.span)
+		return gen.temporary("value.Boolean(!%s.AsBoolean())", operand)
+	case BitwiseNotUnary:
+		return gen.operation("BitNot", gen.unary(node.unary, node.span))
+	case LengthUnary:
+		return gen.operation("Length", gen.unary(node.unary, node.span))
+	case Exponent:
+		// Like Exponent.emitTo, the exponent is a compile error and no Go is
+		// generated for the script
+		return gen.expression(node.base, copy)
+	case TableLiteral:
+		return gen.table(node)
+	default:
+		panic(fmt.Sprintf("Internal error: cannot generate Go for %T", node))
+	}
+}
+
+func (gen *generator) unary(operand Node, span glerror.Span) string {
+	val := gen.expression(operand, false)
+	gen.at(span)
+
+	return val
+}
+
+// A Native operation that can fail, at the current position
+func (gen *generator) operation(method string, operands ...string) string {
+	gen.mark()
+	return gen.temporary("n.%s(%s)", method, strings.Join(operands, ", "))
+}
+
+// Like compiler.emitChain, from left to right with the result so far on the left
+func (gen *generator) chain(first Node, operands []Node, operation func(i int, left, right string) string) string {
+	if len(operands) == 0 {
+		return gen.expression(first, false)
+	}
+
+	left := gen.expression(first, false)
+	for i, operand := range operands {
+		right := gen.expression(operand, false)
+		left = operation(i, left, right)
+	}
+
+	return left
+}
+
+func (gen *generator) variable(primary VariablePrimary, copy bool) string {
+	name := primary.name
+	gen.at(primary.span)
+
+	if local, ok := gen.function.local(name); ok {
+		if copy {
+			return gen.temporary("%s", local.goName)
+		}
+
+		return local.goName
+	}
+
+	if upvalue, ok := gen.function.upvalue(name); ok {
+		return gen.temporary("%s", upvalue.goName)
+	}
+
+	if name == envName {
+		return gen.temporary("value.TableValue(closure.Env)")
+	}
+
+	if gen.function.hasLocalEnv() {
+		return gen.expression(TableAccessor{VariablePrimary{envName, primary.span}, StringPrimary(string(name)), primary.span}, copy)
+	}
+
+	return gen.temporary("closure.Env.GetGlobal(%s)", gen.global(name))
+}
+
+// Keyed entries are set before the values in the list are inserted, as in
+// TableLiteral.Emit
+func (gen *generator) table(literal TableLiteral) string {
+	gen.mark()
+	table := gen.temporary("n.NewTable()")
+
+	for _, entry := range mapPairs(literal.entries) {
+		var key, val Node
+		switch entry := entry.(type) {
+		case StringPair:
+			key, val = entry.key, entry.value
+		case LiteralPair:
+			key, val = entry.key, entry.value
+		}
+
+		k := gen.expression(key, false)
+		v := gen.expression(val, false)
+		gen.mark()
+		gen.line("n.SetTable(%s, %s, %s)", table, k, v)
+	}
+
+	for _, entry := range valuePairs(literal.entries) {
+		v := gen.expression(entry.(Value).value, false)
+		gen.mark()
+		gen.line("n.Insert(%s, %s)", table, v)
+	}
+
+	return table
+}
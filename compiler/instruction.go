@@ -0,0 +1,84 @@
+package compiler
+
+// Instructions are 32 bits, laid out like those of Lua 5.1: a 6 bit opcode
+// and an 8 bit register A, then either two 9 bit operands B and C or one 18
+// bit operand Bx. Jumps use all the bits above the opcode for a signed offset
+//
+//	|  B (9)  |  C (9)  |  A (8)  | op (6) |
+//	|      Bx (18)      |  A (8)  | op (6) |
+//	|           sJ (26)           | op (6) |
+const (
+	sizeOp = 6
+	sizeA  = 8
+	sizeB  = 9
+	sizeC  = 9
+	sizeBx = sizeB + sizeC
+	sizeJ  = sizeA + sizeBx
+
+	posA  = sizeOp
+	posC  = posA + sizeA
+	posB  = posC + sizeC
+	posBx = posC
+	posJ  = posA
+
+	MaxRegister = 1<<sizeA - 1
+	MaxBx       = 1<<sizeBx - 1
+	MaxJump     = 1<<(sizeJ-1) - 1
+)
+
+// B and C are RK operands for most instructions: with the high bit set they
+// index the constants instead of the registers, so that a constant can be
+// used without loading it into a register first
+const (
+	constantBit   = 1 << (sizeB - 1)
+	maxRKConstant = constantBit - 1
+)
+
+func encodeABC(op byte, a, b, c int) uint32 {
+	return uint32(op) | uint32(a)<<posA | uint32(b)<<posB | uint32(c)<<posC
+}
+
+func encodeABx(op byte, a, bx int) uint32 {
+	return uint32(op) | uint32(a)<<posA | uint32(bx)<<posBx
+}
+
+// The offset is stored with a bias so that it is never negative
+func encodeJ(op byte, offset int) uint32 {
+	return uint32(op) | uint32(offset+MaxJump)<<posJ
+}
+
+func Op(instruction uint32) byte {
+	return byte(instruction & (1<<sizeOp - 1))
+}
+
+func A(instruction uint32) int {
+	return int(instruction >> posA & (1<<sizeA - 1))
+}
+
+func B(instruction uint32) int {
+	return int(instruction >> posB & (1<<sizeB - 1))
+}
+
+func C(instruction uint32) int {
+	return int(instruction >> posC & (1<<sizeC - 1))
+}
+
+func Bx(instruction uint32) int {
+	return int(instruction >> posBx & (1<<sizeBx - 1))
+}
+
+func J(instruction uint32) int {
+	return int(instruction>>posJ) - MaxJump
+}
+
+func IsConstant(operand int) bool {
+	return operand&constantBit != 0
+}
+
+func ConstantIndex(operand int) int {
+	return operand &^ constantBit
+}
+
+func constantOperand(index int) int {
+	return index | constantBit
+}
@@ -0,0 +1,277 @@
+package compiler
+
+import (
+	"arlindohall/glua/scanner"
+	"arlindohall/glua/value"
+)
+
+// Optimization levels, see options.Optimize. Folding evaluates expressions on
+// constants while compiling and leaves out code that can never run, jumps
+// threads jumps to jumps and tests comparisons directly
+const (
+	optimizeFold  = 1
+	optimizeJumps = 2
+)
+
+func (compiler *compiler) optimizing(level int) bool {
+	return compiler.options.Optimize >= level
+}
+
+// Evaluates an operation whose operands are all constants. Anything that
+// would be an error is left for the VM, so the error happens when and if the
+// code runs, just as it would without optimizing
+func (compiler *compiler) fold(node Node) (value.Value, bool) {
+	return fold(node, compiler.constantValue)
+}
+
+// Like constantValue, but operations are folded at any optimization level so
+// that a <const> local initialized with one is a constant either way.
+// `variableConstant` finds the value of the <const> variables it reads
+func constantExpression(node Node, variableConstant func(Identifier) *value.Value) (value.Value, bool) {
+	switch node := node.(type) {
+	case LiteralPrimary:
+		return node.value, true
+	case VariablePrimary:
+		if constant := variableConstant(node.name); constant != nil {
+			return *constant, true
+		}
+
+		return value.Nil(), false
+	}
+
+	return fold(node, func(node Node) (value.Value, bool) {
+		return constantExpression(node, variableConstant)
+	})
+}
+
+// Folds the operation, with `constantValue` giving the value of each operand
+// that is known
+func fold(node Node, constantValue func(Node) (value.Value, bool)) (value.Value, bool) {
+	switch node := node.(type) {
+	case LogicOr:
+		return foldChain(constantValue, node.value, node.or, func(i int, left, right value.Value) (value.Value, bool) {
+			return value.Boolean(left.AsBoolean() || right.AsBoolean()), true
+		})
+	case LogicAnd:
+		return foldChain(constantValue, node.value, node.and, func(i int, left, right value.Value) (value.Value, bool) {
+			return value.Boolean(left.AsBoolean() && right.AsBoolean()), true
+		})
+	case Comparison:
+		return foldChain(constantValue, node.term, node.operands(), func(i int, left, right value.Value) (value.Value, bool) {
+			return foldComparison(node.items[i].compareOp, left, right)
+		})
+	case Bitwise:
+		return foldChain(constantValue, node.operand, node.operands(), func(i int, left, right value.Value) (value.Value, bool) {
+			return foldBitwise(node.items[i].bitwiseOp, left, right)
+		})
+	case Term:
+		return foldChain(constantValue, node.factor, node.operands(), func(i int, left, right value.Value) (value.Value, bool) {
+			return foldArithmetic(node.items[i].termOp, left, right)
+		})
+	case Factor:
+		return foldChain(constantValue, node.unary, node.operands(), func(i int, left, right value.Value) (value.Value, bool) {
+			return foldArithmetic(node.items[i].factorOp, left, right)
+		})
+	case NegateUnary:
+		val, ok := constantValue(node.unary)
+		switch {
+		case !ok || !val.IsNumber():
+		case val.IsInteger():
+			return value.Integer(-val.AsInteger()), true
+		default:
+			return value.Number(-val.AsNumber()), true
+		}
+	case NotUnary:
+		if val, ok := constantValue(node.unary); ok {
+			return value.Boolean(!val.AsBoolean()), true
+		}
+	case BitwiseNotUnary:
+		if val, ok := constantValue(node.unary); ok {
+			if integer, ok := value.ToInteger(val); ok {
+				return value.Integer(^integer), true
+			}
+		}
+	case LengthUnary:
+		if val, ok := constantValue(node.unary); ok && val.IsString() {
+			return value.Integer(int64(len(val.RawString()))), true
+		}
+	}
+
+	return value.Nil(), false
+}
+
+// Folds a chain from left to right, like emitChain evaluates it
+func foldChain(constantValue func(Node) (value.Value, bool), first Node, operands []Node, fold func(i int, left, right value.Value) (value.Value, bool)) (value.Value, bool) {
+	if len(operands) == 0 {
+		return constantValue(first)
+	}
+
+	result, ok := constantValue(first)
+	for i := 0; ok && i < len(operands); i++ {
+		var right value.Value
+		if right, ok = constantValue(operands[i]); ok {
+			result, ok = fold(i, result, right)
+		}
+	}
+
+	return result, ok
+}
+
+func foldArithmetic(op scanner.TokenType, left, right value.Value) (value.Value, bool) {
+	switch op {
+	case scanner.TokenPlus:
+		return value.Arithmetic(left, right, func(a, b int64) int64 { return a + b }, func(a, b float64) float64 { return a + b })
+	case scanner.TokenMinus:
+		return value.Arithmetic(left, right, func(a, b int64) int64 { return a - b }, func(a, b float64) float64 { return a - b })
+	case scanner.TokenStar:
+		return value.Arithmetic(left, right, func(a, b int64) int64 { return a * b }, func(a, b float64) float64 { return a * b })
+	case scanner.TokenSlash:
+		return value.Arithmetic(left, right, nil, func(a, b float64) float64 { return a / b })
+	default:
+		return value.Nil(), false
+	}
+}
+
+// Only numbers can be ordered, comparing anything else is an error
+func foldComparison(op scanner.TokenType, left, right value.Value) (value.Value, bool) {
+	switch op {
+	case scanner.TokenEqualEqual:
+		return value.Boolean(value.Equal(left, right)), true
+	case scanner.TokenTildeEqual:
+		return value.Boolean(!value.Equal(left, right)), true
+	}
+
+	if !left.IsNumber() || !right.IsNumber() {
+		return value.Nil(), false
+	}
+
+	switch op {
+	case scanner.TokenLess:
+		return value.Boolean(value.NumberLess(left, right)), true
+	case scanner.TokenLessEqual:
+		return value.Boolean(value.NumberLessEqual(left, right)), true
+	case scanner.TokenGreater:
+		return value.Boolean(value.NumberLess(right, left)), true
+	case scanner.TokenGreaterEqual:
+		return value.Boolean(value.NumberLessEqual(right, left)), true
+	default:
+		return value.Nil(), false
+	}
+}
+
+func foldBitwise(op scanner.TokenType, left, right value.Value) (value.Value, bool) {
+	a, ok := value.ToInteger(left)
+	if !ok {
+		return value.Nil(), false
+	}
+
+	b, ok := value.ToInteger(right)
+	if !ok {
+		return value.Nil(), false
+	}
+
+	switch op {
+	case scanner.TokenPipe:
+		return value.Integer(a | b), true
+	case scanner.TokenTilde:
+		return value.Integer(a ^ b), true
+	case scanner.TokenAmpersand:
+		return value.Integer(a & b), true
+	case scanner.TokenLessLess:
+		return value.Integer(value.ShiftLeft(a, b)), true
+	case scanner.TokenGreaterGreater:
+		return value.Integer(value.ShiftRight(a, b)), true
+	default:
+		return value.Nil(), false
+	}
+}
+
+// A condition that folds to a constant decides which branch runs while
+// compiling
+func (compiler *compiler) constantCondition(condition Node) (bool, bool) {
+	if !compiler.optimizing(optimizeFold) {
+		return false, false
+	}
+
+	val, ok := compiler.constantValue(condition)
+	return val.AsBoolean(), ok
+}
+
+// Code that can never run is still compiled so that it reports the same
+// errors, but none of it is kept
+func (compiler *compiler) emitUnreachable(node Node) {
+	size := compiler.chunkSize()
+	node.Emit(compiler)
+
+	compiler.chunk.Code = compiler.chunk.Code[:size]
+	compiler.chunk.Spans = compiler.chunk.Spans[:size]
+
+	// So were its breaks out of the loops around it, they aren't patched
+	for i := range compiler.loops {
+		breaks := compiler.loops[i].breaks
+		for len(breaks) > 0 && breaks[len(breaks)-1] >= size {
+			breaks = breaks[:len(breaks)-1]
+		}
+		compiler.loops[i].breaks = breaks
+	}
+}
+
+// A condition that is a single comparison skips the jump after it with one
+// of the OpTest comparisons, rather than storing the result and testing it
+func (compiler *compiler) emitTestComparison(condition Node) bool {
+	comparison, ok := condition.(Comparison)
+	if !ok || len(comparison.items) != 1 || !compiler.optimizing(optimizeJumps) {
+		return false
+	}
+
+	top := compiler.registers
+	item := comparison.items[0]
+	left := compiler.operand(comparison.term)
+	right := compiler.operand(item.term)
+
+	// The jump is taken when the condition is false
+	compiler.at(item.span)
+	switch item.compareOp {
+	case scanner.TokenEqualEqual:
+		compiler.emitABC(OpTestEquals, 0, left, right)
+	case scanner.TokenTildeEqual:
+		compiler.emitABC(OpTestEquals, 1, left, right)
+	case scanner.TokenLess:
+		compiler.emitABC(OpTestLess, 0, left, right)
+	case scanner.TokenLessEqual:
+		compiler.emitABC(OpTestLessEqual, 0, left, right)
+	case scanner.TokenGreater:
+		compiler.emitABC(OpTestLess, 0, right, left)
+	case scanner.TokenGreaterEqual:
+		compiler.emitABC(OpTestLessEqual, 0, right, left)
+	default:
+		compiler.free(top)
+		return false
+	}
+
+	compiler.free(top)
+	return true
+}
+
+// A jump to a jump goes straight to where the second one goes. Loops of
+// jumps that never get anywhere are left alone
+func (compiler *compiler) threadJumps() {
+	code := compiler.chunk.Code
+
+	for i, instruction := range code {
+		if Op(instruction) != OpJump {
+			continue
+		}
+
+		dest := i + 1 + J(instruction)
+		for steps := 0; steps < len(code) && dest < len(code) && Op(code[dest]) == OpJump; steps++ {
+			dest = dest + 1 + J(code[dest])
+		}
+
+		if dest < len(code) && Op(code[dest]) == OpJump {
+			continue
+		}
+
+		code[i] = encodeJ(OpJump, dest-i-1)
+	}
+}
@@ -1,26 +1,36 @@
 package main
 
 import (
+	"arlindohall/glua/compiler"
 	"arlindohall/glua/constants"
+	"arlindohall/glua/glerror"
 	"arlindohall/glua/interpreter"
+	"arlindohall/glua/options"
+	"arlindohall/glua/scanner"
+	"arlindohall/glua/value"
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
+// Every script runs on both backends
 func expectNoErrors(t *testing.T, text string) {
-	if constants.PrintTokens {
-		fmt.Println("~~~~~~~~~~ Running program ~~~~~~~~~~")
-		fmt.Println(text)
-		fmt.Println("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
-	}
-
-	vm := interpreter.NewVm()
-	_, err := interpreter.FromString(&vm, text).Interpret()
-
-	if !err.IsEmpty() {
-		fmt.Println("Error running test:")
-		fmt.Println(err)
-		t.FailNow()
+	for _, backend := range []string{options.BackendBytecode, options.BackendClosures} {
+		vm := interpreter.NewVmWithOptions(options.Options{Backend: backend})
+		_, err := interpreter.FromString(vm, text).Interpret()
+
+		if !err.IsEmpty() {
+			fmt.Println("Error running test with the", backend, "backend:")
+			fmt.Println(err)
+			t.FailNow()
+		}
 	}
 }
 
@@ -362,6 +372,49 @@ func TestFibonacciMultipleAssignment(t *testing.T) {
 	expectNoErrors(t, text)
 }
 
+func TestSwapAssignment(t *testing.T) {
+	text := `
+	local a, b = 1, 2
+	a, b = b, a
+	assert a == 2
+	assert b == 1
+
+	x, y = "x", "y"
+	x, y = y, x
+	assert x == "y"
+	assert y == "x"
+
+	local t = {1, 2}
+	t[1], t[2] = t[2], t[1]
+	assert t[1] == 2
+	assert t[2] == 1
+
+	function f()
+		return 1, 2
+	end
+
+	local c, d = f(), 3
+	assert c == 1
+	assert d == 3
+	`
+
+	expectNoErrors(t, text)
+}
+
+func TestNaNComparison(t *testing.T) {
+	text := `
+	local n = 0 / 0
+	assert !(n < n)
+	assert !(n <= n)
+	assert !(n > n)
+	assert !(n >= n)
+	assert n ~= n
+	assert 1 <= 1 and 2 >= 1 and 2 > 1
+	`
+
+	expectNoErrors(t, text)
+}
+
 func TestEmptyReturn(t *testing.T) {
 	text := `
 	function f()
@@ -419,6 +472,594 @@ func TestGenericFor(t *testing.T) {
 	expectNoErrors(t, text)
 }
 
+// Breaks are also tested when optimizing, where code after them is dropped
+func TestBreak(t *testing.T) {
+	text := `
+	function upTo(limit)
+		local i = 0
+		function iter()
+			i = i + 1
+			if i > limit then
+				return nil
+			end
+			return i
+		end
+		return iter
+	end
+
+	local i = 0
+	while true do
+		i = i + 1
+		if i == 5 then break end
+	end
+	assert i == 5
+
+	local seen = 0
+	for k = 1, 2, 3, 4 do
+		seen = seen + k
+		if k == 2 then
+			break
+		end
+	end
+	assert seen == 3
+
+	local total = 0
+	for v in upTo(10) do
+		if v == 3 then break end
+		total = total + v
+	end
+	assert total == 3
+
+	local outer, inner = 0, 0
+	while outer < 3 do
+		outer = outer + 1
+		while true do
+			inner = inner + 1
+			break
+		end
+	end
+	assert outer == 3 and inner == 3
+
+	local fs = {}
+	local n = 0
+	while n < 10 do
+		n = n + 1
+		local v = n * 10
+		function get() return v end
+		fs[n] = get
+		if n == 2 then break end
+		v = v + 1
+	end
+	assert n == 2 and fs[1]() == 11 and fs[2]() == 20
+
+	while false do break end
+	if false then while true do break end end
+	while true do
+		break
+		x = 1
+	end
+	assert x == nil
+	`
+
+	for level := 0; level <= 2; level++ {
+		for _, backend := range []string{options.BackendBytecode, options.BackendClosures} {
+			vm := interpreter.NewVmWithOptions(options.Options{Backend: backend, Optimize: level})
+			_, err := interpreter.FromString(vm, text).Interpret()
+
+			if !err.IsEmpty() {
+				t.Fatalf("Error with the %s backend at optimization level %d: %v", backend, level, err)
+			}
+		}
+	}
+}
+
+func TestBreakOutsideLoop(t *testing.T) {
+	expectCompileError(t, "break")
+	expectCompileError(t, "if true then break end")
+	expectCompileError(t, `
+	while true do
+		function f()
+			break
+		end
+	end
+	`)
+}
+
+func TestIntegerSubtype(t *testing.T) {
+	text := `
+	assert math.type(1) == "integer"
+	assert math.type(1.0) == "float"
+	assert math.type(1e3) == "float"
+	assert math.type(4 / 2) == "float"
+	assert math.type(2 * 3 - 1) == "integer"
+	assert math.type("1") == nil
+	assert 7 / 2 == 3.5
+	assert 1 == 1.0
+	assert 9007199254740993 ~= 9007199254740992
+	assert 9007199254740993 > 9007199254740992.0
+	assert math.maxinteger + 1 == math.mininteger
+	assert math.tointeger(3.0) == 3
+	assert math.tointeger(3.5) == nil
+	`
+
+	expectNoErrors(t, text)
+}
+
+func TestStringKeys(t *testing.T) {
+	text := `
+	local long = "a string that is longer than the ones that are interned"
+	local t = {name = "glua", [long] = 1, [math.type(1)] = 2}
+	assert t.name == "glua"
+	assert t["name"] == "glua"
+	assert t[long] == 1
+	assert t["a string that is longer than the ones that are interned"] == 1
+	assert t.integer == 2
+	assert math.type(1) == "integer"
+	assert "glua" ~= "lua"
+
+	local u = {a = 1, b = 2, c = 3, d = 4, e = 5, f = 6, g = 7, h = 8, i = 9}
+	u.a, u.c, u.e = nil, nil, nil
+	u.j, u.k = 10, 11
+	assert u.a == nil and u.c == nil and u.e == nil
+	assert u.b == 2 and u.i == 9 and u.k == 11
+	u.a = 12
+	assert u.a == 12
+	`
+
+	expectNoErrors(t, text)
+}
+
+// The intern table starts over once it's full, strings from before are
+// still equal to the new ones
+func TestInternLimit(t *testing.T) {
+	strings := value.Strings{}
+	first := strings.Intern(value.StringVal("first"))
+
+	for i := 0; i < 100000; i++ {
+		strings.Intern(value.StringVal(fmt.Sprint("s", i)))
+	}
+
+	if len(strings) > 1<<16 {
+		t.Error("Expected the intern table to be bounded, it has: ", len(strings))
+	}
+
+	table := value.NewTable()
+	table.Set(first, value.Integer(1))
+
+	if again := strings.Intern(value.StringVal("first")); !value.Equal(first, again) || table.Get(again).IsNil() {
+		t.Error("Expected strings interned before the table was emptied to equal new ones")
+	}
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	text := `
+	assert 5 & 3 == 1
+	assert 5 | 3 == 7
+	assert 5 ~ 3 == 6
+	assert ~0 == -1
+	assert 1 << 4 == 16
+	assert 256 >> 4 == 16
+	assert 1 << 64 == 0
+	assert -1 >> 63 == 1
+	assert 1 << -1 == 0
+	assert 0xFF & 0x0F == 15
+	assert 2.0 | 1 == 3
+	assert 1 | 2 ~ 3 & 4 << 1 == 3
+	assert 1 + 1 << 1 == 4
+	`
+
+	expectNoErrors(t, text)
+}
+
+func TestBitwiseOnFloatFails(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, "1.5 | 1").Interpret()
+
+	if err.IsEmpty() {
+		t.Fatal("Expected error for float without integer representation")
+	}
+}
+
+func TestExponentNotSupported(t *testing.T) {
+	for _, backend := range []string{options.BackendBytecode, options.BackendClosures} {
+		vm := interpreter.NewVmWithOptions(options.Options{Backend: backend})
+		_, err := interpreter.FromString(vm, "x = 2\nreturn x ^ 3 ^ 2").Interpret()
+
+		if err.Len() != 2 || !strings.Contains(err.First().Error(), "[stdin:2:10] ---> Exponentiation is not supported") {
+			t.Error("Expected a compile error for each exponent, got: ", err)
+		}
+	}
+
+	scan := scanner.Scanner("exponent", bufio.NewReader(strings.NewReader("return 2 ^ 3")))
+	if _, err := compiler.GenerateGo(scan.Tokens(), scan.Source(), options.Options{}, "main"); err.IsEmpty() {
+		t.Error("Expected gen-go to report the exponent")
+	}
+}
+
+func TestTableFloatKeys(t *testing.T) {
+	text := `
+	t = {"a", "b"}
+	assert t[1.0] == "a"
+	t[3.0] = "c"
+	assert t[3] == "c"
+	t[1.5] = "d"
+	assert t[1.5] == "d"
+	`
+
+	expectNoErrors(t, text)
+}
+
+// Keys are removed and added while the hash part stays the same size, which
+// used to rehash the whole table on every new key
+func TestTableChurn(t *testing.T) {
+	text := `
+	local t = {}
+	local i = 0
+	while i < 1025 do
+		t[i + 0.5] = i
+		i = i + 1
+	end
+
+	local j = 0
+	while j < 2000 do
+		t[j + 0.5] = nil
+		t[i + j + 0.5] = j
+		j = j + 1
+	end
+
+	assert t[0.5] == nil
+	assert t[1999.5] == nil
+	assert t[2000.5] == 975
+	assert t[i + 1999.5] == 1999
+	`
+
+	expectNoErrors(t, text)
+}
+
+func expectCompileError(t *testing.T, text string) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, text).Interpret()
+
+	if err.IsEmpty() {
+		t.Fatal("Expected compile error")
+	}
+
+	if _, ok := err.First().(compiler.CompileError); !ok {
+		t.Fatal("Expected compile error, got: ", err)
+	}
+}
+
+func TestConstLocal(t *testing.T) {
+	text := `
+	local x <const>, y = 10, 20
+	y = 30
+	function f()
+		return x
+	end
+	assert f() == 10
+	assert x + y == 40
+	`
+
+	expectNoErrors(t, text)
+}
+
+func TestAssignConstLocal(t *testing.T) {
+	expectCompileError(t, `
+	local x <const> = 10
+	x = 20
+	`)
+
+	expectCompileError(t, `
+	do
+		local x <const> = 10
+		function f()
+			x = 20
+		end
+	end
+	`)
+
+	expectCompileError(t, "local x <constant> = 10")
+	expectCompileError(t, "global x <const> = 10")
+}
+
+// Operations on constants are folded at every optimization level, so the
+// function returns a constant rather than reading an upvalue
+func TestConstExpression(t *testing.T) {
+	text := `
+	local a <const> = 2
+	local b <const>, c <const> = a * 3 + 1, #"abc" == 3
+	function f()
+		return b
+	end
+	assert c
+	local d <const> = 1 + nil
+	`
+
+	for _, backend := range []string{options.BackendBytecode, options.BackendClosures} {
+		var out bytes.Buffer
+		vm := interpreter.NewVmWithOptions(options.Options{Backend: backend, DumpBytecode: true, Output: &out})
+		_, err := interpreter.FromString(vm, text).Interpret()
+		expectRuntimeError(t, err, "Cannot add two non-numbers")
+
+		vm.ClearErrors()
+		_, err = interpreter.FromString(vm, "assert f() == 7").Interpret()
+		if !err.IsEmpty() {
+			t.Fatal(err)
+		}
+
+		if backend == options.BackendBytecode && strings.Contains(out.String(), "OpGetUpvalue") {
+			t.Error("Expected the constant to be folded, got:\n", out.String())
+		}
+	}
+}
+
+const closeResource = `
+count = 0
+closed = {}
+function onClose(resource, err)
+	count = count + 1
+	closed[count] = resource.name
+end
+meta = {__close = onClose}
+function resource(name)
+	local r = {name = name}
+	setmetatable(r, meta)
+	return r
+end
+`
+
+func TestToBeClosedLocal(t *testing.T) {
+	text := closeResource + `
+	do
+		local a <close> = resource("a")
+		local b <close> = resource("b")
+		local c <close> = nil
+		assert count == 0
+	end
+	assert count == 2
+	assert closed[1] == "b"
+	assert closed[2] == "a"
+
+	function early()
+		local d <close> = resource("d")
+		if true then
+			return 1
+		end
+		return 2
+	end
+
+	assert early() == 1
+	assert count == 3
+	assert closed[3] == "d"
+	`
+
+	expectNoErrors(t, text)
+}
+
+func TestToBeClosedLocalOnError(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, closeResource+`
+	do
+		local e <close> = resource("e")
+		x = 1 + {}
+	end
+	`).Interpret()
+
+	if err.IsEmpty() {
+		t.Fatal("Expected runtime error")
+	}
+
+	vm.ClearErrors()
+	_, err = interpreter.FromString(vm, `assert closed[1] == "e"`).Interpret()
+
+	if !err.IsEmpty() {
+		t.Fatal(err)
+	}
+}
+
+func TestToBeClosedNonClosable(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, "local x <close> = {}").Interpret()
+
+	if err.IsEmpty() {
+		t.Fatal("Expected error for non-closable value")
+	}
+}
+
+func TestToBeClosedLocalOnBreak(t *testing.T) {
+	text := closeResource + `
+	local i = 0
+	while true do
+		i = i + 1
+		local a <close> = resource(i)
+		do
+			local b <close> = resource(i * 10)
+			if i == 2 then break end
+		end
+	end
+	assert count == 4
+	assert closed[1] == 10 and closed[2] == 1 and closed[3] == 20 and closed[4] == 2
+
+	for k = 1, 2 do
+		local c <close> = resource(k + 100)
+		break
+	end
+	assert count == 5 and closed[5] == 101
+	`
+
+	expectNoErrors(t, text)
+}
+
+func TestCallSugar(t *testing.T) {
+	text := `
+	function id(x)
+		return x
+	end
+
+	assert id"abc" == "abc"
+	assert id "abc" == "abc"
+	assert id{1, 2, 3}[3] == 3
+	assert id{name = "glua"}.name == "glua"
+
+	function describe(name)
+		function body(t)
+			return t.n
+		end
+		return body
+	end
+
+	assert describe "thing" { n = 5 } == 5
+	`
+
+	expectNoErrors(t, text)
+}
+
+func TestTableSeparators(t *testing.T) {
+	text := `
+	t = {1; 2, 3;}
+	assert t[1] == 1
+	assert t[3] == 3
+
+	u = {a = 1; b = 2,}
+	assert u.a == 1 and u.b == 2
+
+	v = {[1] = "x"; "y";}
+	assert v[1] == "y"
+	`
+
+	expectNoErrors(t, text)
+}
+
+func TestTableMissingSeparator(t *testing.T) {
+	expectCompileError(t, "t = {1 2}")
+}
+
+func TestManyConstants(t *testing.T) {
+	var text strings.Builder
+
+	text.WriteString("t = {")
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&text, "%d, ", i)
+	}
+	text.WriteString("}\n")
+
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&text, "g%d = %d\n", i, i+1000)
+	}
+
+	text.WriteString(`
+	assert t[1] == 0
+	assert t[1000] == 999
+	assert g0 == 1000
+	assert g299 == 1299
+	`)
+
+	expectNoErrors(t, text.String())
+}
+
+func TestLongJumps(t *testing.T) {
+	var body strings.Builder
+	for i := 0; i < 10000; i++ {
+		body.WriteString("x = x + 1\n")
+	}
+
+	text := fmt.Sprintf(`
+	x = 0
+	if x == 1 then
+		%s
+	end
+	assert x == 0
+
+	function f()
+		local n = 0
+		while n < 2 do
+			n = n + 1
+			%s
+		end
+		return n
+	end
+
+	assert f() == 2
+	assert x == 20000
+	`, body.String(), body.String())
+
+	expectNoErrors(t, text)
+}
+
+func TestTooManyArguments(t *testing.T) {
+	args := make([]string, 300)
+	for i := range args {
+		args[i] = "1"
+	}
+
+	expectCompileError(t, fmt.Sprintf("f(%s)", strings.Join(args, ", ")))
+}
+
+func TestDistinctConstants(t *testing.T) {
+	text := `
+	a, b = 0.0, -0.0
+	assert 1 / a > 0
+	assert 1 / b < 0
+	assert math.type(1) == "integer"
+	assert math.type(1.0) == "float"
+	assert "1" ~= 1
+	`
+
+	expectNoErrors(t, text)
+}
+
+func TestRuntimeErrorTraceback(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, `
+	function inner()
+		return 1 + {}
+	end
+
+	function outer()
+		local x = inner()
+		return x
+	end
+
+	outer()
+	`).Interpret()
+
+	if err.IsEmpty() {
+		t.Fatal("Expected runtime error")
+	}
+
+	re, ok := err.First().(interpreter.RuntimeError)
+	if !ok {
+		t.Fatal("Expected runtime error, got: ", err)
+	}
+
+	var functions []string
+	for _, frame := range re.Traceback() {
+		functions = append(functions, frame.Function)
+
+		if frame.Chunk != "stdin" {
+			t.Error("Expected chunk name stdin, got: ", frame.Chunk)
+		}
+	}
+
+	if strings.Join(functions, ",") != "inner,outer," {
+		t.Error("Unexpected traceback: ", interpreter.FormatTraceback(re.Traceback()))
+	}
+}
+
+func TestDebugTraceback(t *testing.T) {
+	vm := interpreter.NewVm()
+	val, err := interpreter.FromString(vm, `debug.traceback("message")`).Interpret()
+
+	if !err.IsEmpty() {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(val.RawString(), "message\nstack traceback:\n\tstdin:") ||
+		!strings.HasSuffix(val.RawString(), "in main chunk") {
+		t.Error("Unexpected traceback: ", val.RawString())
+	}
+}
+
 // todo: test for builtin `next` iterator
 
 // func TestStressFunctionCall(t *testing.T) {
@@ -458,3 +1099,1261 @@ func TestGenericFor(t *testing.T) {
 // 	`
 // 	expectNoErrors(t, text)
 // }
+
+func TestCompileErrorSnippet(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, "local x <const> = 1\nx = 2").Interpret()
+
+	if err.IsEmpty() {
+		t.Fatal("Expected compile error")
+	}
+
+	expected := "Compile error [stdin:2:1] ---> Attempt to assign to const variable 'x'\n" +
+		"2 | x = 2\n" +
+		"  | ^"
+
+	if err.First().Error() != expected {
+		t.Error("Unexpected error: ", err.First())
+	}
+}
+
+func TestRuntimeErrorSnippet(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, "local t = {}\n\tlocal y = 1 + t").Interpret()
+
+	if err.IsEmpty() {
+		t.Fatal("Expected runtime error")
+	}
+
+	re, ok := err.First().(interpreter.RuntimeError)
+	if !ok {
+		t.Fatal("Expected runtime error, got: ", err)
+	}
+
+	if re.Span().Line != 2 || re.Span().Column != 14 {
+		t.Error("Expected error at 2:14, got: ", re.Span())
+	}
+
+	if !strings.HasSuffix(re.Error(), "2 | \tlocal y = 1 + t\n  | \t            ^") {
+		t.Error("Unexpected error: ", re.Error())
+	}
+}
+
+// Only the last lines are held once they're scanned, an error about an
+// earlier line reads it back from the text, or goes without a snippet when
+// the text can't be read again
+func TestErrorSnippetEarlyLine(t *testing.T) {
+	text := "function f() return 1 + {} end\n" + strings.Repeat("x = 1\n", 1000) + "f()"
+	expected := "1 | function f() return 1 + {} end"
+
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, text).Interpret()
+
+	if err.IsEmpty() || !strings.Contains(err.First().Error(), expected) {
+		t.Error("Expected the first line in the error, got: ", err)
+	}
+
+	vm = interpreter.NewVm()
+	_, err = interpreter.FromBufio(vm, "stdin", bufio.NewReader(strings.NewReader(text))).Interpret()
+
+	if err.IsEmpty() || err.First().Error() != "Runtime error [stdin:1:23] ---> Cannot add two non-numbers" {
+		t.Error("Expected the error without a snippet, got: ", err)
+	}
+}
+
+func TestScanErrorSnippet(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, "// comment\nlocal s = \"abc\n").Interpret()
+
+	if err.IsEmpty() {
+		t.Fatal("Expected scan error")
+	}
+
+	expected := "Scan error [stdin:2:11] ---> Newline in string literal\n" +
+		"2 | local s = \"abc\n" +
+		"  |           ^^^^"
+
+	if err.First().Error() != expected {
+		t.Error("Unexpected error: ", err.First())
+	}
+}
+
+// The compiler has already started on the script when the scanner fails, the
+// scan error is still the only one reported and nothing runs
+func TestScanErrorAfterDeclarations(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, "ran = true\nlocal x = 1 $ 2\nlocal y = ").Interpret()
+
+	if _, ok := err.First().(scanner.ScanError); err.Len() != 1 || !ok {
+		t.Fatal("Expected a scan error, got: ", err)
+	}
+
+	val, _ := interpreter.FromString(vm, "return ran").Interpret()
+	if !val.IsNil() {
+		t.Error("Expected the script not to run, got: ", val)
+	}
+}
+
+func TestSyntaxErrorRecovery(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, "if x do\n\ty = 1\nend\nlocal z = = 2\n").Interpret()
+
+	if err.Len() != 2 {
+		t.Fatal("Expected two errors, got: ", err)
+	}
+
+	expected := "Compile error [stdin:1:6] ---> Expected 'then' after if condition, found 'do'"
+	if !strings.HasPrefix(err.First().Error(), expected) {
+		t.Error("Unexpected error: ", err.First())
+	}
+
+	if !strings.Contains(err.Error(), "[stdin:4:11] ---> Expected expression, found '='") {
+		t.Error("Expected error on line 4, got: ", err)
+	}
+}
+
+// The code after an error is still checked, valid code doesn't get errors of
+// its own
+func TestSyntaxErrorCounts(t *testing.T) {
+	for _, script := range []struct {
+		text   string
+		errors int
+		first  string
+	}{
+		{"if x do\n\ty = 1\nend\nreturn 1", 1, "[stdin:1:6] ---> Expected 'then' after if condition, found 'do'"},
+		{"while x then\n\ty = 1\nend\nreturn 1", 1, "[stdin:1:9] ---> Expected 'do' after while condition, found 'then'"},
+		{"if x\n\ty = 1\nend\nreturn 1", 1, "[stdin:2:2] ---> Expected 'then' after if condition, found 'y'"},
+		{"x = = 1\ny = = 2\nz = 3\nreturn z", 2, "[stdin:1:5] ---> Expected expression, found '='"},
+		{strings.Repeat("x = = 1\n", 100) + "return 1", 11, "[stdin:1:5] ---> Expected expression, found '='"},
+	} {
+		vm := interpreter.NewVm()
+		_, err := interpreter.FromString(vm, script.text).Interpret()
+
+		if err.Len() != script.errors || !strings.Contains(err.First().Error(), script.first) {
+			t.Errorf("Expected %d errors starting with %q, got: %v", script.errors, script.first, err)
+		}
+	}
+}
+
+func TestMissingEnd(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, "function f()\n\treturn 1\n").Interpret()
+
+	if err.Len() != 1 {
+		t.Fatal("Expected one error, got: ", err)
+	}
+
+	if !strings.Contains(err.Error(), "Expected 'end' to close 'function' at line 1, found '<eof>'") {
+		t.Error("Unexpected error: ", err)
+	}
+}
+
+func TestErrorLimit(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, strings.Repeat("local x = = 1\n", 20)).Interpret()
+
+	// Ten errors and a note that compilation stopped
+	if err.Len() != 11 {
+		t.Error("Expected compilation to stop after ten errors, got: ", err.Len())
+	}
+}
+
+func TestConstantLimit(t *testing.T) {
+	var text strings.Builder
+	text.WriteString("local t = {\n")
+	for i := 0; i < compiler.MaxBx+100; i++ {
+		fmt.Fprintf(&text, "\t%d.5,\n", i)
+	}
+	text.WriteString("}\n")
+
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, text.String()).Interpret()
+
+	if err.Len() != 1 {
+		t.Fatal("Expected one error, got: ", err.Len())
+	}
+
+	expected := fmt.Sprintf("Compile error [stdin:%d:2] ---> Too many constants in one chunk", compiler.MaxBx+3)
+	if !strings.HasPrefix(err.First().Error(), expected) {
+		t.Error("Unexpected error: ", err.First())
+	}
+}
+
+// Errors in nested functions count towards the limit of the function they
+// are in
+func TestErrorLimitNested(t *testing.T) {
+	text := "function f()\n" +
+		strings.Repeat("\tfunction g()\n\t\tlocal x <const> = 1\n\t\tx = 2\n\tend\n", 20) +
+		"end\n"
+
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, text).Interpret()
+
+	if err.Len() != 10 {
+		t.Error("Expected ten errors, got: ", err.Len())
+	}
+}
+
+func TestDebugOutput(t *testing.T) {
+	var out bytes.Buffer
+	vm := interpreter.NewVmWithOptions(options.Options{
+		DumpTokens:   true,
+		DumpAst:      true,
+		DumpBytecode: true,
+		Trace:        true,
+		Output:       &out,
+	})
+
+	_, err := interpreter.FromString(vm, "local x = 1 + 2").Interpret()
+
+	if !err.IsEmpty() {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"TokenPlus", "LocalDeclaration", "---------- <script> ----------", "========== <script> =========="} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected debug output to contain %q, got:\n%s", expected, out.String())
+		}
+	}
+}
+
+// Optimizing changes how much code a script takes, never what it does
+func TestOptimize(t *testing.T) {
+	text := `
+	local x <const> = 3
+	assert 1 + 3 * 4 / 2 - 2 == 5
+	assert x * 2 == 6 and -x == -3 and !(x == 2) and x ~= 2
+	assert 2 > 1 and 1 >= 1 and 1 < 2 and 1 <= 1.0
+	assert 1 << 2 | 1 == 5 and ~0 == -1 and #"abc" == 3
+
+	function sign(n)
+		if n < 0 then
+			return -1
+		else
+			if n == 0 then
+				return 0
+			end
+		end
+		return 1
+		assert false
+	end
+
+	assert sign(-5) == -1 and sign(0) == 0 and sign(5) == 1
+
+	function count(limit)
+		local i = 0
+		while true do
+			i = i + 1
+			if i >= limit then
+				return i
+			end
+		end
+	end
+
+	assert count(10) == 10
+
+	if false then
+		assert false
+	else
+		while false do
+			assert false
+		end
+	end
+	`
+
+	var sizes [3]int
+	for level := range sizes {
+		var out bytes.Buffer
+		vm := interpreter.NewVmWithOptions(options.Options{Optimize: level, DumpBytecode: true, Output: &out})
+		_, err := interpreter.FromString(vm, text).Interpret()
+
+		if !err.IsEmpty() {
+			t.Fatalf("Error at optimization level %d: %v", level, err)
+		}
+
+		sizes[level] = strings.Count(out.String(), "\n")
+	}
+
+	if sizes[1] >= sizes[0] || sizes[2] >= sizes[1] {
+		t.Error("Expected each optimization level to emit less code, got: ", sizes)
+	}
+}
+
+// Expressions that would fail aren't folded and unreachable code is still
+// checked, so the same errors are reported
+func TestOptimizeKeepsErrors(t *testing.T) {
+	vm := interpreter.NewVmWithOptions(options.Options{Optimize: 2})
+	_, err := interpreter.FromString(vm, "if false then local y = 1 + nil end\nlocal x = 1 + nil").Interpret()
+	expectRuntimeError(t, err, "Cannot add two non-numbers")
+
+	vm = interpreter.NewVmWithOptions(options.Options{Optimize: 2})
+	_, err = interpreter.FromString(vm, `if "a" < "b" then end`).Interpret()
+	expectRuntimeError(t, err, "Unable to compare two non-numbers")
+
+	vm = interpreter.NewVmWithOptions(options.Options{Optimize: 2})
+	_, err = interpreter.FromString(vm, "if false then local x <const> = 1\nx = 2 end").Interpret()
+
+	if _, ok := err.First().(compiler.CompileError); err.IsEmpty() || !ok {
+		t.Fatal("Expected compile error, got: ", err)
+	}
+}
+
+func TestAssertFailure(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, "local x = 1\nassert x == 2").Interpret()
+
+	re, ok := err.First().(interpreter.RuntimeError)
+	if err.IsEmpty() || !ok || !re.Assertion() {
+		t.Fatal("Expected assertion error, got: ", err)
+	}
+
+	if re.Message() != "assertion failed: x == 2" || re.Line() != 2 {
+		t.Error("Unexpected assertion error: ", re)
+	}
+
+	// The VM is still usable after a failed assert, as in the REPL
+	vm.ClearErrors()
+	val, err := interpreter.FromString(vm, "1 + 1").Interpret()
+	if !err.IsEmpty() || val.AsInteger() != 2 {
+		t.Error("Expected VM to recover, got: ", val, err)
+	}
+}
+
+func TestAssertMessage(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, `
+	function check(n)
+		assert n > 0, "n must be positive"
+		return n
+	end
+
+	assert check(1) == 1
+	check(-1)
+	`).Interpret()
+
+	re, ok := err.First().(interpreter.RuntimeError)
+	if err.IsEmpty() || !ok {
+		t.Fatal("Expected assertion error, got: ", err)
+	}
+
+	if re.Message() != "n must be positive" || len(re.Traceback()) != 2 {
+		t.Error("Unexpected assertion error: ", re)
+	}
+}
+
+func expectRuntimeError(t *testing.T, err glerror.GluaErrorChain, message string) {
+	if err.IsEmpty() {
+		t.Fatal("Expected runtime error")
+	}
+
+	re, ok := err.First().(interpreter.RuntimeError)
+	if !ok {
+		t.Fatal("Expected runtime error, got: ", err)
+	}
+
+	if !strings.HasPrefix(re.Message(), message) {
+		t.Error("Unexpected runtime error: ", re.Message())
+	}
+}
+
+func TestInstructionLimit(t *testing.T) {
+	vm := interpreter.NewVmWithOptions(options.Options{MaxInstructions: 1000})
+	_, err := interpreter.FromString(vm, "while true do end").Interpret()
+
+	expectRuntimeError(t, err, "Instruction limit exceeded")
+}
+
+func TestCallDepthLimit(t *testing.T) {
+	vm := interpreter.NewVmWithOptions(options.Options{MaxCallDepth: 100})
+	_, err := interpreter.FromString(vm, `
+	function recurse(n)
+		return recurse(n + 1) + 1
+	end
+
+	recurse(0)
+	`).Interpret()
+
+	expectRuntimeError(t, err, "Stack overflow, call depth")
+}
+
+// Deep recursion grows the stack of frames, an error deep inside it leaves
+// the VM ready for the next script
+func TestDeepRecursion(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, `
+	function depth(n)
+		if n == 0 then
+			assert false, "bottom"
+		end
+		return depth(n - 1) + 1
+	end
+
+	depth(500)
+	`).Interpret()
+
+	expectRuntimeError(t, err, "bottom")
+	if re := err.First().(interpreter.RuntimeError); len(re.Traceback()) != 502 {
+		t.Error("Expected a frame for each call, got: ", len(re.Traceback()))
+	}
+
+	vm.ClearErrors()
+	val, err := interpreter.FromString(vm, `
+	function depth(n)
+		if n == 0 then
+			return 0
+		end
+		return depth(n - 1) + 1
+	end
+
+	return depth(500)
+	`).Interpret()
+
+	if !err.IsEmpty() || val.AsInteger() != 500 {
+		t.Error("Expected VM to recover, got: ", val, err)
+	}
+}
+
+func TestStackSizeLimit(t *testing.T) {
+	vm := interpreter.NewVmWithOptions(options.Options{MaxStackSize: 100})
+	_, err := interpreter.FromString(vm, `
+	function recurse(a, b, c)
+		return recurse(a, b, c) + 1
+	end
+
+	recurse(1, 2, 3)
+	`).Interpret()
+
+	expectRuntimeError(t, err, "Stack overflow, value stack")
+}
+
+func TestContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, "while true do end").InterpretContext(ctx)
+
+	expectRuntimeError(t, err, "Execution interrupted")
+}
+
+// Compiled loops check for interruption on each pass, and counting
+// instructions runs the script as bytecode, so either way it can be stopped
+func TestClosuresBackendLimits(t *testing.T) {
+	loop := `
+	x = 0
+	while x < 1 do
+		x = x * 1
+	end
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	vm := interpreter.NewVmWithOptions(options.Options{Backend: options.BackendClosures, Optimize: 2})
+	_, err := interpreter.FromString(vm, loop).InterpretContext(ctx)
+
+	expectRuntimeError(t, err, "Execution interrupted")
+
+	vm = interpreter.NewVmWithOptions(options.Options{Backend: options.BackendClosures, MaxInstructions: 1000})
+	_, err = interpreter.FromString(vm, loop).Interpret()
+
+	expectRuntimeError(t, err, "Instruction limit exceeded")
+}
+
+// Compiled calls nest on the Go stack, so a higher limit than the backend
+// can go to is lowered rather than overflowing it
+func TestClosuresBackendCallDepth(t *testing.T) {
+	vm := interpreter.NewVmWithOptions(options.Options{Backend: options.BackendClosures, MaxCallDepth: 50000000})
+	_, err := interpreter.FromString(vm, `
+	function deep(n)
+		if n == 0 then
+			return 0
+		end
+		return deep(n - 1) + 1
+	end
+
+	return deep(300000)
+	`).Interpret()
+
+	expectRuntimeError(t, err, "Stack overflow, call depth limit is 200000")
+}
+
+// Compiled functions keep the spans of what they run, so errors and
+// tracebacks are the same as for bytecode
+func TestClosuresBackendErrors(t *testing.T) {
+	for _, text := range []string{
+		"function f(t) return t.x.y end\nfunction g() local v = f({}) return v end\ng()",
+		"local t <close> = {}",
+		"function count(n) if n == 0 then return 0 end return 1 + count(n - 1) end\ncount(1000)",
+		"x = 1 + 2\nx",
+	} {
+		var results [2]string
+
+		for i, backend := range []string{options.BackendBytecode, options.BackendClosures} {
+			vm := interpreter.NewVmWithOptions(options.Options{Backend: backend, MaxCallDepth: 100})
+			val, err := interpreter.FromString(vm, text).Interpret()
+
+			results[i] = fmt.Sprint(val, err)
+			if !err.IsEmpty() {
+				results[i] += interpreter.FormatTraceback(err.First().(interpreter.RuntimeError).Traceback())
+			}
+		}
+
+		if results[0] != results[1] {
+			t.Errorf("Backends differ on %q:\n%s\n%s", text, results[0], results[1])
+		}
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	vm := interpreter.NewVmWithOptions(options.Options{MaxMemory: 100000})
+	_, err := interpreter.FromString(vm, `
+	t = {}
+	x = 1
+	while x < 10000 do
+		function f()
+			return x
+		end
+		t[x] = f
+		x = x + 1
+	end
+	`).Interpret()
+
+	expectRuntimeError(t, err, "Not enough memory")
+}
+
+// Only what the script still holds on to counts towards the limit, so tables
+// that are dropped straight away can be made for as long as it likes
+func TestMemoryLimitTemporaries(t *testing.T) {
+	for _, backend := range []string{options.BackendBytecode, options.BackendClosures} {
+		vm := interpreter.NewVmWithOptions(options.Options{Backend: backend, MaxMemory: 100000})
+		_, err := interpreter.FromString(vm, `
+		local i = 0
+		while i < 100000 do
+			keep = {i, {}}
+			i = i + 1
+		end
+		assert collectgarbage("count") < 10
+		`).Interpret()
+
+		if !err.IsEmpty() {
+			t.Fatalf("Error running test with the %s backend: %v", backend, err)
+		}
+	}
+}
+
+func TestCollectGarbageCount(t *testing.T) {
+	text := `
+	local before = collectgarbage("count")
+	local t = {1, 2, 3, a = {}}
+	assert collectgarbage("count") > before
+	assert collectgarbage() == 0
+	`
+
+	expectNoErrors(t, text)
+}
+
+func TestCustomEnvironment(t *testing.T) {
+	vm := interpreter.NewVm()
+	env := vm.NewEnvironment(interpreter.ProfileEmpty)
+	env.Set(value.StringVal("limit"), value.Integer(3))
+
+	_, err := interpreter.FromStringWithEnv(vm, `
+	x = limit * 2
+	assert _G.x == 6
+	assert _ENV.limit == 3
+	assert math == nil
+	`, env).Interpret()
+
+	if !err.IsEmpty() {
+		fmt.Println(err)
+		t.FailNow()
+	}
+
+	if env.Get(value.StringVal("x")) != value.Integer(6) {
+		t.Error("Expected global to be set in the environment")
+	}
+
+	if !vm.Globals().Get(value.StringVal("x")).IsNil() {
+		t.Error("Expected global not to leak into the VM's globals")
+	}
+}
+
+func TestGlobalCache(t *testing.T) {
+	text := `
+	function f() return 1 end
+	function g() return f() end
+	assert g() == 1
+
+	function f() return 2 end
+	assert g() == 2
+
+	function h() return later end
+	assert h() == nil
+	_G.later = 3
+	assert h() == 3
+	later = nil
+	assert h() == nil
+	`
+
+	expectNoErrors(t, text)
+
+	vm := interpreter.NewVm()
+	env := vm.NewEnvironment(interpreter.ProfileEmpty)
+
+	for i, script := range []string{
+		"function get() return limit end",
+		"assert get() == nil",
+		"assert get() == 1",
+		"assert get() == 2",
+	} {
+		if i > 1 {
+			env.Set(value.StringVal("limit"), value.Integer(int64(i-1)))
+		}
+
+		_, err := interpreter.FromStringWithEnv(vm, script, env).Interpret()
+
+		if !err.IsEmpty() {
+			fmt.Println(err)
+			t.FailNow()
+		}
+	}
+}
+
+// Running a compiled function only reads it, so it can run on several VMs at
+// once
+func TestSharedFunction(t *testing.T) {
+	scan := scanner.Scanner("shared", bufio.NewReader(strings.NewReader(`
+	function count(n)
+		local t = {name = "shared"}
+		local total = 0
+		while n > 0 do
+			total = total + step
+			n = n - 1
+		end
+		assert t.name == "shared"
+		return total
+	end
+
+	step = 2
+	return count(1000)
+	`)))
+
+	function, errs := compiler.Compile(scan.Tokens(), constants.RunFileMode, scan.Source(), options.Options{})
+	if !errs.IsEmpty() {
+		t.Fatal(errs)
+	}
+
+	results := make(chan value.Value)
+	for i := 0; i < 4; i++ {
+		go func() {
+			val, err := interpreter.NewVm().Interpret(function)
+			if !err.IsEmpty() {
+				val = value.StringVal(err.Error())
+			}
+
+			results <- val
+		}()
+	}
+
+	for i := 0; i < 4; i++ {
+		if val := <-results; !value.Equal(val, value.Integer(2000)) {
+			t.Error("Expected 2000, got: ", val)
+		}
+	}
+}
+
+func TestLocalEnvironment(t *testing.T) {
+	text := `
+	x = 1
+	function f()
+		local _ENV = {y = 2}
+		z = y + 1
+		function g()
+			return z
+		end
+		return g()
+	end
+	assert f() == 3
+	assert z == nil
+	assert x == 1
+	`
+
+	expectNoErrors(t, text)
+	expectCompileError(t, "_ENV = {}")
+}
+
+func TestSafeProfile(t *testing.T) {
+	vm := interpreter.NewVm()
+	env := vm.NewEnvironment(interpreter.ProfileSafe)
+
+	_, err := interpreter.FromStringWithEnv(vm, `
+	assert math.type(1) == "integer"
+	assert debug == nil
+	assert collectgarbage == nil
+	`, env).Interpret()
+
+	if !err.IsEmpty() {
+		fmt.Println(err)
+		t.FailNow()
+	}
+}
+
+func TestSharedUpvalue(t *testing.T) {
+	text := `
+	global inc, get
+
+	function counter()
+		local n = 0
+		function increment()
+			n = n + 1
+		end
+		function read()
+			return n
+		end
+		inc = increment
+		get = read
+		increment()
+	end
+
+	counter()
+	inc()
+	inc()
+	assert get() == 3
+	`
+
+	expectNoErrors(t, text)
+}
+
+func TestUpvalueStackGrowth(t *testing.T) {
+	text := `
+	function deep(n)
+		if n == 0 then
+			return 0
+		end
+		return deep(n - 1) + 1
+	end
+
+	function f()
+		local x = 1
+		function g()
+			x = x + deep(500)
+			return x
+		end
+		return g()
+	end
+
+	assert f() == 501
+	`
+
+	expectNoErrors(t, text)
+}
+
+func TestUpvaluePerIteration(t *testing.T) {
+	text := `
+	t = {}
+	i = 1
+	while i <= 3 do
+		local j = i
+		function f()
+			return j
+		end
+		t[i] = f
+		i = i + 1
+	end
+
+	assert t[1]() == 1
+	assert t[2]() == 2
+	assert t[3]() == 3
+	`
+
+	expectNoErrors(t, text)
+}
+
+func TestTailCall(t *testing.T) {
+	vm := interpreter.NewVmWithOptions(options.Options{MaxCallDepth: 100, MaxStackSize: 100})
+	_, err := interpreter.FromString(vm, `
+	function count(n, total)
+		if n == 0 then
+			return total
+		end
+		return count(n - 1, total + 1)
+	end
+
+	function even(n)
+		if n == 0 then
+			return true
+		end
+		return odd(n - 1)
+	end
+
+	function odd(n)
+		if n == 0 then
+			return false
+		end
+		return even(n - 1)
+	end
+
+	assert count(10000, 0) == 10000
+	assert even(1001) == false
+	`).Interpret()
+
+	if !err.IsEmpty() {
+		fmt.Println(err)
+		t.FailNow()
+	}
+}
+
+func TestTailCallTraceback(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, `
+	function inner()
+		return 1 + {}
+	end
+
+	function outer()
+		return inner()
+	end
+
+	outer()
+	`).Interpret()
+
+	if err.IsEmpty() {
+		t.Fatal("Expected runtime error")
+	}
+
+	re, ok := err.First().(interpreter.RuntimeError)
+	if !ok {
+		t.Fatal("Expected runtime error, got: ", err)
+	}
+
+	traceback := interpreter.FormatTraceback(re.Traceback())
+	expected := "stack traceback:\n\tstdin:3: in function 'inner'\n\t(...tail calls...)\n\tstdin:10: in main chunk"
+
+	if traceback != expected {
+		t.Error("Unexpected traceback: ", traceback)
+	}
+}
+
+func benchmarkFile(b *testing.B, fileName string) {
+	for i := 0; i < b.N; i++ {
+		file, err := os.Open(fileName)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		vm := interpreter.NewVm()
+		_, errs := interpreter.FromBufio(vm, fileName, bufio.NewReader(file)).Interpret()
+		file.Close()
+
+		if !errs.IsEmpty() {
+			b.Fatal(errs)
+		}
+	}
+}
+
+func BenchmarkTableOfClosures(b *testing.B) {
+	benchmarkFile(b, "assets/table-of-closures.glu")
+}
+
+func BenchmarkNestedClosures(b *testing.B) {
+	benchmarkFile(b, "assets/nested-closures.glu")
+}
+
+func TestLength(t *testing.T) {
+	text := `
+	assert #"hello" == 5
+	assert #{} == 0
+	assert #{1, 2, 3} == 3
+
+	local t = {}
+	local i = 1
+	while i <= 100 do
+		t[i] = i
+		i = i + 1
+	end
+	assert #t == 100
+
+	t[100] = nil
+	assert #t == 99
+
+	t[100] = 100
+	t[101] = 101
+	assert #t == 101
+	`
+
+	expectNoErrors(t, text)
+}
+
+func TestLengthSparse(t *testing.T) {
+	text := `
+	local t = {}
+	local i = 64
+	while i >= 1 do
+		t[i] = i * 2
+		i = i - 1
+	end
+	assert #t == 64
+	assert t[1] == 2
+	assert t[64] == 128
+	assert t[65] == nil
+
+	t[32] = nil
+	assert t[32] == nil
+	assert t[33] == 66
+
+	local u = {}
+	u[1] = 1
+	u[2] = 2
+	u[1000] = 3
+	u[1.0] = 4
+	u.x = 5
+	assert #u == 2
+	assert u[1] == 4
+	assert u[1000] == 3
+	assert u.x == 5
+	`
+
+	expectNoErrors(t, text)
+}
+
+func TestLengthMetamethod(t *testing.T) {
+	text := `
+	function size(t)
+		return 42
+	end
+	local t = setmetatable({}, {__len = size})
+	assert #t == 42
+	`
+
+	expectNoErrors(t, text)
+
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, "local x = #1").Interpret()
+	expectRuntimeError(t, err, "Attempt to get length of")
+}
+
+// An error in a function that a metamethod called is reported like any other,
+// and the VM can run the next script
+func TestMetamethodErrors(t *testing.T) {
+	boom := `
+	function boom() return 1 + {} end
+	function call(x) local r = boom() return r end
+	t = {}
+	`
+
+	for _, script := range []struct{ text, message string }{
+		{boom + "setmetatable(t, {__len = call})\nreturn #t", "Cannot add two non-numbers"},
+		{boom + "do local v <close> = setmetatable(t, {__close = call}) end\nreturn 1", "Cannot add two non-numbers"},
+		{"t = {}\nfunction size(x) return #t end\nsetmetatable(t, {__len = size})\nreturn #t", "Stack overflow, call depth"},
+	} {
+		for _, backend := range []string{options.BackendBytecode, options.BackendClosures} {
+			vm := interpreter.NewVmWithOptions(options.Options{Backend: backend, MaxCallDepth: 1000})
+			_, err := interpreter.FromString(vm, script.text).Interpret()
+			expectRuntimeError(t, err, script.message)
+
+			vm.ClearErrors()
+			val, err := interpreter.FromString(vm, "return 1 + 2").Interpret()
+
+			if !err.IsEmpty() || !value.Equal(val, value.Integer(3)) {
+				t.Error("Expected the VM to run after the error, got: ", val, err)
+			}
+		}
+	}
+}
+
+// Metamethods are called from Go, so without a call depth limit there is one
+// on how deeply they nest
+func TestNestedMetamethodLimit(t *testing.T) {
+	vm := interpreter.NewVm()
+	_, err := interpreter.FromString(vm, `
+	t = {}
+	function size(x) return #t end
+	setmetatable(t, {__len = size})
+	return #t
+	`).Interpret()
+
+	expectRuntimeError(t, err, "Stack overflow, nested metamethod limit")
+}
+
+// Each script is translated to Go, built and run, and has to print what
+// `glua <file>` prints and exit with the same code
+func TestGenerateGo(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the generated code")
+	}
+
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("needs the go command")
+	}
+
+	scripts := []struct{ name, text string }{
+		{"closures", `
+		function counter()
+			local n = 0
+			function inc()
+				n = n + 1
+				return n
+			end
+			return inc
+		end
+
+		local a, b = counter(), counter()
+		a()
+		b()
+		local t = {a(), b(), a(), x = 1}
+		return #t * 100 + t[1] * 10 + t[3]
+		`},
+		{"close", closeResource + `
+		function f()
+			local a <close> = resource("a")
+			do
+				local b <close> = resource("b")
+			end
+			return count
+		end
+
+		assert f() == 1
+		assert closed[2] == "a"
+		return count
+		`},
+		{"closetail", closeResource + `
+		function add(n)
+			return n + count
+		end
+
+		function f()
+			do
+				local a <close> = resource("a")
+			end
+			return add(10)
+		end
+
+		return f()
+		`},
+		{"break", closeResource + `
+		local i = 0
+		while true do
+			i = i + 1
+			local a <close> = resource(i)
+			if i == 2 then break end
+		end
+
+		local seen = 0
+		for k = 1, 2, 3 do
+			local b <close> = resource(k * 10)
+			seen = seen + k
+			if k == 2 then
+				break
+			end
+		end
+
+		assert closed[4] == 20
+		return seen * 100 + count
+		`},
+		{"error", `
+		function inner(x)
+			return x + {}
+		end
+
+		function outer(x)
+			local y = inner(x)
+			return y
+		end
+
+		outer(1)
+		`},
+		{"tailcalls", `
+		function count(n, total)
+			if n == 0 then
+				return total
+			end
+			return count(n - 1, total + 1)
+		end
+
+		return count(3000000, 0)
+		`},
+		{"assertion", `
+		function check(v)
+			assert v == 2, "v should be two"
+		end
+
+		return check(1)
+		`},
+	}
+
+	dir, err := os.MkdirTemp(".", "gen-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, script := range scripts {
+		vm := interpreter.NewVm()
+		val, errs := interpreter.FromBufio(vm, script.name, bufio.NewReader(strings.NewReader(script.text))).Interpret()
+
+		var expected bytes.Buffer
+		expectedCode := 0
+		if errs.IsEmpty() {
+			fmt.Fprintln(&expected, "Result: ", val)
+		} else {
+			printErrors(&expected, errs)
+			expectedCode = exitCode(errs.First())
+		}
+
+		scan := scanner.Scanner(script.name, bufio.NewReader(strings.NewReader(script.text)))
+		code, errs := compiler.GenerateGo(scan.Tokens(), scan.Source(), options.Options{}, "main")
+		if !errs.IsEmpty() {
+			t.Fatal(errs)
+		}
+
+		pkg := filepath.Join(dir, script.name)
+		binary := filepath.Join(pkg, script.name)
+		if err := os.Mkdir(pkg, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(pkg, "main.go"), code, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if output, err := exec.Command("go", "build", "-o", binary, "./"+pkg).CombinedOutput(); err != nil {
+			t.Fatalf("Generated code for %s does not build: %v\n%s", script.name, err, output)
+		}
+
+		output, err := exec.Command(binary).CombinedOutput()
+		exited := 0
+		if exit, ok := err.(*exec.ExitError); ok {
+			exited = exit.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(output) != expected.String() || exited != expectedCode {
+			t.Errorf("Generated %s printed\n%s(exit %d), expected\n%s(exit %d)", script.name, output, exited, expected.String(), expectedCode)
+		}
+	}
+}
+
+// The VM has no bytecode for functions made by generated code
+func TestCallGeneratedFunction(t *testing.T) {
+	generated := &value.Closure{
+		Chunk: value.Chunk{
+			Compiled: interpreter.NativeFunction(func(n *interpreter.Native, closure *value.Closure, args []value.Value) []value.Value {
+				return nil
+			}),
+		},
+		Name: "generated",
+	}
+
+	for _, backend := range []string{options.BackendBytecode, options.BackendClosures} {
+		for _, text := range []string{"generated()", "return generated()"} {
+			vm := interpreter.NewVmWithOptions(options.Options{Backend: backend})
+			vm.Globals().Set(value.StringVal("generated"), value.ClosureValue(generated))
+
+			_, err := interpreter.FromString(vm, text).Interpret()
+			expectRuntimeError(t, err, "Cannot call generated function from interpreted code")
+		}
+	}
+}
+
+// Generated calls nest on the Go stack like compiled ones, a higher limit is
+// lowered to what it can hold
+func TestGeneratedCallDepth(t *testing.T) {
+	var deep interpreter.NativeFunction
+	deep = func(n *interpreter.Native, closure *value.Closure, args []value.Value) []value.Value {
+		return n.Call(value.ClosureValue(closure))
+	}
+
+	script := func(n *interpreter.Native, closure *value.Closure, args []value.Value) []value.Value {
+		return n.Call(n.Closure(closure, "deep", 0, deep))
+	}
+
+	vm := interpreter.NewVmWithOptions(options.Options{MaxCallDepth: 50000000})
+	_, err := interpreter.RunNative(context.Background(), vm, vm.Globals(), script, glerror.SourceText("deep", ""), nil)
+
+	expectRuntimeError(t, err, "Stack overflow, call depth limit is 200000")
+}
+
+func BenchmarkFibonacci(b *testing.B) {
+	benchmarkFile(b, "assets/fibonacci.glu")
+}
+
+func BenchmarkArithmetic(b *testing.B) {
+	text := `
+	local x = 0.5
+	local i = 0
+	while i < 1000000 do
+		x = x * 1.0000001 + 0.25
+		i = i + 1
+	end
+	`
+
+	for i := 0; i < b.N; i++ {
+		vm := interpreter.NewVm()
+		_, err := interpreter.FromString(vm, text).Interpret()
+
+		if !err.IsEmpty() {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTableChurn(b *testing.B) {
+	text := `
+	local t = {}
+	local i = 0
+	while i < 65537 do
+		t[i + 0.5] = i
+		i = i + 1
+	end
+
+	local j = 0
+	while j < 20000 do
+		t[j + 0.5] = nil
+		t[i + j + 0.5] = j
+		j = j + 1
+	end
+	`
+
+	for i := 0; i < b.N; i++ {
+		vm := interpreter.NewVm()
+		_, err := interpreter.FromString(vm, text).Interpret()
+
+		if !err.IsEmpty() {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFieldAccess(b *testing.B) {
+	text := `
+	local list = nil
+	local i = 0
+	while i < 1000 do
+		list = {head = i, tail = list}
+		i = i + 1
+	end
+
+	local sum = 0
+	i = 0
+	while i < 1000 do
+		local node = list
+		while node do
+			sum = sum + node.head
+			node = node.tail
+		end
+		i = i + 1
+	end
+	assert sum == 499500000
+	`
+
+	for i := 0; i < b.N; i++ {
+		vm := interpreter.NewVm()
+		_, err := interpreter.FromString(vm, text).Interpret()
+
+		if !err.IsEmpty() {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,16 +1,6 @@
 package constants
 
 const (
-	// DebugAst       bool = false
-	// PrintBytecode  bool = false
-	// PrintTokens    bool = false
-	// TraceExecution bool = false
-
-	DebugAst       bool = true
-	PrintBytecode  bool = true
-	PrintTokens    bool = true
-	TraceExecution bool = true
-
 	RunFileMode = iota
 	ReplMode
 )
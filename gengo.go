@@ -0,0 +1,66 @@
+package main
+
+import (
+	"arlindohall/glua/compiler"
+	"arlindohall/glua/options"
+	"arlindohall/glua/scanner"
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// `glua gen-go [flags] file` writes the script as a Go package, see the README
+func genGo(args []string) {
+	flags := flag.NewFlagSet("gen-go", flag.ExitOnError)
+	pkg := flags.String("package", "main", "name of the generated package, main also gets a main function")
+	output := flags.String("o", "", "file to write the package to (default stdout)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: glua gen-go [flags] file")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	fileName := flags.Arg(0)
+	file, err := os.Open(fileName)
+
+	if err != nil {
+		fmt.Println("Error opening file", fileName, err)
+		return
+	}
+	defer file.Close()
+
+	scan := scanner.ScannerAt(fileName, bufio.NewReader(file), file)
+	code, compileErrs := compiler.GenerateGo(scan.Tokens(), scan.Source(), options.Options{}, *pkg)
+
+	if scanErrs := scan.Errors(); !scanErrs.IsEmpty() {
+		printErrors(os.Stderr, scanErrs)
+		os.Exit(exitCode(scanErrs.First()))
+	}
+
+	if !compileErrs.IsEmpty() {
+		printErrors(os.Stderr, compileErrs)
+		os.Exit(exitCode(compileErrs.First()))
+	}
+
+	if *output == "" {
+		os.Stdout.Write(code)
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(*output), 0755)
+	if err == nil {
+		err = os.WriteFile(*output, code, 0644)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing file", *output, err)
+		os.Exit(4)
+	}
+}
@@ -20,6 +20,10 @@ func (chain *GluaErrorChain) IsEmpty() bool {
 	return len(chain.errors) == 0
 }
 
+func (chain *GluaErrorChain) Len() int {
+	return len(chain.errors)
+}
+
 func (chain *GluaErrorChain) Append(err error) {
 	chain.errors = append(chain.errors, GluaError(err))
 }
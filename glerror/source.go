@@ -0,0 +1,208 @@
+package glerror
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Span locates a token or AST node in the source, lines and columns start
+// at 1 and the length is counted in runes
+type Span struct {
+	Line   int
+	Column int
+	Offset int
+	Length int
+}
+
+// Source is the text of a chunk, the scanner adds each line as it reads it
+// so errors can point back at the offending line. Only the last lines read
+// are held, along with where each line starts, and older lines are read
+// back from the text when it can be read again
+type Source struct {
+	Name    string
+	text    io.ReaderAt
+	offsets []int
+	recent  []string
+	first   int
+}
+
+// Between this many and twice as many lines are held
+const sourceWindow = 64
+
+// The text is where lines that are no longer held are read back from, it
+// can be nil when the text can't be read again
+func NewSource(name string, text io.ReaderAt) *Source {
+	return &Source{Name: name, text: text}
+}
+
+// SourceText is the source of a text that is known in full, like the one
+// generated code is built with
+func SourceText(name string, text string) *Source {
+	source := NewSource(name, strings.NewReader(text))
+
+	offset := 0
+	for _, line := range strings.Split(text, "\n") {
+		source.AddLine(line, offset)
+		offset += len(line) + 1
+	}
+
+	return source
+}
+
+// AddLine records the next line, which starts at the byte offset in the
+// text and doesn't include its newline
+func (source *Source) AddLine(text string, offset int) {
+	source.offsets = append(source.offsets, offset)
+	source.recent = append(source.recent, text)
+
+	if len(source.recent) == 2*sourceWindow {
+		source.recent = append([]string(nil), source.recent[sourceWindow:]...)
+		source.first += sourceWindow
+	}
+}
+
+// LineCount is the number of lines added so far
+func (source *Source) LineCount() int {
+	return len(source.offsets)
+}
+
+// Line is the text of a line numbered from 1, false when it hasn't been read
+// or isn't held and can't be read again
+func (source *Source) Line(number int) (string, bool) {
+	if source == nil || number < 1 || number > len(source.offsets) {
+		return "", false
+	}
+
+	if i := number - 1 - source.first; i >= 0 {
+		return source.recent[i], true
+	}
+
+	if source.text == nil {
+		return "", false
+	}
+
+	// A line that isn't held has another after it, which starts past its
+	// newline
+	start, end := source.offsets[number-1], source.offsets[number]-1
+	buffer := make([]byte, end-start)
+
+	if _, err := source.text.ReadAt(buffer, int64(start)); err != nil {
+		return "", false
+	}
+
+	// The scanner reads invalid UTF-8 as replacement characters, and so does
+	// converting to runes
+	return string([]rune(string(buffer))), true
+}
+
+// Contents is the whole text, false when some of it can't be read again
+func (source *Source) Contents() (string, bool) {
+	lines := make([]string, source.LineCount())
+
+	for i := range lines {
+		line, ok := source.Line(i + 1)
+		if !ok {
+			return "", false
+		}
+
+		lines[i] = line
+	}
+
+	return strings.Join(lines, "\n"), true
+}
+
+func (source *Source) Location(span Span) string {
+	name := "?"
+	if source != nil {
+		name = source.Name
+	}
+
+	if span.Line < 1 {
+		return name
+	}
+
+	return fmt.Sprintf("%s:%d:%d", name, span.Line, span.Column)
+}
+
+// Snippet renders the line the span is on with a caret underline, or an
+// empty string when the line isn't known
+//
+//	3 | return 1 + {}
+//	  |          ^
+func (source *Source) Snippet(span Span) string {
+	text, ok := source.Line(span.Line)
+	if !ok {
+		return ""
+	}
+
+	number := fmt.Sprint(span.Line)
+	gutter := strings.Repeat(" ", len(number))
+
+	var underline strings.Builder
+	for i, r := range []rune(text) {
+		if i >= span.Column-1 {
+			break
+		}
+
+		// keep tabs so the caret lines up with the source
+		if r == '\t' {
+			underline.WriteRune('\t')
+		} else {
+			underline.WriteRune(' ')
+		}
+	}
+
+	length := span.Length
+	if length < 1 {
+		length = 1
+	}
+	underline.WriteString(strings.Repeat("^", length))
+
+	return fmt.Sprintf("%s | %s\n%s | %s", number, text, gutter, underline.String())
+}
+
+// Format is shared by the scan, compile and runtime errors
+func Format(kind string, message string, source *Source, span Span) string {
+	header := fmt.Sprintf("%s [%s] ---> %s", kind, source.Location(span), message)
+	snippet := source.Snippet(span)
+
+	if snippet == "" {
+		return header
+	}
+
+	return header + "\n" + snippet
+}
+
+// Text returns the source from the start of one span to the end of another,
+// lines in between are joined with a space
+func (source *Source) Text(from Span, to Span) string {
+	if to.Line < from.Line {
+		return ""
+	}
+
+	var parts []string
+	for line := from.Line; line <= to.Line; line++ {
+		content, ok := source.Line(line)
+		if !ok {
+			return ""
+		}
+
+		text := []rune(content)
+		start, end := 0, len(text)
+
+		if line == to.Line && to.Column-1+to.Length < end {
+			end = to.Column - 1 + to.Length
+		}
+
+		if line == from.Line {
+			start = from.Column - 1
+		}
+
+		if start < end {
+			parts = append(parts, strings.TrimSpace(string(text[start:end])))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
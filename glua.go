@@ -2,25 +2,70 @@ package main
 
 import (
 	"arlindohall/glua/compiler"
+	"arlindohall/glua/glerror"
 	"arlindohall/glua/interpreter"
+	"arlindohall/glua/options"
 	"arlindohall/glua/scanner"
 	"bufio"
+	"context"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 )
 
 func main() {
-	if len(os.Args) <= 1 {
-		repl()
+	if len(os.Args) > 1 && os.Args[1] == "gen-go" {
+		genGo(os.Args[2:])
 		return
 	}
 
-	fileName := os.Args[1]
+	var opts options.Options
+
+	flag.BoolVar(&opts.DumpTokens, "dump-tokens", false, "print the tokens of each chunk")
+	flag.BoolVar(&opts.DumpAst, "dump-ast", false, "print the syntax tree of each declaration")
+	flag.BoolVar(&opts.DumpBytecode, "dump-bytecode", false, "print the bytecode of each function")
+	flag.BoolVar(&opts.Trace, "trace", false, "print each instruction as it is executed")
+	flag.IntVar(&opts.Optimize, "O", 0, "optimization level: 1 folds constants and drops unreachable code, 2 also optimizes jumps")
+	flag.StringVar(&opts.Backend, "backend", options.BackendBytecode, "how to run compiled code: bytecode or closures")
+	flag.IntVar(&opts.MaxInstructions, "max-instructions", 0, "stop after executing this many instructions (0 for no limit)")
+	flag.IntVar(&opts.MaxCallDepth, "max-call-depth", 0, "limit the depth of nested calls (0 for no limit)")
+	flag.IntVar(&opts.MaxStackSize, "max-stack", 0, "limit the size of the value stack (0 for no limit)")
+	flag.IntVar(&opts.MaxMemory, "max-memory", 0, "limit the bytes the script may hold on to (0 for no limit)")
+	timeout := flag.Duration("timeout", 0, "stop running a file after this long (0 for no limit)")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: glua [flags] [file]")
+		fmt.Fprintln(flag.CommandLine.Output(), "       glua gen-go [flags] file")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if opts.Backend != options.BackendBytecode && opts.Backend != options.BackendClosures {
+		fmt.Fprintln(flag.CommandLine.Output(), "Unknown backend:", opts.Backend)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	vm := interpreter.NewVmWithOptions(opts)
+
+	if flag.NArg() == 0 {
+		repl(vm)
+		return
+	}
+
+	fileName := flag.Arg(0)
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
 
-	runFile(fileName)
+	runFile(ctx, vm, fileName)
 }
 
-func repl() {
+func repl(vm *interpreter.VM) {
 	reader := bufio.NewReader(os.Stdin)
 
 	fmt.Println("Running REPL...")
@@ -28,12 +73,11 @@ func repl() {
 
 	// todo: add history
 	// todo: read a whole declaration at a time, not a line
-	vm := interpreter.NewVm()
 	for line, _, err := reader.ReadLine(); err == nil; line, _, err = reader.ReadLine() {
-		val, err := interpreter.FromString(&vm, string(line)).Interpret()
+		val, err := interpreter.FromString(vm, string(line)).Interpret()
 
 		if !err.IsEmpty() {
-			fmt.Println(err)
+			printErrors(os.Stdout, err)
 			vm.ClearErrors()
 		} else {
 			fmt.Println(val)
@@ -43,7 +87,7 @@ func repl() {
 	}
 }
 
-func runFile(fileName string) {
+func runFile(ctx context.Context, vm *interpreter.VM, fileName string) {
 
 	file, err := os.Open(fileName)
 
@@ -51,24 +95,41 @@ func runFile(fileName string) {
 		fmt.Println("Error opening file", fileName, err)
 		return
 	}
+	defer file.Close()
 
-	reader := bufio.NewReader(file)
-
-	val, intErrs := interpreter.FromBufio(reader).Interpret()
+	val, intErrs := interpreter.FromFile(vm, fileName, file).InterpretContext(ctx)
 
 	if !intErrs.IsEmpty() {
-		fmt.Fprintln(os.Stderr, err)
-		switch intErrs.First().(type) {
-		case scanner.ScanError:
-			os.Exit(1)
-		case compiler.CompileError:
-			os.Exit(2)
-		case interpreter.RuntimeError:
-			os.Exit(3)
-		default:
-			os.Exit(4)
-		}
+		printErrors(os.Stderr, intErrs)
+		os.Exit(exitCode(intErrs.First()))
 	}
 
 	fmt.Println("Result: ", val)
 }
+
+// Exit codes are listed in the README, a failed assert keeps the code it had
+// when asserts exited the process directly
+func exitCode(err error) int {
+	switch err := err.(type) {
+	case scanner.ScanError:
+		return 1
+	case compiler.CompileError:
+		return 2
+	case interpreter.RuntimeError:
+		if err.Assertion() {
+			return 5
+		}
+		return 3
+	default:
+		return 4
+	}
+}
+
+// Runtime errors are followed by a Lua-style stack traceback
+func printErrors(out io.Writer, errs glerror.GluaErrorChain) {
+	fmt.Fprintln(out, errs)
+
+	if re, ok := errs.First().(interpreter.RuntimeError); ok {
+		fmt.Fprintln(out, interpreter.FormatTraceback(re.Traceback()))
+	}
+}
@@ -0,0 +1,253 @@
+package interpreter
+
+import (
+	"arlindohall/glua/compiler"
+	"arlindohall/glua/value"
+	"fmt"
+)
+
+// The closures backend runs functions that the compiler built out of Go
+// closures from their syntax tree, see compiler.Function.Closures. They get
+// frames on the VM's stack of frames and registers on its stack like bytecode
+// functions, so the two can call each other, and do everything but the
+// simplest operations through compiledRuntime. A call made by compiled code
+// is a Go call that runs the callee before returning, errors are recorded on
+// the VM and then unwind the Go stack with a panic, which runCompiled
+// recovers from
+func (vm *VM) compiling() bool {
+	return vm.options.Closures()
+}
+
+func compiledFunction(closure *value.Closure) (compiler.CompiledFunction, bool) {
+	function, ok := closure.Chunk.Compiled.(compiler.CompiledFunction)
+	return function, ok
+}
+
+// Whether the current frame runs a compiled function
+func (vm *VM) compiled() bool {
+	_, ok := compiledFunction(vm.frame.closure)
+	return ok
+}
+
+func (vm *VM) check(ok bool) {
+	if !ok {
+		panic(nativeError{})
+	}
+}
+
+// Like runBytecode, for when the current frame is compiled. It stops early
+// after an error
+func (vm *VM) runCompiled(base int) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, isError := r.(nativeError); !isError {
+				panic(r)
+			}
+		}
+	}()
+
+	vm.runFrames(base)
+}
+
+// Runs frames until the depth is back to `base`. A compiled function returns
+// once it has returned or tail called, the frame it leaves is then either its
+// caller's or the callee's
+func (vm *VM) runFrames(base int) {
+	for vm.depth > base {
+		function, ok := compiledFunction(vm.frame.closure)
+
+		if !ok {
+			errors := vm.err.Len()
+			vm.runBytecode(base)
+			vm.check(vm.err.Len() == errors)
+			continue
+		}
+
+		frame := vm.compiledFrame()
+		function(frame)
+		frame.Closure = nil
+	}
+}
+
+// The frames compiled code runs in are kept for each depth and reused, like
+// the VM's frames
+func (vm *VM) compiledFrame() *compiler.Frame {
+	for len(vm.compiledFrames) < vm.depth {
+		vm.compiledFrames = append(vm.compiledFrames, &compiler.Frame{
+			Runtime: compiledRuntime{vm},
+			Stack:   &vm.stack,
+		})
+	}
+
+	frame := vm.compiledFrames[vm.depth-1]
+	frame.Base = vm.frame.stack
+	frame.Closure = vm.frame.closure
+
+	return frame
+}
+
+// The VM as compiled code sees it. Positions are kept in the frame as if
+// they were the instruction pointer, so that errors and tracebacks find
+// their spans
+type compiledRuntime struct {
+	vm *VM
+}
+
+func (runtime compiledRuntime) at(position int) *VM {
+	vm := runtime.vm
+	vm.frame.ip = position + 1
+
+	return vm
+}
+
+// Calls to closures nest on the Go stack, so their depth is limited to
+// nativeCallDepth even when the VM's own limit is higher or there is none
+func (vm *VM) nativeDepthLimit() int {
+	if limit := vm.options.MaxCallDepth; limit > 0 && limit < nativeCallDepth {
+		return limit
+	}
+
+	return nativeCallDepth
+}
+
+func (runtime compiledRuntime) Call(position, register, arity, results int) {
+	vm := runtime.at(position)
+	slot := vm.frame.stack + register
+	base := vm.depth
+
+	if limit := vm.nativeDepthLimit(); vm.depth > limit && vm.stack[slot].IsClosure() {
+		vm.error(fmt.Sprint("Stack overflow, call depth limit is ", limit))
+		panic(nativeError{})
+	}
+
+	vm.check(vm.call(slot, arity, results))
+
+	if vm.depth > base {
+		vm.runFrames(base)
+	}
+}
+
+func (runtime compiledRuntime) TailCall(position, register, arity int) {
+	vm := runtime.at(position)
+	vm.check(vm.tailCall(vm.frame.stack+register, arity))
+}
+
+func (runtime compiledRuntime) Return(position, register, count int) {
+	vm := runtime.at(position)
+	vm.check(vm.returnFrom(vm.frame.stack+register, count))
+}
+
+// Checked at the end of each pass of a loop, like a backward jump
+func (runtime compiledRuntime) Loop(position int) {
+	vm := runtime.at(position)
+	vm.check(!vm.interrupted())
+}
+
+func (runtime compiledRuntime) AssertionFailed(position int, message value.Value) {
+	vm := runtime.at(position)
+	vm.assertionError(message.RawString())
+	panic(nativeError{})
+}
+
+func (runtime compiledRuntime) Arithmetic(position int, name string, a, b value.Value, intOp func(int64, int64) int64, floatOp func(float64, float64) float64) value.Value {
+	vm := runtime.at(position)
+	result, ok := vm.arithmetic(name, a, b, intOp, floatOp)
+	vm.check(ok)
+
+	return result
+}
+
+func (runtime compiledRuntime) Compare(position int, a, b value.Value, compare func(value.Value, value.Value) bool) bool {
+	vm := runtime.at(position)
+	result, ok := vm.compare(a, b, compare)
+	vm.check(ok)
+
+	return result.AsBoolean()
+}
+
+func (runtime compiledRuntime) Bitwise(position int, a, b value.Value, op func(int64, int64) int64) value.Value {
+	vm := runtime.at(position)
+	result, ok := vm.bitwise(a, b, op)
+	vm.check(ok)
+
+	return result
+}
+
+func (runtime compiledRuntime) BitNot(position int, val value.Value) value.Value {
+	vm := runtime.at(position)
+	integer, ok := vm.toInteger(val)
+	vm.check(ok)
+
+	return value.Integer(^integer)
+}
+
+func (runtime compiledRuntime) Length(position, register int, val value.Value) {
+	vm := runtime.at(position)
+	vm.check(vm.length(register, val))
+}
+
+func (runtime compiledRuntime) NewTable(position int) value.Value {
+	vm := runtime.at(position)
+	vm.check(vm.allocate(tableSize))
+
+	return value.TableValue(value.NewTable())
+}
+
+func (runtime compiledRuntime) Insert(position int, table, val value.Value) {
+	vm := runtime.at(position)
+	table.AsTable().Insert(val)
+	vm.check(vm.allocate(entrySize))
+}
+
+func (runtime compiledRuntime) GetTable(position int, table, key value.Value) value.Value {
+	vm := runtime.at(position)
+	if !table.IsTable() {
+		vm.error("Cannot assign to non-table")
+		panic(nativeError{})
+	}
+
+	return table.AsTable().Get(key)
+}
+
+func (runtime compiledRuntime) SetTable(position int, table, key, val value.Value) {
+	vm := runtime.at(position)
+	if !table.IsTable() {
+		vm.error("Cannot assign to non-table")
+		panic(nativeError{})
+	}
+
+	vm.check(vm.setTable(table.AsTable(), key, val))
+}
+
+// Like OpClosure, the prototype is copied with the running function's
+// globals
+func (runtime compiledRuntime) Closure(position int, prototype *value.Closure) *value.Closure {
+	vm := runtime.at(position)
+	vm.check(vm.allocate(closureSize))
+
+	return &value.Closure{
+		Chunk:    prototype.Chunk,
+		Name:     prototype.Name,
+		Upvalues: nil,
+		Env:      vm.frame.closure.Env,
+	}
+}
+
+func (runtime compiledRuntime) Capture(position int, closure *value.Closure, index int, isLocal bool) {
+	vm := runtime.at(position)
+	vm.check(vm.createUpvalue(index, isLocal, closure))
+}
+
+func (runtime compiledRuntime) MarkClose(position, register int, name value.Value) {
+	vm := runtime.at(position)
+	vm.check(vm.markClose(register, name))
+}
+
+func (runtime compiledRuntime) Close(position, register int) {
+	vm := runtime.at(position)
+	slot := vm.frame.stack + register
+
+	ok := vm.closeVariables(slot, value.Nil())
+	vm.closeUpvalues(slot)
+	vm.check(ok)
+}
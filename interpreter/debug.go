@@ -3,61 +3,10 @@ package interpreter
 import (
 	"arlindohall/glua/compiler"
 	"fmt"
-	"os"
 )
 
-func DebugTrace(vm *VM) {
-	var trace func(int, *VM)
-	switch vm.previous() {
-	case compiler.OpConstant, compiler.OpSetGlobal, compiler.OpGetGlobal, compiler.OpSetLocal, compiler.OpGetLocal,
-		compiler.OpCloseUpvalues, compiler.OpGetUpvalue, compiler.OpSetUpvalue, compiler.OpReturn:
-		trace = traceConstant
-	case compiler.OpAdd, compiler.OpSubtract, compiler.OpNot, compiler.OpNegate, compiler.OpMult, compiler.OpDivide, compiler.OpNil,
-		compiler.OpPop, compiler.OpAssert, compiler.OpLess, compiler.OpGreater, compiler.OpEquals, compiler.OpAnd, compiler.OpOr,
-		compiler.OpCreateTable, compiler.OpSetTable, compiler.OpInsertTable, compiler.OpInitTable, compiler.OpGetTable, compiler.OpZero,
-		compiler.OpClosure, compiler.OpAssignStart, compiler.OpAssignCleanup, compiler.OpLocalAllocate, compiler.OpLocalCleanup:
-		trace = traceInstruction
-	case compiler.OpCall:
-		trace = traceCall
-	case compiler.OpCreateUpvalue:
-		trace = traceUpvalue
-	case compiler.OpJumpIfFalse:
-		trace = traceJump
-	case compiler.OpLoop:
-		trace = traceLoop
-	default:
-		panic(fmt.Sprint("Do not know how to trace: ", compiler.ByteName(vm.previous())))
-	}
-
-	trace(vm.frame.ip, vm)
-}
-
-func traceInstruction(i int, vm *VM) {
-	fmt.Fprintf(os.Stderr, "%04d | %-16v                           %v\n", i, compiler.ByteName(vm.previous()), vm.stack[:vm.stackSize])
-}
-
-func traceConstant(i int, vm *VM) {
-	fmt.Fprintf(os.Stderr, "%04d | %-16v %-4d                      %v\n", i, compiler.ByteName(vm.previous()), vm.current(), vm.stack[:vm.stackSize])
-}
-
-func traceCall(i int, vm *VM) {
-	fmt.Fprintf(os.Stderr, "%04d | %-16v %-4d%-5v                 %v\n", i, compiler.ByteName(vm.previous()), vm.current(), vm.next() == 1, vm.stack[:vm.stackSize])
-}
-
-func traceUpvalue(i int, vm *VM) {
-	fmt.Fprintf(os.Stderr, "%04d | %-16v %-4d%-4v                  %v\n", i, compiler.ByteName(vm.previous()), vm.current(), vm.next() == 1, vm.stack[:vm.stackSize])
-}
-
-func traceJump(i int, vm *VM) {
-	jump := compiler.MergeBytes(byte(vm.current()), byte(vm.next()))
-	start := i + 3
-	to := start + jump
-	fmt.Fprintf(os.Stderr, "%04d | %-16v %-6d (%-6d -> %-6d) %v\n", i, compiler.ByteName(vm.previous()), jump, start, to, vm.stack[:vm.stackSize])
-}
-
-func traceLoop(i int, vm *VM) {
-	jump := compiler.MergeBytes(byte(vm.current()), byte(vm.next()))
-	start := i + 3
-	to := start - jump
-	fmt.Fprintf(os.Stderr, "%04d | %-16v %-6d (%-6d -> %-6d) %v\n", i, compiler.ByteName(vm.previous()), jump, start, to, vm.stack[:vm.stackSize])
+// Prints the instruction about to run followed by the frame's registers
+func DebugTrace(vm *VM, instruction uint32) {
+	registers := vm.stack[vm.frame.stack:vm.stackSize]
+	fmt.Fprintf(vm.options.Writer(), "%-48s %v\n", compiler.FormatInstruction(vm.frame.ip-1, instruction), registers)
 }
@@ -0,0 +1,51 @@
+package interpreter
+
+import (
+	"arlindohall/glua/value"
+)
+
+// A profile is the set of builtins put in a new environment
+type Profile int
+
+const (
+	// Every builtin, this is what the VM's own globals start with
+	ProfileFull Profile = iota
+	// Only builtins that can't look outside the script or at the VM running
+	// it, for loading code that isn't trusted
+	ProfileSafe
+	// Nothing but _G, the host adds whatever the script is allowed to use
+	ProfileEmpty
+)
+
+// The environment is an ordinary table, _G refers back to it so scripts can
+// reach globals by name
+func (vm *VM) NewEnvironment(profile Profile) *value.Table {
+	env := value.NewTable()
+	env.Set(value.StringVal("_G"), value.TableValue(env))
+
+	if profile == ProfileEmpty {
+		return env
+	}
+
+	env.Set(value.StringVal("time"), value.NewBuiltin("time", value.Time))
+	env.Set(value.StringVal("math"), value.TableValue(value.MathLibrary()))
+	env.Set(value.StringVal("setmetatable"), value.NewBuiltin("setmetatable", value.SetMetatable))
+	env.Set(value.StringVal("getmetatable"), value.NewBuiltin("getmetatable", value.GetMetatable))
+
+	if profile == ProfileSafe {
+		return env
+	}
+
+	env.Set(value.StringVal("collectgarbage"), value.NewBuiltin("collectgarbage", vm.collectGarbage))
+
+	debug := value.NewTable()
+	debug.Set(value.StringVal("traceback"), value.NewBuiltin("traceback", vm.tracebackBuiltin))
+	env.Set(value.StringVal("debug"), value.TableValue(debug))
+
+	return env
+}
+
+// The globals are shared by everything the VM runs without its own environment
+func (vm *VM) Globals() *value.Table {
+	return vm.globals
+}
@@ -7,6 +7,9 @@ import (
 	"arlindohall/glua/scanner"
 	"arlindohall/glua/value"
 	"bufio"
+	"context"
+	"io"
+	"os"
 	"strings"
 )
 
@@ -14,71 +17,115 @@ import (
 // todo: Glua should include a VM
 type Glua interface {
 	Interpret() (value.Value, glerror.GluaErrorChain)
+	InterpretContext(ctx context.Context) (value.Value, glerror.GluaErrorChain)
 }
 
 // todo: it's weird to pass in the vm
 // instead have the interpreter be persistent and pass in only the string
+// A nil env runs the script against the VM's globals, and a nil source means
+// errors can only show the lines the scanner still holds
 type BufioInterpreter struct {
-	text *bufio.Reader
-	mode compiler.ReturnMode
-	vm   *VM
+	text   *bufio.Reader
+	name   string
+	mode   compiler.ReturnMode
+	vm     *VM
+	env    *value.Table
+	source io.ReaderAt
 }
 
 type StringInterpreter struct {
 	text string
 	mode compiler.ReturnMode
 	vm   *VM
+	env  *value.Table
 }
 
+// Strings are run as if typed into the REPL, so their chunk is named "stdin"
 func FromString(vm *VM, text string) Glua {
-	return StringInterpreter{text, constants.ReplMode, vm}
+	return StringInterpreter{text, constants.ReplMode, vm, nil}
+}
+
+// The script's globals live in env instead of the VM's, see VM.NewEnvironment
+func FromStringWithEnv(vm *VM, text string, env *value.Table) Glua {
+	return StringInterpreter{text, constants.ReplMode, vm, env}
+}
+
+// The name identifies the chunk in error messages and tracebacks
+func FromBufio(vm *VM, name string, reader *bufio.Reader) Glua {
+	interpreter := BufioInterpreter{reader, name, constants.RunFileMode, vm, nil, nil}
+	return &interpreter
+}
+
+func FromBufioWithEnv(vm *VM, name string, reader *bufio.Reader, env *value.Table) Glua {
+	interpreter := BufioInterpreter{reader, name, constants.RunFileMode, vm, env, nil}
+	return &interpreter
 }
 
-func FromBufio(reader *bufio.Reader) Glua {
-	vm := NewVm()
-	interpreter := BufioInterpreter{reader, constants.RunFileMode, &vm}
+// Like FromBufio, errors read the lines they show back from the file
+func FromFile(vm *VM, name string, file *os.File) Glua {
+	interpreter := BufioInterpreter{bufio.NewReader(file), name, constants.RunFileMode, vm, nil, file}
 	return &interpreter
 }
 
 func (interp StringInterpreter) Interpret() (value.Value, glerror.GluaErrorChain) {
+	return interp.InterpretContext(context.Background())
+}
+
+func (interp StringInterpreter) InterpretContext(ctx context.Context) (value.Value, glerror.GluaErrorChain) {
 	reader := bufio.NewReader(strings.NewReader(string(interp.text)))
-	return interp.ToBufioInterpreter(reader).Interpret()
+	return interp.ToBufioInterpreter(reader).InterpretContext(ctx)
 }
 
 func (in StringInterpreter) ToBufioInterpreter(reader *bufio.Reader) Glua {
 	interp := BufioInterpreter{
 		reader,
+		"stdin",
 		in.mode,
 		in.vm,
+		in.env,
+		strings.NewReader(in.text),
 	}
 	return &interp
 }
 
 func (interp *BufioInterpreter) Interpret() (value.Value, glerror.GluaErrorChain) {
+	return interp.InterpretContext(context.Background())
+}
+
+// Cancelling the context stops the script with a runtime error
+func (interp *BufioInterpreter) InterpretContext(ctx context.Context) (value.Value, glerror.GluaErrorChain) {
 	reader := bufio.Reader(*interp.text)
 
-	scan := scanner.Scanner(&reader)
-	tokens, err := scan.ScanTokens()
+	scan := scanner.ScannerAt(interp.name, &reader, interp.source)
+	tokens := scan.Tokens()
 
-	if !err.IsEmpty() {
-		return nil, err
+	options := interp.vm.options
+	if options.DumpTokens {
+		tokens.Dump(options.Writer())
 	}
 
-	if constants.PrintTokens {
-		scanner.DebugTokens(tokens)
-	}
+	function, err := compiler.Compile(tokens, interp.mode, scan.Source(), options)
 
-	function, err := compiler.Compile(tokens, interp.mode)
+	// The compiler stops at the first token the scanner couldn't make sense
+	// of, which is the error to report
+	if scanErr := scan.Errors(); !scanErr.IsEmpty() {
+		return value.Nil(), scanErr
+	}
 
 	if !err.IsEmpty() {
-		return nil, err
+		return value.Nil(), err
 	}
 
 	// todo: use a VM struct that is re-used on Repl
-	val, err := interp.vm.Interpret(function)
+	env := interp.env
+	if env == nil {
+		env = interp.vm.Globals()
+	}
+
+	val, err := interp.vm.InterpretWithEnv(ctx, function, env)
 
 	if !err.IsEmpty() {
-		return nil, err
+		return value.Nil(), err
 	}
 
 	return val, glerror.GluaErrorChain{}
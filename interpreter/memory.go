@@ -0,0 +1,146 @@
+package interpreter
+
+import (
+	"arlindohall/glua/value"
+	"fmt"
+)
+
+// Rough sizes in bytes of the values the VM allocates, taken from the Go
+// structs and map entries behind them rather than measured
+const (
+	tableSize   = 64
+	entrySize   = 48
+	closureSize = 64
+	upvalueSize = 48
+	stringSize  = 16
+)
+
+// The Go collector frees values without telling the VM, so the count grows
+// with every allocation until it is measured again. Going over the limit
+// measures it, like an emergency collection in Lua, and only then is it an
+// error if the memory still in use is over the limit. Measuring walks all of
+// it, so it waits until the count has doubled since it was last measured,
+// and a script can be over the limit until then
+func (vm *VM) allocate(bytes int) bool {
+	vm.allocated += bytes
+
+	limit := vm.options.MaxMemory
+	if limit == 0 || vm.allocated <= limit || vm.allocated < vm.nextCollect {
+		return true
+	}
+
+	vm.collect(bytes)
+
+	if vm.allocated > limit {
+		vm.error(fmt.Sprint("Not enough memory, limit is ", limit, " bytes"))
+		return false
+	}
+
+	return true
+}
+
+// Sets the count to the memory the running scripts can still reach, plus
+// what is being allocated. The variables of generated code are Go's and
+// can't be walked, so nothing is given back while it runs
+func (vm *VM) collect(allocating int) {
+	if vm.native != nil {
+		return
+	}
+
+	vm.allocated = vm.liveMemory() + allocating
+	vm.nextCollect = 2 * vm.allocated
+}
+
+// Walks everything reachable from the stack, the functions being run and the
+// globals, and adds up the sizes allocate charges for them. Strings are
+// counted once per text since most of them are interned
+func (vm *VM) liveMemory() int {
+	seen := map[interface{}]bool{}
+	pending := append([]value.Value{value.TableValue(vm.globals)}, vm.stack[:vm.stackSize]...)
+	bytes := 0
+
+	for i := 0; i < vm.depth; i++ {
+		pending = append(pending, value.ClosureValue(vm.frames[i].closure))
+	}
+
+	for len(pending) > 0 {
+		val := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		switch {
+		case val.IsString():
+			if text := val.RawString(); !seen[text] {
+				seen[text] = true
+				bytes += stringSize + len(text)
+			}
+		case val.IsTable():
+			table := val.AsTable()
+			if seen[table] {
+				continue
+			}
+
+			seen[table] = true
+			bytes += tableSize + entrySize*table.Count()
+
+			if metatable := table.Metatable(); metatable != nil {
+				pending = append(pending, value.TableValue(metatable))
+			}
+
+			table.Each(func(k, v value.Value) {
+				pending = append(pending, k, v)
+			})
+		case val.IsClosure():
+			closure := val.AsClosure()
+			if seen[closure] {
+				continue
+			}
+
+			seen[closure] = true
+			bytes += closureSize
+
+			if closure.Env != nil {
+				pending = append(pending, value.TableValue(closure.Env))
+			}
+
+			// Open upvalues are slots on the stack
+			for _, upvalue := range closure.Upvalues {
+				if !seen[upvalue] {
+					seen[upvalue] = true
+					bytes += upvalueSize
+					pending = append(pending, upvalue.Value)
+				}
+			}
+		}
+	}
+
+	return bytes
+}
+
+// Tables are charged for new entries, removed entries are given back when the
+// memory in use is next measured
+func (vm *VM) setTable(table *value.Table, key value.Value, val value.Value) bool {
+	added := !val.IsNil() && table.Get(key).IsNil()
+
+	if !table.Set(key, val) {
+		vm.error(fmt.Sprintf("Cannot set key %s in table.", key))
+		return false
+	}
+
+	return !added || vm.allocate(entrySize)
+}
+
+func (vm *VM) MemoryUsage() int {
+	return vm.allocated
+}
+
+// collectgarbage("count") returns the memory in use in kilobytes. Any other
+// option measures it again, freeing memory is left to Go
+func (vm *VM) collectGarbage(args []value.Value) value.Value {
+	vm.collect(0)
+
+	if len(args) > 0 && args[0].IsString() && args[0].RawString() == "count" {
+		return value.Number(float64(vm.allocated) / 1024)
+	}
+
+	return value.Integer(0)
+}
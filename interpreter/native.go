@@ -0,0 +1,480 @@
+package interpreter
+
+import (
+	"arlindohall/glua/glerror"
+	"arlindohall/glua/value"
+	"context"
+	"fmt"
+)
+
+// A glua function translated to Go by `glua gen-go`. The closure is the one
+// being called, its Env holds the globals, and missing arguments are nil
+type NativeFunction func(native *Native, closure *value.Closure, args []value.Value) []value.Value
+
+// Native runs generated code on a VM. Each function called gets a frame on
+// the VM's stack of frames like an interpreted one, so errors, tracebacks
+// and the VM's limits work the same. The generated code says where it is
+// with At, an index into the spans of the script, which is kept in the frame
+// as if it were the instruction pointer. Errors are raised as on the VM and
+// then unwind the Go stack with a panic, which RunNative recovers from.
+// Arguments are passed on a stack and results in a buffer that are both
+// reused, so the results of a call have to be read before the next one
+//
+// Generated functions can only be called by generated code, the VM doesn't
+// know how to run them
+type Native struct {
+	vm      *VM
+	source  *glerror.Source
+	spans   []glerror.Span
+	toClose []value.Value
+	stack   []value.Value
+	results []value.Value
+
+	// A tail call waiting for Call to make it, with its arguments
+	tail     *value.Closure
+	tailArgs []value.Value
+}
+
+// Each call made by generated or compiled code is a Go call too, so there is
+// always a limit to keep clear of overflowing the goroutine's stack
+const nativeCallDepth = 200000
+
+// What generated and compiled code panic with after a runtime error has been
+// recorded
+type nativeError struct{}
+
+// Runs a script translated by gen-go with env as its globals, it returns
+// what interpreting the script with InterpretWithEnv would
+func RunNative(ctx context.Context, vm *VM, env *value.Table, script NativeFunction, source *glerror.Source, spans []glerror.Span) (value.Value, glerror.GluaErrorChain) {
+	native := &Native{
+		vm:     vm,
+		source: source,
+		spans:  spans,
+	}
+
+	vm.ctx = ctx
+	vm.done = ctx.Done()
+	vm.executed = 0
+	vm.native = native
+	defer func() { vm.native = nil }()
+
+	closure := native.closure(env, "", 0, script)
+	base := vm.depth
+
+	var val value.Value = value.Nil()
+	native.protect(func() {
+		val = Nth(native.Call(value.ClosureValue(closure)), 0)
+	})
+
+	if !vm.err.IsEmpty() {
+		native.unwind(base)
+		return value.Nil(), vm.err
+	}
+
+	return val, vm.err
+}
+
+// Nth is the value at i, or nil when there are fewer values, for arguments
+// and the results of calls
+func Nth(values []value.Value, i int) value.Value {
+	if i < len(values) {
+		return values[i]
+	}
+
+	return value.Nil()
+}
+
+// Runs f and reports whether it raised an error, dropping any frames the
+// error left behind
+func (native *Native) protect(f func()) (ok bool) {
+	depth := native.vm.depth
+	stack := len(native.stack)
+
+	defer func() {
+		if r := recover(); r != nil {
+			if _, isError := r.(nativeError); !isError {
+				panic(r)
+			}
+
+			for native.vm.depth > depth {
+				native.vm.popFrame()
+			}
+
+			native.stack = native.stack[:stack]
+			ok = false
+		}
+	}()
+
+	f()
+	return true
+}
+
+// The error is already recorded on the VM
+func (native *Native) fail() {
+	panic(nativeError{})
+}
+
+func (native *Native) check(ok bool) {
+	if !ok {
+		native.fail()
+	}
+}
+
+// Like VM.unwind, pending to-be-closed variables are closed with the error
+func (native *Native) unwind(base int) {
+	err := value.StringVal(native.vm.err.First().Error())
+
+	for len(native.toClose) > 0 {
+		last := len(native.toClose) - 1
+		val := native.toClose[last]
+		native.toClose = native.toClose[:last]
+
+		native.protect(func() {
+			native.Call(value.Metamethod(val, "__close"), val, err)
+		})
+	}
+
+	for native.vm.depth > base {
+		native.vm.popFrame()
+	}
+}
+
+// Errors after this are reported at the span, until it is moved again
+func (native *Native) At(span int) {
+	native.vm.frame.ip = span + 1
+}
+
+// Checked at the end of each pass of a loop, like a backward jump
+func (native *Native) Loop() {
+	native.check(!native.vm.interrupted())
+}
+
+func (native *Native) closure(env *value.Table, name string, arity int, function NativeFunction) *value.Closure {
+	return &value.Closure{
+		Chunk: value.Chunk{
+			Source:   native.source,
+			Spans:    native.spans,
+			Arity:    arity,
+			Compiled: function,
+		},
+		Name: name,
+		Env:  env,
+	}
+}
+
+// Closure makes a function declared inside the one that is running, which
+// shares its globals
+func (native *Native) Closure(enclosing *value.Closure, name string, arity int, function NativeFunction) value.Value {
+	native.check(native.vm.allocate(closureSize))
+	return value.ClosureValue(native.closure(enclosing.Env, name, arity, function))
+}
+
+// Calls a generated function or a builtin and returns all its results
+func (native *Native) Call(function value.Value, args ...value.Value) []value.Value {
+	vm := native.vm
+	native.check(!vm.interrupted())
+
+	switch {
+	case function.IsClosure():
+		closure, compiled := native.compiled(function)
+
+		// The script itself is at depth zero
+		if limit := vm.nativeDepthLimit(); vm.depth > limit {
+			vm.error(fmt.Sprint("Stack overflow, call depth limit is ", limit))
+			native.fail()
+		}
+
+		vm.pushFrame(CallFrame{closure: closure})
+		results := native.call(compiled, closure, args)
+
+		// Tail calls come back here to be made, so that a chain of them
+		// doesn't grow the Go stack
+		for native.tail != nil {
+			closure, native.tail = native.tail, nil
+
+			frame := vm.frame
+			frame.closure = closure
+			frame.ip = 0
+			frame.tailCall = true
+
+			results = native.call(closure.Chunk.Compiled.(NativeFunction), closure, native.tailArgs)
+		}
+
+		vm.popFrame()
+
+		return results
+	case function.IsBuiltin():
+		// Builtins may keep their arguments
+		arguments := make([]value.Value, len(args))
+		copy(arguments, args)
+
+		result := vm.strings.Intern(function.AsBuiltin().Function(arguments))
+
+		if result.IsString() {
+			native.check(vm.allocate(stringSize + len(result.RawString())))
+		}
+
+		return native.Return(result)
+	default:
+		vm.error(fmt.Sprintf("Attempt to call a non-function value %s", function))
+		native.fail()
+		return nil
+	}
+}
+
+// The called function takes over the frame of the one returning its
+// results, as in VM.tailCall, so the traceback looks the same. It is left
+// for the Call that made the frame to make once the function returns
+func (native *Native) TailCall(function value.Value, args ...value.Value) []value.Value {
+	if !function.IsClosure() {
+		return native.Call(function, args...)
+	}
+
+	native.check(!native.vm.interrupted())
+	closure, _ := native.compiled(function)
+
+	native.tail = closure
+	native.tailArgs = append(native.tailArgs[:0], args...)
+
+	return nil
+}
+
+// Generated functions take their parameters out of args before they call
+// anything, so the arguments only need to last until then
+func (native *Native) call(compiled NativeFunction, closure *value.Closure, args []value.Value) []value.Value {
+	base := len(native.stack)
+	native.stack = append(native.stack, args...)
+
+	results := compiled(native, closure, native.stack[base:])
+	native.stack = native.stack[:base]
+
+	return results
+}
+
+// Return is what a generated function returns its results with
+func (native *Native) Return(results ...value.Value) []value.Value {
+	native.results = append(native.results[:0], results...)
+	return native.results
+}
+
+func (native *Native) compiled(function value.Value) (*value.Closure, NativeFunction) {
+	closure := function.AsClosure()
+	compiled, ok := closure.Chunk.Compiled.(NativeFunction)
+
+	if !ok {
+		native.vm.error(fmt.Sprintf("Cannot call interpreted function %s from generated code", function))
+		native.fail()
+	}
+
+	return closure, compiled
+}
+
+func (native *Native) Assert(val, message value.Value) {
+	if !val.AsBoolean() {
+		native.vm.assertionError(message.RawString())
+		native.fail()
+	}
+}
+
+func (native *Native) Add(a, b value.Value) value.Value {
+	if a.IsInteger() && b.IsInteger() {
+		return value.Integer(a.AsInteger() + b.AsInteger())
+	}
+
+	return native.arithmetic(
+		"add", a, b,
+		func(a, b int64) int64 { return a + b },
+		func(a, b float64) float64 { return a + b },
+	)
+}
+
+func (native *Native) Subtract(a, b value.Value) value.Value {
+	if a.IsInteger() && b.IsInteger() {
+		return value.Integer(a.AsInteger() - b.AsInteger())
+	}
+
+	return native.arithmetic(
+		"subtract", a, b,
+		func(a, b int64) int64 { return a - b },
+		func(a, b float64) float64 { return a - b },
+	)
+}
+
+func (native *Native) Multiply(a, b value.Value) value.Value {
+	if a.IsInteger() && b.IsInteger() {
+		return value.Integer(a.AsInteger() * b.AsInteger())
+	}
+
+	return native.arithmetic(
+		"multiply", a, b,
+		func(a, b int64) int64 { return a * b },
+		func(a, b float64) float64 { return a * b },
+	)
+}
+
+// Division always produces a float, even for two integers
+func (native *Native) Divide(a, b value.Value) value.Value {
+	return native.arithmetic("divide", a, b, nil, func(a, b float64) float64 { return a / b })
+}
+
+func (native *Native) arithmetic(name string, a, b value.Value, intOp func(int64, int64) int64, floatOp func(float64, float64) float64) value.Value {
+	result, ok := native.vm.arithmetic(name, a, b, intOp, floatOp)
+	native.check(ok)
+
+	return result
+}
+
+func (native *Native) Negate(val value.Value) value.Value {
+	if val.IsInteger() {
+		return value.Integer(-val.AsInteger())
+	}
+
+	return value.Number(-val.AsNumber())
+}
+
+func (native *Native) Less(a, b value.Value) value.Value {
+	if a.IsInteger() && b.IsInteger() {
+		return value.Boolean(a.AsInteger() < b.AsInteger())
+	}
+
+	return native.compare(a, b, value.NumberLess)
+}
+
+func (native *Native) LessEqual(a, b value.Value) value.Value {
+	if a.IsInteger() && b.IsInteger() {
+		return value.Boolean(a.AsInteger() <= b.AsInteger())
+	}
+
+	return native.compare(a, b, value.NumberLessEqual)
+}
+
+func (native *Native) compare(a, b value.Value, compare func(value.Value, value.Value) bool) value.Value {
+	result, ok := native.vm.compare(a, b, compare)
+	native.check(ok)
+
+	return result
+}
+
+func (native *Native) BitAnd(a, b value.Value) value.Value {
+	return native.bitwise(a, b, func(a, b int64) int64 { return a & b })
+}
+
+func (native *Native) BitOr(a, b value.Value) value.Value {
+	return native.bitwise(a, b, func(a, b int64) int64 { return a | b })
+}
+
+func (native *Native) BitXor(a, b value.Value) value.Value {
+	return native.bitwise(a, b, func(a, b int64) int64 { return a ^ b })
+}
+
+func (native *Native) ShiftLeft(a, b value.Value) value.Value {
+	return native.bitwise(a, b, value.ShiftLeft)
+}
+
+func (native *Native) ShiftRight(a, b value.Value) value.Value {
+	return native.bitwise(a, b, value.ShiftRight)
+}
+
+func (native *Native) bitwise(a, b value.Value, op func(int64, int64) int64) value.Value {
+	result, ok := native.vm.bitwise(a, b, op)
+	native.check(ok)
+
+	return result
+}
+
+func (native *Native) BitNot(val value.Value) value.Value {
+	integer, ok := native.vm.toInteger(val)
+	native.check(ok)
+
+	return value.Integer(^integer)
+}
+
+// Strings are measured in bytes, tables use __len when they have it and
+// otherwise their border
+func (native *Native) Length(val value.Value) value.Value {
+	switch {
+	case val.IsString():
+		return value.Integer(int64(len(val.RawString())))
+	case val.IsTable():
+		if handler := value.Metamethod(val, "__len"); !handler.IsNil() {
+			return Nth(native.Call(handler, val), 0)
+		}
+
+		return value.Integer(int64(val.AsTable().Length()))
+	default:
+		native.vm.error(fmt.Sprintf("Attempt to get length of %s", val))
+		native.fail()
+		return value.Nil()
+	}
+}
+
+func (native *Native) SetGlobal(env *value.Table, global *value.Global, val value.Value) {
+	native.check(native.vm.setTable(env, global.Name, val))
+}
+
+func (native *Native) NewTable() value.Value {
+	native.check(native.vm.allocate(tableSize))
+	return value.TableValue(value.NewTable())
+}
+
+func (native *Native) Insert(table, val value.Value) {
+	table.AsTable().Insert(val)
+	native.check(native.vm.allocate(entrySize))
+}
+
+func (native *Native) SetTable(table, key, val value.Value) {
+	if !table.IsTable() {
+		native.vm.error("Cannot assign to non-table")
+		native.fail()
+	}
+
+	native.check(native.vm.setTable(table.AsTable(), key, val))
+}
+
+func (native *Native) GetTable(table, key value.Value) value.Value {
+	if !table.IsTable() {
+		native.vm.error("Cannot assign to non-table")
+		native.fail()
+	}
+
+	return table.AsTable().Get(key)
+}
+
+// A to-be-closed variable, false and nil are allowed and ignored
+func (native *Native) MarkClose(val value.Value, name string) {
+	if val.IsNil() || (val.IsBoolean() && !val.AsBoolean()) {
+		return
+	}
+
+	if value.Metamethod(val, "__close").IsNil() {
+		native.vm.error(fmt.Sprintf("Variable '%s' got a non-closable value", name))
+		native.fail()
+	}
+
+	native.toClose = append(native.toClose, val)
+}
+
+// The number of variables waiting to be closed, to pass to Close at the end
+// of the scope
+func (native *Native) Closing() int {
+	return len(native.toClose)
+}
+
+// Calls __close on the variables marked since Closing returned `mark`, in
+// reverse order. An error in one doesn't stop the others from being closed
+func (native *Native) Close(mark int) {
+	ok := true
+
+	for len(native.toClose) > mark {
+		last := len(native.toClose) - 1
+		val := native.toClose[last]
+		native.toClose = native.toClose[:last]
+
+		closed := native.protect(func() {
+			native.Call(value.Metamethod(val, "__close"), val, value.Nil())
+		})
+		ok = ok && closed
+	}
+
+	native.check(ok)
+}
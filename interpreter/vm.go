@@ -2,573 +2,1109 @@ package interpreter
 
 import (
 	"arlindohall/glua/compiler"
-	"arlindohall/glua/constants"
 	"arlindohall/glua/glerror"
+	"arlindohall/glua/options"
 	"arlindohall/glua/value"
+	"context"
 	"fmt"
-	"os"
+	"sort"
+	"strings"
 )
 
 type CallFrame struct {
-	ip           int
-	stack        int
-	closure      *value.Closure
-	context      *CallFrame
-	isAssignment bool
+	ip       int
+	stack    int
+	closure  *value.Closure
+	results  int
+	tailCall bool
 }
 
+// Frames are kept in a stack that is reused from call to call, so calling a
+// function allocates nothing. `frame` is the top one, the first `depth`
+// frames are in use
+const initialFrames = 64
+
+// Each frame's registers are a window onto the stack starting at its
+// function, stackSize is the top of the current frame's window
 type VM struct {
 	frame        *CallFrame
-	assignBase   []int
-	assignTarget []int
-	localTarget  []int
+	frames       []CallFrame
+	depth        int
 	stackSize    int
 	stack        []value.Value
 	openUpvalues []*value.Upvalue
-	globals      map[string]value.Value
+	toClose      []int
+	strings      value.Strings
+	globals      *value.Table
 	err          glerror.GluaErrorChain
+	options      options.Options
+	ctx          context.Context
+	done         <-chan struct{}
+	executed     int
+	allocated    int
+	nextCollect  int
+	nested       int
+	native       *Native
+
+	// The frames compiled functions run in, see compiledFrame
+	compiledFrames []*compiler.Frame
+}
+
+func NewVm() *VM {
+	return NewVmWithOptions(options.Options{})
 }
 
-func NewVm() VM {
-	vm := VM{
+// The options apply to everything the VM runs, including compiling the
+// scripts passed to the interpreter
+func NewVmWithOptions(options options.Options) *VM {
+	vm := &VM{
 		frame:     nil,
+		frames:    make([]CallFrame, 0, initialFrames),
 		stack:     nil,
 		stackSize: 0,
-		globals:   make(map[string]value.Value),
+		strings:   value.Strings{},
+		globals:   nil,
 		err:       glerror.GluaErrorChain{},
+		options:   options,
 	}
 
-	vm.addBuiltins()
+	vm.globals = vm.NewEnvironment(ProfileFull)
 
 	return vm
 }
 
-func (vm *VM) addBuiltins() {
-	vm.globals["time"] = value.NewBuiltin("time", value.Time)
+func (vm *VM) Interpret(function compiler.Function) (value.Value, glerror.GluaErrorChain) {
+	return vm.InterpretContext(context.Background(), function)
 }
 
-func (vm *VM) Interpret(function compiler.Function) (value.Value, glerror.GluaErrorChain) {
-	closure := value.NewClosure(function.Chunk, function.Name)
+// The script stops with a runtime error when the context is done, it is
+// checked at backward jumps and calls so any loop or recursion will see it
+func (vm *VM) InterpretContext(ctx context.Context, function compiler.Function) (value.Value, glerror.GluaErrorChain) {
+	return vm.InterpretWithEnv(ctx, function, vm.globals)
+}
+
+// Runs the function with its own globals, nothing it defines is visible to
+// other scripts and it can only use the builtins that are in the table
+func (vm *VM) InterpretWithEnv(ctx context.Context, function compiler.Function, env *value.Table) (value.Value, glerror.GluaErrorChain) {
+	chunk := function.Chunk
+	if vm.compiling() {
+		if compiled, ok := function.Closures(vm.strings); ok {
+			chunk = compiled
+		}
+	}
 
-	vm.push(closure)
-	vm.call(0, false)
+	closure := value.NewClosure(vm.load(chunk), function.Name)
+	closure.Env = env
+	slot := vm.stackSize
 
-	val := vm.run()
+	vm.ctx = ctx
+	vm.done = ctx.Done()
+	vm.executed = 0
+
+	vm.ensureStack(slot + 1)
+	vm.stack[slot] = value.ClosureValue(closure)
+	vm.stackSize = slot + 1
+
+	var val value.Value = value.Nil()
+	if base := vm.depth; vm.call(slot, 0, 1) {
+		val = vm.run(base)
+	}
+
+	if !vm.err.IsEmpty() {
+		vm.unwind(slot)
+	} else {
+		vm.clearStack(slot)
+	}
 
 	return val, vm.err
 }
 
-func (vm *VM) run() value.Value {
+// The VM runs its own copy of the chunk and of the functions in it, with
+// globals that cache what this VM reads and the VM's interned strings so that
+// scripts compare them by pointer. The compiled function is only read, so it
+// can run on other VMs at the same time
+func (vm *VM) load(chunk value.Chunk) value.Chunk {
+	constants := make([]value.Value, len(chunk.Constants))
+	for i, constant := range chunk.Constants {
+		if constant.IsClosure() {
+			prototype := *constant.AsClosure()
+			prototype.Chunk = vm.load(prototype.Chunk)
+			constants[i] = value.ClosureValue(&prototype)
+		} else {
+			constants[i] = vm.strings.Intern(constant)
+		}
+	}
+
+	globals := make([]value.Global, len(chunk.Globals))
+	for i, global := range chunk.Globals {
+		globals[i] = value.NewGlobal(vm.strings.Intern(global.Name))
+	}
+
+	chunk.Constants = constants
+	chunk.Globals = globals
+
+	return chunk
+}
+
+// Runs until the call depth is back to `base`, the depth when the call was
+// made, so that the VM can call back into glua functions. It returns the
+// first result of the function that was called
+func (vm *VM) run(base int) value.Value {
+	dest := vm.frame.stack
+	errors := vm.err.Len()
+
+	for vm.depth > base && vm.err.Len() == errors {
+		if vm.compiled() {
+			vm.runCompiled(base)
+		} else {
+			vm.runBytecode(base)
+		}
+	}
+
+	if vm.err.Len() > errors {
+		return value.Nil()
+	}
+
+	return vm.stack[dest]
+}
+
+// Runs bytecode until the depth is back to `base`, an error is raised or a
+// compiled function is called
+func (vm *VM) runBytecode(base int) {
+	// The registers are a slice of the stack and the frame is in the stack of
+	// frames, so they are fetched again after anything that can call a
+	// function and grow either one
+	frame, code, constants, globals, registers := vm.current()
+
 	for {
-		op := vm.readByte()
+		instruction := code[frame.ip]
+		frame.ip += 1
 
-		if constants.TraceExecution {
-			DebugTrace(vm)
+		if vm.options.MaxInstructions > 0 {
+			vm.executed += 1
+
+			if vm.executed > vm.options.MaxInstructions {
+				vm.error(fmt.Sprint("Instruction limit exceeded, limit is ", vm.options.MaxInstructions))
+				return
+			}
 		}
 
+		if vm.options.Trace {
+			DebugTrace(vm, instruction)
+		}
+
+		a := compiler.A(instruction)
 		var ok bool = true
 
-		switch op {
+		switch op := compiler.Op(instruction); op {
 		case compiler.OpAssert:
-			val := vm.pop()
-			if !val.AsBoolean() {
-				// exit or break to top level?
-				os.Exit(5)
+			if !registers[a].AsBoolean() {
+				message := rk(registers, constants, compiler.B(instruction))
+				vm.assertionError(message.RawString())
+				return
 			}
-		case compiler.OpPop:
-			vm.pop()
+		case compiler.OpMove:
+			registers[a] = registers[compiler.B(instruction)]
 		case compiler.OpConstant:
-			c := byte(vm.readByte())
-			val := vm.getConstant(c)
-
-			vm.push(val)
+			registers[a] = constants[compiler.Bx(instruction)]
 		case compiler.OpNil:
-			vm.push(value.Nil{})
-		case compiler.OpZero:
-			vm.push(value.Number(0))
+			for i := a; i < a+compiler.B(instruction); i++ {
+				registers[i] = value.Nil()
+			}
 		case compiler.OpLess:
-			ok = vm.compare(func(v1, v2 float64) bool { return v1 < v2 })
-		case compiler.OpGreater:
-			ok = vm.compare(func(v1, v2 float64) bool { return v1 > v2 })
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
+			registers[a], ok = vm.compare(b, c, value.NumberLess)
+		case compiler.OpLessEqual:
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
+			registers[a], ok = vm.compare(b, c, value.NumberLessEqual)
 		case compiler.OpEquals:
-			val2 := vm.pop()
-			val1 := vm.pop()
-
-			if val1.IsNumber() && val2.IsNumber() {
-				vm.push(value.Boolean(val1.AsNumber() == val2.AsNumber()))
-			} else if val1.IsBoolean() && val2.IsBoolean() {
-				vm.push(value.Boolean(val1.AsBoolean() == val2.AsBoolean()))
-			} else if val1.IsString() && val2.IsString() {
-				vm.push(value.Boolean(val1.String() == val2.String()))
-			} else if val1.IsNil() && val2.IsNil() {
-				vm.push(value.Boolean(true))
-			} else {
-				vm.push(value.Boolean(false))
-			}
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
+			registers[a] = value.Boolean(value.Equal(b, c))
 		case compiler.OpAnd:
-			val2 := vm.pop()
-			val1 := vm.pop()
-
-			vm.push(value.Boolean(val1.AsBoolean() && val2.AsBoolean()))
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
+			registers[a] = value.Boolean(b.AsBoolean() && c.AsBoolean())
 		case compiler.OpOr:
-			val2 := vm.pop()
-			val1 := vm.pop()
-
-			vm.push(value.Boolean(val1.AsBoolean() || val2.AsBoolean()))
-		case compiler.OpSubtract:
-			ok = vm.arithmetic("subtract", func(a, b float64) float64 { return a - b })
-		case compiler.OpDivide:
-			ok = vm.arithmetic("divide", func(a, b float64) float64 { return a / b })
-		case compiler.OpMult:
-			ok = vm.arithmetic("multiply", func(a, b float64) float64 { return a * b })
-		case compiler.OpNegate:
-			val := vm.pop().AsNumber()
-			vm.push(value.Number(-val))
-		case compiler.OpNot:
-			val := vm.pop().AsBoolean()
-			vm.push(value.Boolean(!val))
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
+			registers[a] = value.Boolean(b.AsBoolean() || c.AsBoolean())
 		case compiler.OpAdd:
-			val2 := vm.pop()
-			val1 := vm.pop()
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
 
 			switch {
-			case val1.IsNumber() && val2.IsNumber():
-				vm.push(value.Number(val1.AsNumber() + val2.AsNumber()))
+			case b.IsInteger() && c.IsInteger():
+				registers[a] = value.Integer(b.AsInteger() + c.AsInteger())
+			case b.Kind() == value.KindNumber && c.Kind() == value.KindNumber:
+				registers[a] = value.Number(b.AsNumber() + c.AsNumber())
 			default:
-				return vm.error("Cannot add two non-numbers")
+				registers[a], ok = vm.arithmetic(
+					"add", b, c,
+					func(a, b int64) int64 { return a + b },
+					func(a, b float64) float64 { return a + b },
+				)
 			}
-		case compiler.OpAssignStart:
-			vm.addAssignment(vm.stackSize)
-		case compiler.OpAssignCleanup:
-			// for security, clear stack
-			vm.clearStack(vm.popAssignment())
-		case compiler.OpLocalAllocate:
-			vm.addLocalAssignment(vm.stackSize + int(vm.readByte()))
-		case compiler.OpLocalCleanup:
-			// stack=[x, y] stackSize=2
-			// z, w = 1, 2, 3
-			// stack=[x, y, 1, 2, 3] vm.localTarget=(2+2)=4
-			// desired stack=[x, y, 1, 2]
-			vm.clearStack(vm.popLocalAssignment())
-		case compiler.OpSetGlobal:
-			val := vm.getAssign()
-			i := vm.readByte()
-			name := vm.frame.closure.Chunk.Constants[i]
+		case compiler.OpSubtract:
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
 
-			vm.globals[name.RawString()] = val
-		case compiler.OpGetGlobal:
-			i := vm.readByte()
-			name := vm.frame.closure.Chunk.Constants[i].RawString()
+			switch {
+			case b.IsInteger() && c.IsInteger():
+				registers[a] = value.Integer(b.AsInteger() - c.AsInteger())
+			case b.Kind() == value.KindNumber && c.Kind() == value.KindNumber:
+				registers[a] = value.Number(b.AsNumber() - c.AsNumber())
+			default:
+				registers[a], ok = vm.arithmetic(
+					"subtract", b, c,
+					func(a, b int64) int64 { return a - b },
+					func(a, b float64) float64 { return a - b },
+				)
+			}
+		case compiler.OpMult:
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
 
-			val := vm.globals[name]
+			switch {
+			case b.IsInteger() && c.IsInteger():
+				registers[a] = value.Integer(b.AsInteger() * c.AsInteger())
+			case b.Kind() == value.KindNumber && c.Kind() == value.KindNumber:
+				registers[a] = value.Number(b.AsNumber() * c.AsNumber())
+			default:
+				registers[a], ok = vm.arithmetic(
+					"multiply", b, c,
+					func(a, b int64) int64 { return a * b },
+					func(a, b float64) float64 { return a * b },
+				)
+			}
+		case compiler.OpDivide:
+			// Division always produces a float, even for two integers
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
+			registers[a], ok = vm.arithmetic("divide", b, c, nil, func(a, b float64) float64 { return a / b })
+		case compiler.OpNegate:
+			val := rk(registers, constants, compiler.B(instruction))
 
-			if val == nil {
-				vm.push(value.Nil{})
+			if val.IsInteger() {
+				registers[a] = value.Integer(-val.AsInteger())
 			} else {
-				vm.push(val)
+				registers[a] = value.Number(-val.AsNumber())
+			}
+		case compiler.OpNot:
+			val := rk(registers, constants, compiler.B(instruction))
+			registers[a] = value.Boolean(!val.AsBoolean())
+		case compiler.OpBitAnd:
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
+			registers[a], ok = vm.bitwise(b, c, func(a, b int64) int64 { return a & b })
+		case compiler.OpBitOr:
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
+			registers[a], ok = vm.bitwise(b, c, func(a, b int64) int64 { return a | b })
+		case compiler.OpBitXor:
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
+			registers[a], ok = vm.bitwise(b, c, func(a, b int64) int64 { return a ^ b })
+		case compiler.OpShiftLeft:
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
+			registers[a], ok = vm.bitwise(b, c, value.ShiftLeft)
+		case compiler.OpShiftRight:
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
+			registers[a], ok = vm.bitwise(b, c, value.ShiftRight)
+		case compiler.OpBitNot:
+			val, isInteger := vm.toInteger(rk(registers, constants, compiler.B(instruction)))
+
+			if !isInteger {
+				return
 			}
-		case compiler.OpSetLocal:
-			slot := vm.readByte()
-			val := vm.getAssign()
 
-			vm.setLocal(byte(slot), val)
-		case compiler.OpGetLocal:
-			slot := vm.readByte()
-			val := vm.getLocal(byte(slot))
+			registers[a] = value.Integer(^val)
+		case compiler.OpLength:
+			ok = vm.length(a, rk(registers, constants, compiler.B(instruction)))
 
-			vm.push(val)
+			if ok {
+				frame, code, constants, globals, registers = vm.current()
+			}
+		case compiler.OpSetGlobal:
+			name := globals[compiler.Bx(instruction)].Name
+
+			if !vm.setTable(frame.closure.Env, name, registers[a]) {
+				return
+			}
+		case compiler.OpGetGlobal:
+			registers[a] = frame.closure.Env.GetGlobal(&globals[compiler.Bx(instruction)])
+		case compiler.OpGetEnv:
+			registers[a] = value.TableValue(frame.closure.Env)
 		case compiler.OpCreateUpvalue:
-			index := vm.readByte()
-			isLocal := vm.readByte() == 1
-			closure := vm.peek().AsClosure()
+			index := compiler.B(instruction)
+			isLocal := compiler.C(instruction) == 1
+			closure := registers[a].AsClosure()
 
-			vm.createUpvalue(index, isLocal, closure)
+			if !vm.createUpvalue(index, isLocal, closure) {
+				return
+			}
 		case compiler.OpSetUpvalue:
-			index := vm.readByte()
-			val := vm.getAssign()
-
-			vm.setUpvalue(index, val)
+			vm.setUpvalue(compiler.B(instruction), registers[a])
 		case compiler.OpGetUpvalue:
 			// todo: trace isLocal too
-			index := vm.readByte()
-			val := vm.getUpvalue(index)
-
-			vm.push(val)
+			registers[a] = vm.getUpvalue(compiler.B(instruction))
+		case compiler.OpMarkClose:
+			name := constants[compiler.Bx(instruction)]
+			ok = vm.markClose(a, name)
 		case compiler.OpCloseUpvalues:
-			index := vm.readByte()
-			vm.closeUpvalues(vm.frame.stack + int(index))
-			vm.clearStack(vm.frame.stack + int(index))
+			ok = vm.closeVariables(frame.stack+a, value.Nil())
+			vm.closeUpvalues(frame.stack + a)
+
+			if ok {
+				frame, code, constants, globals, registers = vm.current()
+			}
 		case compiler.OpClosure:
 			// Copy closure
-			closure := vm.pop().AsClosure()
+			closure := constants[compiler.Bx(instruction)].AsClosure()
 
-			vm.push(&value.Closure{
+			if !vm.allocate(closureSize) {
+				return
+			}
+
+			registers[a] = value.ClosureValue(&value.Closure{
 				Chunk:    closure.Chunk,
 				Name:     closure.Name,
 				Upvalues: nil,
+				Env:      frame.closure.Env,
 			})
-		case compiler.OpJumpIfFalse:
-			cond := vm.pop()
+		case compiler.OpTest:
+			if registers[a].AsBoolean() != (compiler.C(instruction) == 1) {
+				frame.ip += 1
+			}
+		case compiler.OpTestEquals:
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
 
-			if cond.AsBoolean() {
-				vm.advance()
-				vm.advance()
-			} else {
-				upper := byte(vm.readByte())
-				lower := byte(vm.readByte())
-				dist := compiler.MergeBytes(upper, lower)
+			if value.Equal(b, c) != (a == 1) {
+				frame.ip += 1
+			}
+		case compiler.OpTestLess:
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
+
+			var less value.Value
+			if less, ok = vm.compare(b, c, value.NumberLess); ok && less.AsBoolean() != (a == 1) {
+				frame.ip += 1
+			}
+		case compiler.OpTestLessEqual:
+			b, c := rk(registers, constants, compiler.B(instruction)), rk(registers, constants, compiler.C(instruction))
 
-				vm.frame.ip += dist
+			var lessEqual value.Value
+			if lessEqual, ok = vm.compare(b, c, value.NumberLessEqual); ok && lessEqual.AsBoolean() != (a == 1) {
+				frame.ip += 1
 			}
-		case compiler.OpLoop:
-			upper := byte(vm.readByte())
-			lower := byte(vm.readByte())
-			dist := compiler.MergeBytes(upper, lower)
+		case compiler.OpJump:
+			offset := compiler.J(instruction)
 
-			vm.frame.ip -= dist
+			if offset < 0 && vm.interrupted() {
+				return
+			}
+
+			frame.ip += offset
 		case compiler.OpCreateTable:
-			vm.push(value.NewTable())
+			if !vm.allocate(tableSize) {
+				return
+			}
+
+			registers[a] = value.TableValue(value.NewTable())
 		case compiler.OpInsertTable:
-			val := vm.pop()
-			table := vm.peek().AsTable()
+			table := registers[a].AsTable()
 
-			table.Insert(val)
+			table.Insert(rk(registers, constants, compiler.B(instruction)))
+			ok = vm.allocate(entrySize)
 		case compiler.OpSetTable:
-			val := vm.getAssign()
-			key := vm.pop()
-			table := vm.pop().AsTable()
-
-			ok := table.Set(key, val)
+			table := registers[a]
+			key := rk(registers, constants, compiler.B(instruction))
+			val := rk(registers, constants, compiler.C(instruction))
 
-			if !ok {
-				return vm.error("Cannot set key <nil> in table.")
+			if !table.IsTable() {
+				vm.error("Cannot assign to non-table")
+				return
 			}
-		case compiler.OpInitTable:
-			// Exact same as set table, but leaves table on stack instead of value
-			val := vm.pop()
-			key := vm.pop()
-			table := vm.peek().AsTable()
-
-			ok := table.Set(key, val)
 
-			if !ok {
-				return vm.error("Cannot set key <nil> in table.")
+			if !vm.setTable(table.AsTable(), key, val) {
+				return
 			}
 		case compiler.OpGetTable:
-			attribute := vm.pop()
-			table := vm.pop()
+			table := registers[compiler.B(instruction)]
+			key := rk(registers, constants, compiler.C(instruction))
 
 			if !table.IsTable() {
-				return vm.error("Cannot assign to non-table")
+				vm.error("Cannot assign to non-table")
+				return
 			}
 
-			val := table.AsTable().Get(attribute)
-			vm.push(val)
+			registers[a] = table.AsTable().Get(key)
 		case compiler.OpCall:
-			arity := int(vm.readByte())
-			isAssignment := vm.readByte() == 1
-			vm.call(arity, isAssignment)
+			arity := compiler.B(instruction) - 1
+			results := compiler.C(instruction) - 1
+
+			if !vm.call(frame.stack+a, arity, results) {
+				return
+			}
+
+			if vm.compiled() {
+				return
+			}
+
+			frame, code, constants, globals, registers = vm.current()
 		case compiler.OpReturn:
-			arity := int(vm.readByte())
-			vm.returnFrom(arity)
+			ok = vm.returnFrom(frame.stack+a, compiler.B(instruction)-1)
+
+			if ok && (vm.depth == base || vm.compiled()) {
+				return
+			}
+
+			if ok {
+				frame, code, constants, globals, registers = vm.current()
+			}
+		case compiler.OpTailCall:
+			ok = vm.tailCall(frame.stack+a, compiler.B(instruction)-1)
+
+			// Only a builtin returns straight away
+			if ok && (vm.depth == base || vm.compiled()) {
+				return
+			}
 
-			if vm.frame == nil {
-				return vm.pop()
+			if ok {
+				frame, code, constants, globals, registers = vm.current()
 			}
 		default:
-			return vm.error(fmt.Sprint("Do not know how to perform: ", compiler.ByteName(op)))
+			vm.error(fmt.Sprint("Do not know how to perform: ", compiler.OpName(op)))
+			return
 		}
 
 		if !ok {
-			return value.Nil{}
+			return
 		}
 	}
 }
 
-func (vm *VM) addAssignment(capacity int) {
-	vm.assignBase = append(vm.assignBase, capacity)
-	vm.assignTarget = append(vm.assignTarget, capacity)
+func (vm *VM) current() (*CallFrame, []uint32, []value.Value, []value.Global, []value.Value) {
+	frame := vm.frame
+	chunk := &frame.closure.Chunk
+
+	return frame, chunk.Code, chunk.Constants, chunk.Globals, vm.stack[frame.stack:vm.stackSize]
 }
 
-func (vm *VM) incAssignTarget() int {
-	index := len(vm.assignTarget) - 1
-	result := vm.assignTarget[index]
-	vm.assignTarget[index] += 1
+// B and C operands with the constant bit set refer to the constants
+func rk(registers []value.Value, constants []value.Value, operand int) value.Value {
+	if compiler.IsConstant(operand) {
+		return constants[compiler.ConstantIndex(operand)]
+	}
 
-	return result
+	return registers[operand]
 }
 
-func (vm *VM) popAssignment() int {
-	index := len(vm.assignBase) - 1
-	assign := vm.assignBase[index]
-	vm.assignBase = vm.assignBase[:index]
-	vm.assignTarget = vm.assignTarget[:index]
+// The function is at `slot` followed by its arguments, and `results` values
+// replace them when it returns
+func (vm *VM) call(slot, arity, results int) bool {
+	if vm.interrupted() {
+		return false
+	}
+
+	function := vm.stack[slot]
+
+	if function.IsClosure() {
+		closure := function.AsClosure()
+		if !vm.interpretable(closure) {
+			return false
+		}
+
+		// The script itself is at depth zero
+		if limit := vm.options.MaxCallDepth; limit > 0 && vm.depth > limit {
+			vm.error(fmt.Sprint("Stack overflow, call depth limit is ", limit))
+			return false
+		}
 
-	return assign
+		top := slot + closure.Chunk.Registers
+		if limit := vm.options.MaxStackSize; limit > 0 && top > limit {
+			vm.error(fmt.Sprint("Stack overflow, value stack limit is ", limit))
+			return false
+		}
+
+		vm.ensureStack(top)
+		vm.setArguments(slot, arity, closure.Chunk.Arity)
+
+		vm.pushFrame(CallFrame{
+			ip:      0,
+			stack:   slot,
+			closure: closure,
+			results: results,
+		})
+		vm.stackSize = top
+
+		vm.traceFunction()
+	} else if function.IsBuiltin() {
+		arguments := make([]value.Value, arity)
+		copy(arguments, vm.stack[slot+1:slot+1+arity])
+
+		result := vm.strings.Intern(function.AsBuiltin().Function(arguments))
+
+		// Builtins return one value, the rest are nil
+		vm.stack[slot] = result
+		for i := slot + 1; i < slot+1+arity || i < slot+results; i++ {
+			vm.stack[i] = value.Nil()
+		}
+
+		if result.IsString() && !vm.allocate(stringSize+len(result.RawString())) {
+			return false
+		}
+	} else {
+		vm.error(fmt.Sprintf("Attempt to call a non-function value %s", function))
+		return false
+	}
+
+	return true
 }
 
-func (vm *VM) addLocalAssignment(capacity int) {
-	vm.localTarget = append(vm.localTarget, capacity)
+// Functions made by generated code have no bytecode, they can only be run by
+// the code they were generated with
+func (vm *VM) interpretable(closure *value.Closure) bool {
+	if _, generated := closure.Chunk.Compiled.(NativeFunction); generated {
+		vm.error("Cannot call generated function from interpreted code")
+		return false
+	}
+
+	return true
 }
 
-func (vm *VM) popLocalAssignment() int {
-	index := len(vm.localTarget) - 1
-	assign := vm.localTarget[index]
-	vm.localTarget = vm.localTarget[:index]
+// Growing the stack of frames moves it, like the value stack, so pointers to
+// frames other than vm.frame go stale after a call
+func (vm *VM) pushFrame(frame CallFrame) {
+	if vm.depth == len(vm.frames) {
+		vm.frames = append(vm.frames, frame)
+	} else {
+		vm.frames[vm.depth] = frame
+	}
 
-	return assign
+	vm.frame = &vm.frames[vm.depth]
+	vm.depth += 1
 }
 
-func (vm *VM) call(arity int, isAssignment bool) {
-	// stack=[x, y, func, a, b, c]; stackSize=6; arity=3 -> stackBottom=2
-	stackBottom := vm.stackSize - arity - 1
+// The frame is cleared so that it doesn't keep its closure alive
+func (vm *VM) popFrame() {
+	vm.depth -= 1
+	vm.frames[vm.depth] = CallFrame{}
 
-	if vm.stack[stackBottom].IsClosure() {
-		closure := vm.stack[stackBottom].AsClosure()
-		enclosing := vm.frame
-		frame := CallFrame{
-			ip:           0,
-			stack:        stackBottom,
-			context:      enclosing,
-			closure:      closure,
-			isAssignment: isAssignment,
-		}
-		vm.frame = &frame
+	if vm.depth == 0 {
+		vm.frame = nil
+	} else {
+		vm.frame = &vm.frames[vm.depth-1]
+	}
+}
 
-		vm.traceFunction()
-	} else if vm.stack[stackBottom].IsBuiltin() {
-		arguments := vm.stack[stackBottom+1 : vm.stackSize]
-		for range arguments {
-			vm.pop()
-		}
+// Missing arguments are nil and extra arguments are dropped
+func (vm *VM) setArguments(slot, arity, params int) {
+	for i := slot + 1 + arity; i < slot+1+params; i++ {
+		vm.stack[i] = value.Nil()
+	}
 
-		builtin := vm.pop().AsBuiltin()
-		vm.push(builtin.Function(arguments))
+	for i := slot + 1 + params; i < slot+1+arity; i++ {
+		vm.stack[i] = value.Nil()
+	}
+}
+
+// Grows the stack to hold at least `size` values, slices of the old stack
+// are not updated
+func (vm *VM) ensureStack(size int) {
+	if size > len(vm.stack) {
+		vm.stack = append(vm.stack, make([]value.Value, size-len(vm.stack))...)
+	}
+}
+
+// Strings are measured in bytes, tables use __len when they have it and
+// otherwise their border
+func (vm *VM) length(register int, val value.Value) bool {
+	var result value.Value
+
+	switch {
+	case val.IsString():
+		result = value.Integer(int64(len(val.RawString())))
+	case val.IsTable():
+		if handler := value.Metamethod(val, "__len"); !handler.IsNil() {
+			var ok bool
+			if result, ok = vm.callValue(handler, val); !ok {
+				return false
+			}
+		} else {
+			result = value.Integer(int64(val.AsTable().Length()))
+		}
+	default:
+		vm.error(fmt.Sprintf("Attempt to get length of %s", val))
+		return false
 	}
+
+	vm.stack[vm.frame.stack+register] = result
+	return true
 }
 
-func (vm *VM) returnFrom(arity int) {
-	values := make([]value.Value, arity)
+// The called closure takes over the current frame, so its upvalues are closed
+// and the closure and arguments are moved down to the frame's base. Calling a
+// builtin is a normal call followed by a return
+func (vm *VM) tailCall(slot, arity int) bool {
+	if !vm.stack[slot].IsClosure() {
+		return vm.call(slot, arity, 1) && vm.returnFrom(slot, 1)
+	}
+
+	if vm.interrupted() || !vm.interpretable(vm.stack[slot].AsClosure()) {
+		return false
+	}
+
+	base := vm.frame.stack
+	vm.closeUpvalues(base)
+
+	copy(vm.stack[base:], vm.stack[slot:slot+arity+1])
+	vm.clearStack(base + arity + 1)
+
+	closure := vm.stack[base].AsClosure()
+	top := base + closure.Chunk.Registers
+	if limit := vm.options.MaxStackSize; limit > 0 && top > limit {
+		vm.error(fmt.Sprint("Stack overflow, value stack limit is ", limit))
+		return false
+	}
+
+	vm.ensureStack(top)
+	vm.setArguments(base, arity, closure.Chunk.Arity)
+	vm.stackSize = top
+
+	vm.frame.closure = closure
+	vm.frame.ip = 0
+	vm.frame.tailCall = true
+
+	vm.traceFunction()
+
+	return true
+}
 
-	for i := 1; i <= arity; i++ {
-		values[arity-i] = vm.pop()
+// A done channel that is nil never fires, so without a deadline or
+// cancellation this is a single failed select
+func (vm *VM) interrupted() bool {
+	select {
+	case <-vm.done:
+		vm.error(fmt.Sprint("Execution interrupted: ", vm.ctx.Err()))
+		return true
+	default:
+		return false
 	}
+}
 
-	// stack=[x, y, func, a, b, c, r1, r2, r3]; frame.stack=2; arity=3
-	vm.closeUpvalues(vm.frame.stack)
+// The `count` values starting at `first` are the results, they are moved to
+// where the function was in the caller's registers
+func (vm *VM) returnFrom(first, count int) bool {
+	if !vm.closeVariables(vm.frame.stack, value.Nil()) {
+		return false
+	}
 
-	// stack=[x, y, func, a, b, c, r1, r2, r3]; frame.stack=2; arity=3
-	stack := vm.frame.stack
-	context := vm.frame.context
-	isAssignment := vm.frame.isAssignment
+	// Closing variables calls __close, which can move the frames
+	frame := vm.frame
 
-	// remove all stack entries from stack..stackSize, not inclusive of stackSize
-	// this also sets the stack top to the stack top before the call, dropping
-	// the closure as well as parameters and locals
-	//
-	// then set the call frame to the parent call frame
-	// stack=[x, y]; frame.stack=0
-	vm.clearStack(stack)
-	vm.frame = context
+	// registers=[func, a, b, c, r1, r2]; frame.stack=2; first=6; count=2
+	vm.closeUpvalues(frame.stack)
 
-	if isAssignment && len(values) > 0 {
-		for _, value := range values {
-			vm.push(value)
+	// Missing results are nil and extra ones are dropped, the results are
+	// never below where they are copied to so they can be moved in order
+	dest := frame.stack
+	for i := 0; i < frame.results; i++ {
+		if i < count {
+			vm.stack[dest+i] = vm.stack[first+i]
+		} else {
+			vm.stack[dest+i] = value.Nil()
 		}
-	} else if isAssignment && len(values) == 0 {
-		vm.push(value.Nil{})
-	} else {
-		vm.push(values[0])
 	}
 
+	// remove all stack entries from the results to the top of the frame,
+	// dropping the parameters and locals, and return to the caller's frame
+	vm.clearStack(dest + frame.results)
+	vm.popFrame()
+
 	if vm.frame != nil {
+		if top := vm.frame.stack + vm.frame.closure.Chunk.Registers; top > vm.stackSize {
+			vm.stackSize = top
+		}
+
 		vm.traceFunction()
 	}
+
+	return true
+}
+
+// Calls a glua function or builtin from inside the VM and returns its first
+// result, reporting false if the call raised an error
+func (vm *VM) callValue(function value.Value, args ...value.Value) (value.Value, bool) {
+	errors := vm.err.Len()
+
+	if !function.IsClosure() && !function.IsBuiltin() {
+		vm.error(fmt.Sprintf("Attempt to call a non-function value %s", function))
+		return value.Nil(), false
+	}
+
+	// The call goes above the current frame's registers
+	slot := vm.stackSize
+	vm.ensureStack(slot + 1 + len(args))
+	vm.stack[slot] = function
+	copy(vm.stack[slot+1:], args)
+	vm.stackSize = slot + 1 + len(args)
+
+	// Each call made this way nests on the Go stack
+	if vm.nested >= nativeCallDepth {
+		vm.error(fmt.Sprint("Stack overflow, nested metamethod limit is ", nativeCallDepth))
+		vm.clearStack(slot)
+		return value.Nil(), false
+	}
+
+	base := vm.depth
+	if !vm.call(slot, len(args), 1) {
+		vm.clearStack(slot)
+		return value.Nil(), false
+	}
+
+	if function.IsClosure() {
+		vm.nested += 1
+		vm.run(base)
+		vm.nested -= 1
+	}
+
+	// An error stops the function with its frames and those of anything it
+	// called still on the stack of frames. They are dropped so the caller's
+	// frame is current again, their registers are left for unwind to close
+	if vm.err.Len() > errors {
+		for vm.depth > base {
+			vm.popFrame()
+		}
+
+		return value.Nil(), false
+	}
+
+	result := vm.stack[slot]
+	vm.clearStack(slot)
+
+	return result, true
+}
+
+// A to-be-closed variable is remembered by its absolute stack slot, false
+// and nil are allowed and ignored
+func (vm *VM) markClose(register int, name value.Value) bool {
+	slot := vm.frame.stack + register
+	val := vm.stack[slot]
+
+	if val.IsNil() || (val.IsBoolean() && !val.AsBoolean()) {
+		return true
+	}
+
+	if value.Metamethod(val, "__close").IsNil() {
+		vm.error(fmt.Sprintf("Variable '%s' got a non-closable value", name.RawString()))
+		return false
+	}
+
+	vm.toClose = append(vm.toClose, slot)
+	return true
+}
+
+// Calls __close on every to-be-closed variable at or above the stack index,
+// in reverse order of declaration, with the error (or nil) that caused the
+// scope to exit
+func (vm *VM) closeVariables(index int, err value.Value) bool {
+	ok := true
+
+	for len(vm.toClose) > 0 && vm.toClose[len(vm.toClose)-1] >= index {
+		last := len(vm.toClose) - 1
+		slot := vm.toClose[last]
+		vm.toClose = vm.toClose[:last]
+
+		val := vm.stack[slot]
+		_, closed := vm.callValue(value.Metamethod(val, "__close"), val, err)
+		ok = ok && closed
+	}
+
+	return ok
+}
+
+// After an error, close any pending variables and drop everything the failed
+// script left on the stack so that the VM can be reused by the REPL
+func (vm *VM) unwind(base int) {
+	err := value.StringVal(vm.err.First().Error())
+
+	for len(vm.toClose) > 0 && vm.toClose[len(vm.toClose)-1] >= base {
+		slot := vm.toClose[len(vm.toClose)-1]
+		vm.clearStack(slot + 1)
+		vm.closeVariables(slot, err)
+	}
+
+	vm.closeUpvalues(base)
+	vm.clearStack(base)
+
+	for vm.depth > 0 {
+		vm.popFrame()
+	}
 }
 
 func (vm *VM) clearStack(stack int) {
 	for i := stack; i < vm.stackSize; i++ {
-		vm.stack[i] = nil
+		vm.stack[i] = value.Nil()
 	}
 	vm.stackSize = stack
 }
 
 func (vm *VM) traceFunction() {
 	// todo: call function
-	if constants.TraceExecution && vm.frame.closure.Name == "" {
-		fmt.Fprintln(os.Stderr, "========== <script> ==========")
-	} else if constants.TraceExecution {
-		fmt.Fprintf(os.Stderr, "========== %s ==========\n", vm.frame.closure.Name)
+	if vm.options.Trace && vm.frame.closure.Name == "" {
+		fmt.Fprintln(vm.options.Writer(), "========== <script> ==========")
+	} else if vm.options.Trace {
+		fmt.Fprintf(vm.options.Writer(), "========== %s ==========\n", vm.frame.closure.Name)
 	}
 }
 
-func (vm *VM) pop() value.Value {
-	vm.stackSize -= 1
-	val := vm.stack[vm.stackSize]
-	vm.stack[vm.stackSize] = nil
+// Closures capturing the same variable share one upvalue, enclosing upvalues
+// are passed on as they are and locals reuse the open upvalue for their slot
+func (vm *VM) createUpvalue(index int, isLocal bool, closure *value.Closure) bool {
+	if !isLocal {
+		closure.Upvalues = append(closure.Upvalues, vm.frame.closure.Upvalues[index])
+		return true
+	}
+
+	slot := vm.frame.stack + index
+	i := vm.findOpenUpvalue(slot)
+
+	if i < len(vm.openUpvalues) && vm.openUpvalues[i].Slot == slot {
+		closure.Upvalues = append(closure.Upvalues, vm.openUpvalues[i])
+		return true
+	}
+
+	if !vm.allocate(upvalueSize) {
+		return false
+	}
+
+	upvalue := value.NewUpvalue(slot)
+
+	// Keep the open upvalues sorted by slot
+	vm.openUpvalues = append(vm.openUpvalues, nil)
+	copy(vm.openUpvalues[i+1:], vm.openUpvalues[i:])
+	vm.openUpvalues[i] = upvalue
 
-	return val
+	closure.Upvalues = append(closure.Upvalues, upvalue)
+	return true
 }
 
-func (vm *VM) peek() value.Value {
-	return vm.stack[vm.stackSize-1]
+// The position of the first open upvalue at or above the slot
+func (vm *VM) findOpenUpvalue(slot int) int {
+	return sort.Search(len(vm.openUpvalues), func(i int) bool {
+		return vm.openUpvalues[i].Slot >= slot
+	})
 }
 
-func (vm *VM) push(val value.Value) {
-	if vm.stackSize >= len(vm.stack) {
-		vm.stack = append(vm.stack, val)
-	} else {
-		vm.stack[vm.stackSize] = val
+func (vm *VM) getUpvalue(index int) value.Value {
+	upvalue := vm.frame.closure.Upvalues[index]
+
+	if upvalue.Open {
+		return vm.stack[upvalue.Slot]
 	}
 
-	vm.stackSize += 1
+	return upvalue.Value
 }
 
-func (vm *VM) getConstant(slot byte) value.Value {
-	return vm.frame.closure.Chunk.Constants[slot]
-}
+func (vm *VM) setUpvalue(index int, val value.Value) {
+	upvalue := vm.frame.closure.Upvalues[index]
 
-func (vm *VM) getAssign() value.Value {
-	index := vm.incAssignTarget()
-	if index >= vm.stackSize {
-		return value.Nil{}
+	if upvalue.Open {
+		vm.stack[upvalue.Slot] = val
 	} else {
-		return vm.stack[index]
+		upvalue.Value = val
 	}
 }
 
-func (vm *VM) getLocal(slot byte) value.Value {
-	return vm.stack[vm.frame.stack+int(slot)]
-}
+// Closes the upvalues for every slot at or above `slot`, which must happen
+// before those slots are cleared from the stack
+func (vm *VM) closeUpvalues(slot int) {
+	i := vm.findOpenUpvalue(slot)
+
+	for _, upvalue := range vm.openUpvalues[i:] {
+		upvalue.Close(vm.stack[upvalue.Slot])
+	}
 
-func (vm *VM) setLocal(slot byte, val value.Value) {
-	vm.stack[vm.frame.stack+int(slot)] = val
+	for j := i; j < len(vm.openUpvalues); j++ {
+		vm.openUpvalues[j] = nil
+	}
+	vm.openUpvalues = vm.openUpvalues[:i]
 }
 
-func (vm *VM) createUpvalue(index byte, isLocal bool, closure *value.Closure) {
-	var upvalue *value.Upvalue
+func (vm *VM) arithmetic(name string, val1, val2 value.Value, intOp func(int64, int64) int64, floatOp func(float64, float64) float64) (value.Value, bool) {
+	result, ok := value.Arithmetic(val1, val2, intOp, floatOp)
 
-	if isLocal {
-		upvalue = &value.Upvalue{
-			Value:   nil,
-			Pointer: &vm.stack[vm.frame.stack+int(index)],
-			IsLocal: true,
-			Index:   int(index),
-		}
+	if !ok {
+		vm.error(fmt.Sprintf("Cannot %s two non-numbers", name))
+	}
 
-	} else {
-		root := vm.frame.closure.Upvalues[index]
-		upvalue = &value.Upvalue{
-			Value:   nil,
-			Pointer: root.Pointer,
-			IsLocal: false,
-			Index:   root.Index,
-		}
+	return result, ok
+}
+
+func (vm *VM) bitwise(val1, val2 value.Value, op func(int64, int64) int64) (value.Value, bool) {
+	integer2, ok := vm.toInteger(val2)
+	if !ok {
+		return value.Nil(), false
 	}
 
-	vm.addOpenUpvalue(upvalue)
+	integer1, ok := vm.toInteger(val1)
+	if !ok {
+		return value.Nil(), false
+	}
 
-	closure.Upvalues = append(closure.Upvalues, upvalue)
+	return value.Integer(op(integer1, integer2)), true
 }
 
-func (vm *VM) addOpenUpvalue(upvalue *value.Upvalue) {
-	vm.openUpvalues = append(vm.openUpvalues, upvalue)
+func (vm *VM) toInteger(val value.Value) (int64, bool) {
+	if !val.IsNumber() {
+		vm.error("Cannot perform bitwise operation on non-number")
+		return 0, false
+	}
+
+	integer, ok := value.ToInteger(val)
+
+	if !ok {
+		vm.error(fmt.Sprintf("Number %s has no integer representation", val))
+	}
+
+	return integer, ok
 }
 
-func (vm *VM) getUpvalue( /*frame *CallFrame,*/ index byte) value.Value {
-	return *vm.frame.closure.Upvalues[index].Pointer
+func (vm *VM) compare(val1, val2 value.Value, compare func(value.Value, value.Value) bool) (value.Value, bool) {
+	if val1.IsNumber() && val2.IsNumber() {
+		return value.Boolean(compare(val1, val2)), true
+	}
 
+	vm.error("Unable to compare two non-numbers")
+	return value.Nil(), false
 }
 
-func (vm *VM) setUpvalue(index byte, val value.Value) {
-	*vm.frame.closure.Upvalues[index].Pointer = val
+func (vm *VM) error(message string) value.Value {
+	return vm.raise(message, false)
 }
 
-func (vm *VM) closeUpvalues(index int) {
-	dropping, keeping := vm.partitionUpvalues(index)
-	vm.openUpvalues = keeping
+// Failed asserts are ordinary runtime errors, marked so that the CLI can
+// give them their own exit code
+func (vm *VM) assertionError(message string) value.Value {
+	return vm.raise(message, true)
+}
 
-	for _, upvalue := range dropping {
-		upvalue.Close()
+func (vm *VM) raise(message string, assertion bool) value.Value {
+	traceback := vm.traceback()
+
+	var span glerror.Span
+	var source *glerror.Source
+	if len(traceback) > 0 {
+		span = traceback[0].Span
+		source = traceback[0].source
 	}
+
+	vm.err.Append(RuntimeError{
+		message:   message,
+		span:      span,
+		source:    source,
+		traceback: traceback,
+		assertion: assertion,
+	})
+	return value.Nil()
 }
 
-func (vm *VM) partitionUpvalues(index int) (keeping []*value.Upvalue, dropping []*value.Upvalue) {
-	for _, upvalue := range vm.openUpvalues {
-		if upvalue.Index > index {
-			dropping = append(dropping, upvalue)
-		} else {
-			keeping = append(keeping, upvalue)
+// Walks the call frames from the innermost outwards, the span of each frame
+// is that of the instruction being executed (the call, for callers)
+func (vm *VM) traceback() []StackFrame {
+	var traceback []StackFrame
+
+	for i := vm.depth - 1; i >= 0; i-- {
+		frame := &vm.frames[i]
+		chunk := frame.closure.Chunk
+		span := glerror.Span{Line: -1}
+
+		if frame.ip > 0 && frame.ip <= len(chunk.Spans) {
+			span = chunk.Spans[frame.ip-1]
+		}
+
+		name := "?"
+		if chunk.Source != nil {
+			name = chunk.Source.Name
 		}
+
+		traceback = append(traceback, StackFrame{
+			Function: frame.closure.Name,
+			Chunk:    name,
+			Line:     span.Line,
+			Span:     span,
+			TailCall: frame.tailCall,
+			source:   chunk.Source,
+		})
 	}
 
-	return
+	return traceback
 }
 
-func (vm *VM) arithmetic(name string, op func(float64, float64) float64) bool {
-	val2 := vm.pop()
-	val1 := vm.pop()
-
-	switch {
-	case val1.IsNumber() && val2.IsNumber():
-		vm.push(value.Number(op(val1.AsNumber(), val2.AsNumber())))
-		return true
-	default:
-		vm.error(fmt.Sprintf("Cannot %s two non-numbers", name))
-		return false
+// debug.traceback([message]) returns the message followed by the current
+// stack traceback
+func (vm *VM) tracebackBuiltin(args []value.Value) value.Value {
+	message := ""
+	if len(args) > 0 && !args[0].IsNil() {
+		message = args[0].RawString() + "\n"
 	}
+
+	return value.StringVal(message + FormatTraceback(vm.traceback()))
 }
 
-func (vm *VM) compare(compare func(float64, float64) bool) bool {
-	val2 := vm.pop()
-	val1 := vm.pop()
+type StackFrame struct {
+	Function string
+	Chunk    string
+	Line     int
+	Span     glerror.Span
+	TailCall bool
+	source   *glerror.Source
+}
 
-	if val1.IsNumber() && val2.IsNumber() {
-		vm.push(value.Boolean(compare(val1.AsNumber(), val2.AsNumber())))
-		return true
-	} else {
-		vm.error("Unable to compare two non-numbers")
-		return false
+func (frame StackFrame) String() string {
+	if frame.Function == "" {
+		return fmt.Sprintf("%s:%d: in main chunk", frame.Chunk, frame.Line)
 	}
+
+	return fmt.Sprintf("%s:%d: in function '%s'", frame.Chunk, frame.Line, frame.Function)
 }
 
-func (vm *VM) readByte() byte {
-	c := vm.current()
-	vm.advance()
-	return c
+func FormatTraceback(traceback []StackFrame) string {
+	lines := []string{"stack traceback:"}
+
+	for _, frame := range traceback {
+		lines = append(lines, "\t"+frame.String())
+
+		// The frames the tail calls replaced are gone
+		if frame.TailCall {
+			lines = append(lines, "\t(...tail calls...)")
+		}
+	}
+
+	return strings.Join(lines, "\n")
 }
 
-func (vm *VM) advance() {
-	vm.frame.ip += 1
+type RuntimeError struct {
+	message   string
+	span      glerror.Span
+	source    *glerror.Source
+	traceback []StackFrame
+	assertion bool
 }
 
-func (vm *VM) previous() byte {
-	return vm.frame.closure.Chunk.Bytecode[vm.frame.ip-1]
+func (re RuntimeError) Error() string {
+	return glerror.Format("Runtime error", re.message, re.source, re.span)
 }
 
-func (vm *VM) current() byte {
-	return vm.frame.closure.Chunk.Bytecode[vm.frame.ip]
+func (re RuntimeError) Message() string {
+	return re.message
 }
 
-func (vm *VM) next() byte {
-	return vm.frame.closure.Chunk.Bytecode[vm.frame.ip+1]
+func (re RuntimeError) Line() int {
+	return re.span.Line
 }
 
-func (vm *VM) error(message string) value.Value {
-	vm.err.Append(RuntimeError{
-		message: message,
-		line:    vm.frame.closure.Chunk.Lines[vm.frame.ip],
-	})
-	return value.Nil{}
+func (re RuntimeError) Span() glerror.Span {
+	return re.span
 }
 
-type RuntimeError struct {
-	message string
-	line    int
+func (re RuntimeError) Assertion() bool {
+	return re.assertion
 }
 
-func (re RuntimeError) Error() string {
-	return fmt.Sprintf("Runtime error [line=%d] ---> %s", re.line, re.message)
+// Traceback lists the active functions when the error was raised, innermost first
+func (re RuntimeError) Traceback() []StackFrame {
+	return re.traceback
 }
 
 func (vm *VM) GetErrors() error {
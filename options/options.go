@@ -0,0 +1,48 @@
+package options
+
+import (
+	"io"
+	"os"
+)
+
+// Options turn on the debug output of the scanner, compiler and VM, all of it
+// is off by default and written to stderr unless Output is set. The limits
+// are for running untrusted scripts, zero means no limit. Optimize is the
+// optimization level of the compiler, at zero it emits code as written.
+// Backend is how the VM runs compiled code, empty is the same as bytecode.
+type Options struct {
+	DumpTokens   bool
+	DumpAst      bool
+	DumpBytecode bool
+	Trace        bool
+	Output       io.Writer
+	Optimize     int
+	Backend      string
+
+	MaxInstructions int
+	MaxCallDepth    int
+	MaxStackSize    int
+	MaxMemory       int
+}
+
+// The bytecode backend decodes and runs one instruction at a time, the
+// closures backend compiles each function's syntax tree into Go closures
+const (
+	BackendBytecode = "bytecode"
+	BackendClosures = "closures"
+)
+
+// Closures says whether scripts are run as closures. Counting or tracing
+// instructions needs bytecode, so with either of those they run as bytecode
+// whatever the backend
+func (options Options) Closures() bool {
+	return options.Backend == BackendClosures && !options.Trace && options.MaxInstructions == 0
+}
+
+func (options Options) Writer() io.Writer {
+	if options.Output == nil {
+		return os.Stderr
+	}
+
+	return options.Output
+}
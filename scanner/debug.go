@@ -2,7 +2,7 @@ package scanner
 
 import (
 	"fmt"
-	"os"
+	"io"
 )
 
 func (tt TokenType) String() string {
@@ -77,6 +77,28 @@ func (tt TokenType) String() string {
 		return "TokenAnd"
 	case TokenOr:
 		return "TokenOr"
+	case TokenAmpersand:
+		return "TokenAmpersand"
+	case TokenPipe:
+		return "TokenPipe"
+	case TokenTilde:
+		return "TokenTilde"
+	case TokenTildeEqual:
+		return "TokenTildeEqual"
+	case TokenLessLess:
+		return "TokenLessLess"
+	case TokenGreaterGreater:
+		return "TokenGreaterGreater"
+	case TokenHash:
+		return "TokenHash"
+	case TokenBreak:
+		return "TokenBreak"
+	case TokenCaret:
+		return "TokenCaret"
+	case TokenFor:
+		return "TokenFor"
+	case TokenIn:
+		return "TokenIn"
 	case TokenLeftBrace:
 		return "TokenLeftBrace"
 	case TokenRightBrace:
@@ -98,15 +120,14 @@ func (t Token) String() string {
 	return fmt.Sprintf("%v/\"%v\"", t.Type, t.Text)
 }
 
-// todo: if using goroutines to publish tokens, how to debug?
-func DebugTokens(tokens []Token) {
-	for _, token := range tokens {
-		if token.Type == TokenSemicolon {
-			fmt.Fprintln(os.Stderr, ";")
-			continue
-		}
-		fmt.Fprint(os.Stderr, token, " ")
+// Tokens are printed as they are scanned, a line at a time
+func DebugToken(out io.Writer, token Token) {
+	switch token.Type {
+	case TokenSemicolon:
+		fmt.Fprintln(out, ";")
+	case TokenEof:
+		fmt.Fprintln(out, token)
+	default:
+		fmt.Fprint(out, token, " ")
 	}
-
-	fmt.Fprintln(os.Stderr)
 }
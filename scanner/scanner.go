@@ -9,24 +9,171 @@ import (
 )
 
 type Token struct {
-	Text string
-	Type TokenType
-	Line int
+	Text   string
+	Type   TokenType
+	Line   int
+	Column int
+	Offset int
+	Length int
+}
+
+func (token Token) Span() glerror.Span {
+	return glerror.Span{
+		Line:   token.Line,
+		Column: token.Column,
+		Offset: token.Offset,
+		Length: token.Length,
+	}
 }
 
 type TokenType int
 
+// Describe names the token type the way it is written in the source, for
+// error messages like "Expected 'then' after if condition"
+func (tt TokenType) Describe() string {
+	switch tt {
+	case TokenIdentifier:
+		return "identifier"
+	case TokenNumber:
+		return "number"
+	case TokenString:
+		return "string"
+	case TokenEof:
+		return "'<eof>'"
+	case TokenAmpersand:
+		return "'&'"
+	case TokenAnd:
+		return "'and'"
+	case TokenAssert:
+		return "'assert'"
+	case TokenBang:
+		return "'!'"
+	case TokenBreak:
+		return "'break'"
+	case TokenCaret:
+		return "'^'"
+	case TokenComma:
+		return "','"
+	case TokenDo:
+		return "'do'"
+	case TokenDot:
+		return "'.'"
+	case TokenElse:
+		return "'else'"
+	case TokenEnd:
+		return "'end'"
+	case TokenEqual:
+		return "'='"
+	case TokenEqualEqual:
+		return "'=='"
+	case TokenFalse:
+		return "'false'"
+	case TokenFor:
+		return "'for'"
+	case TokenFunction:
+		return "'function'"
+	case TokenGlobal:
+		return "'global'"
+	case TokenGreater:
+		return "'>'"
+	case TokenGreaterEqual:
+		return "'>='"
+	case TokenGreaterGreater:
+		return "'>>'"
+	case TokenHash:
+		return "'#'"
+	case TokenIf:
+		return "'if'"
+	case TokenIn:
+		return "'in'"
+	case TokenLeftBrace:
+		return "'{'"
+	case TokenLeftBracket:
+		return "'['"
+	case TokenLeftParen:
+		return "'('"
+	case TokenLess:
+		return "'<'"
+	case TokenLessEqual:
+		return "'<='"
+	case TokenLessLess:
+		return "'<<'"
+	case TokenLocal:
+		return "'local'"
+	case TokenMinus:
+		return "'-'"
+	case TokenNil:
+		return "'nil'"
+	case TokenOr:
+		return "'or'"
+	case TokenPipe:
+		return "'|'"
+	case TokenPlus:
+		return "'+'"
+	case TokenReturn:
+		return "'return'"
+	case TokenRightBrace:
+		return "'}'"
+	case TokenRightBracket:
+		return "']'"
+	case TokenRightParen:
+		return "')'"
+	case TokenSemicolon:
+		return "';'"
+	case TokenSlash:
+		return "'/'"
+	case TokenStar:
+		return "'*'"
+	case TokenThen:
+		return "'then'"
+	case TokenTilde:
+		return "'~'"
+	case TokenTildeEqual:
+		return "'~='"
+	case TokenTrue:
+		return "'true'"
+	case TokenWhile:
+		return "'while'"
+	default:
+		return tt.String()
+	}
+}
+
+// Describe quotes the token as it was found in the source
+func (token Token) Describe() string {
+	switch token.Type {
+	case TokenEof:
+		return "'<eof>'"
+	case TokenString:
+		return fmt.Sprintf("%q", token.Text)
+	default:
+		return fmt.Sprintf("'%s'", token.Text)
+	}
+}
+
+// `text` is the line being read, which starts at `lineOffset`, and
+// `startRest` is how much of the line a token started on was left after it
 type scanner struct {
-	reader *bufio.Reader
-	line   int
-	err    glerror.GluaErrorChain
+	reader     *bufio.Reader
+	line       int
+	column     int
+	offset     int
+	lineOffset int
+	start      glerror.Span
+	startRest  int
+	source     *glerror.Source
+	text       []rune
+	end        *Token
+	err        glerror.GluaErrorChain
 }
 
 const (
 	TokenError = iota
+	TokenAmpersand
 	TokenAnd
 	TokenAssert
 	TokenBang
+	TokenBreak
 	TokenCaret
 	TokenComma
 	TokenDo
@@ -42,6 +189,8 @@ const (
 	TokenGlobal
 	TokenGreater
 	TokenGreaterEqual
+	TokenGreaterGreater
+	TokenHash
 	TokenIdentifier
 	TokenIf
 	TokenIn
@@ -50,11 +199,13 @@ const (
 	TokenLeftParen
 	TokenLess
 	TokenLessEqual
+	TokenLessLess
 	TokenLocal
 	TokenMinus
 	TokenNil
 	TokenNumber
 	TokenOr
+	TokenPipe
 	TokenPlus
 	TokenReturn
 	TokenRightBrace
@@ -65,33 +216,67 @@ const (
 	TokenStar
 	TokenString
 	TokenThen
+	TokenTilde
 	TokenTildeEqual
 	TokenTrue
 	TokenWhile
 )
 
-func Scanner(reader *bufio.Reader) *scanner {
+// The name is recorded on the source so errors can say which file they are in
+func Scanner(name string, reader *bufio.Reader) *scanner {
+	return ScannerAt(name, reader, nil)
+}
+
+// Like Scanner, for a reader that starts at the beginning of `text`, which
+// errors read lines back from once the source no longer holds them
+func ScannerAt(name string, reader *bufio.Reader, text io.ReaderAt) *scanner {
 	return &scanner{
 		reader: reader,
 		err:    glerror.GluaErrorChain{},
 		line:   1,
+		column: 1,
+		source: glerror.NewSource(name, text),
 	}
 }
 
-// todo: goroutine publishes one token at a time?
-func (scanner *scanner) ScanTokens() ([]Token, glerror.GluaErrorChain) {
-	var tokens []Token
+// Source has a line for every line read so far, it is complete once the EOF
+// token has been scanned
+func (scanner *scanner) Source() *glerror.Source {
+	return scanner.source
+}
+
+// Errors are kept rather than stopping the compiler, which sees an EOF token
+// after any error the scanner can't go on from
+func (scanner *scanner) Errors() glerror.GluaErrorChain {
+	return scanner.err
+}
+
+// Tokens are scanned one at a time, see TokenStream
+func (scanner *scanner) Tokens() *TokenStream {
+	return &TokenStream{scanner: scanner}
+}
+
+// Once the source ends every token after that is the EOF token, which is
+// placed at the end so the compiler can point there
+func (scanner *scanner) next() Token {
+	if scanner.end != nil {
+		return *scanner.end
+	}
 
 	token, err := scanner.scanToken()
-	for ; err == nil; token, err = scanner.scanToken() {
-		tokens = append(tokens, token)
+	if err == nil {
+		return token
 	}
 
-	if err == io.EOF {
-		return tokens, scanner.err
+	if err != io.EOF {
+		scanner.markStart()
+		token = scanner.makeToken("", TokenEof)
 	}
 
-	return tokens, scanner.err
+	scanner.flushLine()
+	scanner.end = &token
+
+	return token
 }
 
 func (scanner *scanner) peekRune() (rune, error) {
@@ -117,7 +302,7 @@ func (scanner *scanner) peekRune() (rune, error) {
 }
 
 func (scanner *scanner) scanRune() (rune, error) {
-	r, _, err := scanner.reader.ReadRune()
+	r, size, err := scanner.reader.ReadRune()
 
 	if err == io.EOF {
 		return 0, err
@@ -128,9 +313,39 @@ func (scanner *scanner) scanRune() (rune, error) {
 		return 0, err
 	}
 
+	scanner.offset += size
+
+	if r == '\n' {
+		scanner.flushLine()
+		scanner.line += 1
+		scanner.column = 1
+		scanner.lineOffset = scanner.offset
+	} else {
+		scanner.text = append(scanner.text, r)
+		scanner.column += 1
+	}
+
 	return r, nil
 }
 
+func (scanner *scanner) flushLine() {
+	if scanner.line == scanner.start.Line {
+		scanner.startRest = len(scanner.text) - scanner.start.Column + 1
+	}
+
+	scanner.source.AddLine(string(scanner.text), scanner.lineOffset)
+	scanner.text = nil
+}
+
+// markStart records where the next token begins
+func (scanner *scanner) markStart() {
+	scanner.start = glerror.Span{
+		Line:   scanner.line,
+		Column: scanner.column,
+		Offset: scanner.offset,
+	}
+}
+
 func (scanner *scanner) advance() (ok bool) {
 	_, err := scanner.scanRune()
 
@@ -138,14 +353,6 @@ func (scanner *scanner) advance() (ok bool) {
 	return
 }
 
-func (scanner *scanner) revert() {
-	err := scanner.reader.UnreadRune()
-
-	if err != nil {
-		scanner.error(err.Error())
-	}
-}
-
 func (scanner *scanner) check(r rune) bool {
 	next, err := scanner.peekRune()
 
@@ -159,6 +366,8 @@ func (scanner *scanner) check(r rune) bool {
 
 func (scanner *scanner) skipWhitespace() *Token {
 	for r, err := scanner.peekRune(); err == nil; r, err = scanner.peekRune() {
+		scanner.markStart()
+
 		if r == '/' {
 			if scanner.consumeComment() {
 				return nil
@@ -171,10 +380,6 @@ func (scanner *scanner) skipWhitespace() *Token {
 			return nil
 		}
 
-		if r == '\n' {
-			scanner.line += 1
-		}
-
 		scanner.advance()
 	}
 
@@ -209,6 +414,8 @@ func (scanner *scanner) scanToken() (Token, error) {
 		return *token, nil
 	}
 
+	scanner.markStart()
+
 	r, err := scanner.peekRune()
 	switch {
 	case err == io.EOF:
@@ -218,7 +425,7 @@ func (scanner *scanner) scanToken() (Token, error) {
 		return scanner.makeToken("", TokenError), nil
 	case isNumber(r):
 		return scanner.scanNumber()
-	case isAlpha(r):
+	case isAlpha(r) || r == '_':
 		return scanner.scanWord()
 	case scanner.check('+'):
 		return scanner.makeToken("+", TokenPlus), nil
@@ -232,15 +439,21 @@ func (scanner *scanner) scanToken() (Token, error) {
 		return scanner.makeToken(";", TokenSemicolon), nil
 	case scanner.check('!'):
 		return scanner.makeToken("!", TokenBang), nil
+	case scanner.check('#'):
+		return scanner.makeToken("#", TokenHash), nil
 	case scanner.check('<'):
 		if scanner.check('=') {
 			return scanner.makeToken("<=", TokenLessEqual), nil
+		} else if scanner.check('<') {
+			return scanner.makeToken("<<", TokenLessLess), nil
 		} else {
 			return scanner.makeToken("<", TokenLess), nil
 		}
 	case scanner.check('>'):
 		if scanner.check('=') {
 			return scanner.makeToken(">=", TokenGreaterEqual), nil
+		} else if scanner.check('>') {
+			return scanner.makeToken(">>", TokenGreaterGreater), nil
 		} else {
 			return scanner.makeToken(">", TokenGreater), nil
 		}
@@ -250,6 +463,18 @@ func (scanner *scanner) scanToken() (Token, error) {
 		} else {
 			return scanner.makeToken("=", TokenEqual), nil
 		}
+	case scanner.check('~'):
+		if scanner.check('=') {
+			return scanner.makeToken("~=", TokenTildeEqual), nil
+		} else {
+			return scanner.makeToken("~", TokenTilde), nil
+		}
+	case scanner.check('&'):
+		return scanner.makeToken("&", TokenAmpersand), nil
+	case scanner.check('|'):
+		return scanner.makeToken("|", TokenPipe), nil
+	case scanner.check('^'):
+		return scanner.makeToken("^", TokenCaret), nil
 	case scanner.check('"'):
 		return scanner.scanString()
 	case scanner.check('{'):
@@ -275,34 +500,64 @@ func (scanner *scanner) scanToken() (Token, error) {
 	}
 }
 
+// Tokens are placed where markStart was last called, a token that runs onto
+// another line (an unterminated string) is only underlined to the line end
 func (scanner *scanner) makeToken(name string, tt TokenType) Token {
 	return Token{
-		Text: name,
-		Type: tt,
-		Line: scanner.line,
+		Text:   name,
+		Type:   tt,
+		Line:   scanner.start.Line,
+		Column: scanner.start.Column,
+		Offset: scanner.start.Offset,
+		Length: scanner.length(),
 	}
 }
 
+func (scanner *scanner) length() int {
+	if scanner.line != scanner.start.Line {
+		return scanner.startRest
+	}
+
+	return scanner.column - scanner.start.Column
+}
+
+// Numbers without a decimal point or exponent are scanned as integers,
+// the compiler decides the subtype by looking at the token text
 func (scanner *scanner) scanNumber() (Token, error) {
 	var runes []rune
 
-	// todo: decimals
-	r, err := scanner.scanRune()
-	for ; err == nil && isNumber(r) || r == '_'; r, err = scanner.scanRune() {
-		if r == '_' {
-			continue
-		}
+	if scanner.check('0') {
+		runes = append(runes, '0')
 
-		runes = append(runes, r)
+		if scanner.check('x') || scanner.check('X') {
+			return scanner.scanHex()
+		}
 	}
 
-	// On EOF, just unread the EOF and let the next skipWhitespace pick it up
-	if err != nil && err != io.EOF {
-		return scanner.makeToken(string(runes), TokenError), err
+	runes = scanner.scanDigits(runes, isNumber)
+
+	if scanner.peekDecimal() {
+		scanner.advance()
+		runes = append(runes, '.')
+		runes = scanner.scanDigits(runes, isNumber)
 	}
 
-	if err != io.EOF {
-		scanner.revert()
+	if scanner.check('e') || scanner.check('E') {
+		runes = append(runes, 'e')
+
+		if scanner.check('-') {
+			runes = append(runes, '-')
+		} else if scanner.check('+') {
+			runes = append(runes, '+')
+		}
+
+		exponent := scanner.scanDigits(nil, isNumber)
+		if len(exponent) == 0 {
+			scanner.error(fmt.Sprint("Malformed number near '", string(runes), "'"))
+			return scanner.makeToken(string(runes), TokenError), scanner.err
+		}
+
+		runes = append(runes, exponent...)
 	}
 
 	return scanner.makeToken(
@@ -311,11 +566,42 @@ func (scanner *scanner) scanNumber() (Token, error) {
 	), nil
 }
 
+func (scanner *scanner) scanHex() (Token, error) {
+	digits := scanner.scanDigits(nil, isHex)
+
+	if len(digits) == 0 {
+		scanner.error("Malformed number near '0x'")
+		return scanner.makeToken("0x", TokenError), scanner.err
+	}
+
+	return scanner.makeToken("0x"+string(digits), TokenNumber), nil
+}
+
+// Digits may be separated by underscores, which are dropped from the token
+func (scanner *scanner) scanDigits(runes []rune, isDigit func(rune) bool) []rune {
+	for r, err := scanner.peekRune(); err == nil && (isDigit(r) || r == '_'); r, err = scanner.peekRune() {
+		scanner.advance()
+
+		if r != '_' {
+			runes = append(runes, r)
+		}
+	}
+
+	return runes
+}
+
+// A '.' only continues a number if a digit follows, the bufio reader can only
+// unread one rune so look at the raw bytes instead
+func (scanner *scanner) peekDecimal() bool {
+	bytes, err := scanner.reader.Peek(2)
+
+	return err == nil && bytes[0] == '.' && isNumber(rune(bytes[1]))
+}
+
 func (scanner *scanner) scanString() (Token, error) {
 	var literal []rune
 	for r, err := scanner.scanRune(); err == nil && r != '"'; r, err = scanner.scanRune() {
 		if r == '\n' {
-			scanner.line += 1
 			scanner.error("Newline in string literal")
 			return scanner.makeToken(string(literal), TokenError), scanner.err
 		}
@@ -360,7 +646,7 @@ func (scanner *scanner) scanEscape() (rune, error) {
 
 func (scanner *scanner) scanWord() (Token, error) {
 	var word []rune
-	for c, err := scanner.peekRune(); err == nil && isAlpha(c) || isNumber(c); c, err = scanner.peekRune() {
+	for c, err := scanner.peekRune(); err == nil && (isAlpha(c) || isNumber(c) || c == '_'); c, err = scanner.peekRune() {
 		word = append(word, c)
 		if !scanner.advance() {
 			break
@@ -407,6 +693,8 @@ func (scanner *scanner) scanWord() (Token, error) {
 		return scanner.makeToken(source, TokenFunction), nil
 	case "return":
 		return scanner.makeToken(source, TokenReturn), nil
+	case "break":
+		return scanner.makeToken(source, TokenBreak), nil
 	default:
 		return scanner.makeToken(source, TokenIdentifier), nil
 	}
@@ -422,24 +710,33 @@ func isNumber(r rune) bool {
 	}
 }
 
+func isHex(r rune) bool {
+	lower := unicode.ToLower(r)
+	return isNumber(r) || 'a' <= lower && 'f' >= lower
+}
+
 func isAlpha(r rune) bool {
 	lower := unicode.ToLower(r)
 	return 'a' <= lower && 'z' >= lower
 }
 
 func (scanner *scanner) error(message string) {
+	span := scanner.start
+	span.Length = scanner.length()
+
 	scanner.err.Append(ScanError{
 		message: message,
-		line:    scanner.line,
+		span:    span,
+		source:  scanner.source,
 	})
 }
 
 type ScanError struct {
 	message string
-	line    int
+	span    glerror.Span
+	source  *glerror.Source
 }
 
-// todo: line numbers
 func (se ScanError) Error() string {
-	return fmt.Sprintf("Scan error [line=%d] ---> %s", se.line, se.message)
+	return glerror.Format("Scan error", se.message, se.source, se.span)
 }
@@ -0,0 +1,65 @@
+package scanner
+
+import "io"
+
+// A TokenStream hands the parser one token at a time, scanning each as it is
+// reached. Only the previous, current and next tokens are held, so compiling
+// a large file doesn't keep all of its tokens
+type TokenStream struct {
+	scanner  *scanner
+	previous Token
+	current  Token
+	next     Token
+	started  bool
+	peeked   bool
+	dump     io.Writer
+}
+
+// Dump prints each token to out as it is scanned
+func (stream *TokenStream) Dump(out io.Writer) {
+	stream.dump = out
+}
+
+func (stream *TokenStream) Current() Token {
+	if !stream.started {
+		stream.current = stream.scan()
+		stream.previous = stream.current
+		stream.started = true
+	}
+
+	return stream.current
+}
+
+func (stream *TokenStream) Peek() Token {
+	stream.Current()
+
+	if !stream.peeked {
+		stream.next = stream.scan()
+		stream.peeked = true
+	}
+
+	return stream.next
+}
+
+// Before the first Advance the previous token is the current one
+func (stream *TokenStream) Previous() Token {
+	stream.Current()
+	return stream.previous
+}
+
+func (stream *TokenStream) Advance() {
+	stream.previous = stream.Current()
+	stream.current = stream.Peek()
+	stream.peeked = false
+}
+
+func (stream *TokenStream) scan() Token {
+	token := stream.scanner.next()
+
+	// The scanner repeats the EOF token, it is only printed once
+	if stream.dump != nil && (token.Type != TokenEof || stream.current.Type != TokenEof) {
+		DebugToken(stream.dump, token)
+	}
+
+	return token
+}
@@ -1,16 +1,88 @@
 package value
 
 import (
+	"math"
 	"time"
 )
 
-func NewBuiltin(name string, f BuiltinFunc) *Builtin {
-	return &Builtin{
+func NewBuiltin(name string, f BuiltinFunc) Value {
+	return BuiltinValue(&Builtin{
 		Name:     name,
 		Function: f,
-	}
+	})
 }
 
 func Time(args []Value) Value {
-	return Number(time.Now().UnixNano())
+	return Integer(time.Now().UnixNano())
+}
+
+// SetMetatable sets (or with nil, removes) the metatable of a table and
+// returns the table
+func SetMetatable(args []Value) Value {
+	if len(args) == 0 {
+		return Nil()
+	}
+
+	if !args[0].IsTable() {
+		return Nil()
+	}
+
+	var metatable *Table
+	if len(args) > 1 && args[1].IsTable() {
+		metatable = args[1].AsTable()
+	}
+
+	args[0].AsTable().SetMetatable(metatable)
+	return args[0]
+}
+
+func GetMetatable(args []Value) Value {
+	if len(args) == 0 {
+		return Nil()
+	}
+
+	if !args[0].IsTable() || args[0].AsTable().Metatable() == nil {
+		return Nil()
+	}
+
+	return TableValue(args[0].AsTable().Metatable())
+}
+
+func MathLibrary() *Table {
+	library := NewTable()
+
+	library.Set(StringVal("type"), NewBuiltin("type", MathType))
+	library.Set(StringVal("tointeger"), NewBuiltin("tointeger", MathToInteger))
+	library.Set(StringVal("maxinteger"), Integer(math.MaxInt64))
+	library.Set(StringVal("mininteger"), Integer(math.MinInt64))
+
+	return library
+}
+
+// MathType returns "integer" or "float" for numbers and nil otherwise
+func MathType(args []Value) Value {
+	if len(args) == 0 {
+		return Nil()
+	}
+
+	switch args[0].Kind() {
+	case KindInteger:
+		return StringVal("integer")
+	case KindNumber:
+		return StringVal("float")
+	default:
+		return Nil()
+	}
+}
+
+func MathToInteger(args []Value) Value {
+	if len(args) == 0 {
+		return Nil()
+	}
+
+	if i, ok := ToInteger(args[0]); ok {
+		return Integer(i)
+	}
+
+	return Nil()
 }
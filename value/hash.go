@@ -0,0 +1,161 @@
+package value
+
+import "reflect"
+
+// The hash part of a table is open addressing with linear probing, with the
+// hash of each key taken from the value itself: strings carry theirs, numbers
+// and booleans use their bits and everything else its address. Removing a key
+// leaves it in place with a nil value, as Lua does, so probing for the keys
+// after it still finds them. Dead keys are dropped when the entries grow
+type hashPart struct {
+	entries []entry
+	count   int
+	used    int
+}
+
+type entry struct {
+	key   Value
+	value Value
+}
+
+// The entries are grown when more than this many eighths are in use
+const maxLoad = 6
+
+func hashKey(k Value) uint64 {
+	var hash uint64
+
+	switch k.kind {
+	case KindString:
+		return k.ref.(*stringObject).hash
+	case KindBoolean, KindInteger, KindNumber:
+		hash = k.bits
+	default:
+		hash = uint64(reflect.ValueOf(k.ref).Pointer())
+	}
+
+	// Spread out keys that differ only in their high bits, like floats
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+
+	return hash
+}
+
+func keysEqual(a, b Value) bool {
+	if a.kind != b.kind {
+		return false
+	}
+
+	switch a.kind {
+	case KindString:
+		return StringsEqual(a, b)
+	case KindBoolean, KindInteger, KindNumber:
+		return a.bits == b.bits
+	default:
+		return a.ref == b.ref
+	}
+}
+
+// The index of the key's entry, or of the empty entry that ends its probe
+func (h *hashPart) find(k Value) int {
+	mask := len(h.entries) - 1
+
+	for i := int(hashKey(k)) & mask; ; i = (i + 1) & mask {
+		key := h.entries[i].key
+
+		if key.kind == KindNil || keysEqual(key, k) {
+			return i
+		}
+	}
+}
+
+func (h *hashPart) get(k Value) (Value, bool) {
+	if h.count == 0 {
+		return Nil(), false
+	}
+
+	v := h.entries[h.find(k)].value
+	return v, !v.IsNil()
+}
+
+func (h *hashPart) set(k, v Value) {
+	if v.IsNil() {
+		h.delete(k)
+		return
+	}
+
+	if h.full(k) {
+		h.resize(h.count + 1)
+	}
+
+	i := h.find(k)
+	e := &h.entries[i]
+
+	if e.key.IsNil() {
+		e.key = k
+		h.used += 1
+	}
+
+	if e.value.IsNil() {
+		h.count += 1
+	}
+
+	e.value = v
+}
+
+func (h *hashPart) delete(k Value) {
+	if h.count == 0 {
+		return
+	}
+
+	e := &h.entries[h.find(k)]
+
+	if !e.value.IsNil() {
+		e.value = Nil()
+		h.count -= 1
+	}
+}
+
+// Whether the entries have to grow before k can be added. A key that is
+// already there keeps its entry, even when it's dead
+func (h *hashPart) full(k Value) bool {
+	if (h.used+1)*8 <= len(h.entries)*maxLoad {
+		return false
+	}
+
+	return len(h.entries) == 0 || h.entries[h.find(k)].key.IsNil()
+}
+
+// Makes room for at least `size` keys, leaving out the dead ones. There is
+// room for half as many again, so that a table whose keys keep changing
+// doesn't resize on every new one
+func (h *hashPart) resize(size int) {
+	capacity := 4
+	for (size+size/2)*8 > capacity*maxLoad {
+		capacity *= 2
+	}
+
+	entries := h.entries
+	h.entries = make([]entry, capacity)
+	h.count = 0
+	h.used = 0
+
+	for _, e := range entries {
+		if !e.value.IsNil() {
+			h.set(e.key, e.value)
+		}
+	}
+}
+
+func (h *hashPart) len() int {
+	return h.count
+}
+
+// Calls f on every key with a value, the table must not be changed meanwhile
+func (h *hashPart) each(f func(k, v Value)) {
+	for _, e := range h.entries {
+		if !e.value.IsNil() {
+			f(e.key, e.value)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package value
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Lua prints floats with "%.14g" and appends ".0" when the result would
+// otherwise be indistinguishable from an integer
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+
+	formatted := strconv.FormatFloat(f, 'g', 14, 64)
+	if strings.ContainsAny(formatted, ".e") {
+		return formatted
+	}
+
+	return formatted + ".0"
+}
+
+func IsNaN(v Value) bool {
+	return v.Kind() == KindNumber && math.IsNaN(v.AsNumber())
+}
+
+// FloatToInteger converts a float to an integer only if the conversion is
+// exact, following the Lua 5.4 rules for float -> integer coercion
+func FloatToInteger(f float64) (int64, bool) {
+	if math.Floor(f) != f {
+		return 0, false
+	}
+
+	// -2^63 is exactly representable, 2^63 is one past the max int64
+	if f < -(1<<63) || f >= (1<<63) {
+		return 0, false
+	}
+
+	return int64(f), true
+}
+
+// ToInteger converts a number to an integer for bitwise operations and
+// integer-only builtins, failing for non-numbers and non-integral floats
+func ToInteger(v Value) (int64, bool) {
+	switch v.Kind() {
+	case KindInteger:
+		return v.AsInteger(), true
+	case KindNumber:
+		return FloatToInteger(v.AsNumber())
+	default:
+		return 0, false
+	}
+}
+
+// Integer operands use intOp (when provided) so results wrap around rather
+// than lose precision, anything else with two numbers is done in floats. It
+// fails unless both operands are numbers
+func Arithmetic(a, b Value, intOp func(int64, int64) int64, floatOp func(float64, float64) float64) (Value, bool) {
+	switch {
+	case intOp != nil && a.IsInteger() && b.IsInteger():
+		return Integer(intOp(a.AsInteger(), b.AsInteger())), true
+	case a.IsNumber() && b.IsNumber():
+		return Number(floatOp(a.AsNumber(), b.AsNumber())), true
+	default:
+		return Nil(), false
+	}
+}
+
+func NumbersEqual(a, b Value) bool {
+	if a.IsInteger() && b.IsInteger() {
+		return a.AsInteger() == b.AsInteger()
+	}
+
+	if a.IsInteger() {
+		i, ok := FloatToInteger(b.AsNumber())
+		return ok && i == a.AsInteger()
+	}
+
+	if b.IsInteger() {
+		i, ok := FloatToInteger(a.AsNumber())
+		return ok && i == b.AsInteger()
+	}
+
+	return a.AsNumber() == b.AsNumber()
+}
+
+// NumberLess compares two numbers exactly, even when one is an integer
+// too large to be represented as a float without rounding
+func NumberLess(a, b Value) bool {
+	switch {
+	case a.IsInteger() && b.IsInteger():
+		return a.AsInteger() < b.AsInteger()
+	case a.IsInteger():
+		return integerLessFloat(a.AsInteger(), b.AsNumber())
+	case b.IsInteger():
+		return floatLessInteger(a.AsNumber(), b.AsInteger())
+	default:
+		return a.AsNumber() < b.AsNumber()
+	}
+}
+
+// NumberLessEqual is false when either number is NaN, so it isn't the same
+// as the negation of NumberLess with the operands swapped
+func NumberLessEqual(a, b Value) bool {
+	if IsNaN(a) || IsNaN(b) {
+		return false
+	}
+
+	return !NumberLess(b, a)
+}
+
+func integerLessFloat(i int64, f float64) bool {
+	switch {
+	case math.IsNaN(f):
+		return false
+	case f >= (1 << 63):
+		return true
+	case f < -(1 << 63):
+		return false
+	default:
+		// i < f <=> i < ceil(f) for any integer i
+		return i < int64(math.Ceil(f))
+	}
+}
+
+func floatLessInteger(f float64, i int64) bool {
+	switch {
+	case math.IsNaN(f):
+		return false
+	case f >= (1 << 63):
+		return false
+	case f < -(1 << 63):
+		return true
+	default:
+		// f < i <=> floor(f) < i for any integer i
+		return int64(math.Floor(f)) < i
+	}
+}
+
+// ShiftLeft is a logical shift, shifting by 64 or more in either
+// direction clears every bit and negative displacements shift right
+func ShiftLeft(x, y int64) int64 {
+	switch {
+	case y <= -64 || y >= 64:
+		return 0
+	case y >= 0:
+		return int64(uint64(x) << uint64(y))
+	default:
+		return int64(uint64(x) >> uint64(-y))
+	}
+}
+
+func ShiftRight(x, y int64) int64 {
+	if y <= -64 {
+		return 0
+	}
+
+	return ShiftLeft(x, -y)
+}
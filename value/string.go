@@ -0,0 +1,71 @@
+package value
+
+// A string value points to its text along with a hash worked out when the
+// string is made, so tables never hash a string key twice. Interned strings
+// with the same text share one object and compare equal by pointer
+type stringObject struct {
+	text string
+	hash uint64
+}
+
+// Only strings up to this length are interned, longer ones are rarely
+// compared or used as keys and would keep a lot of text alive
+const maxInternLength = 40
+
+func StringVal(s string) Value {
+	return Value{kind: KindString, ref: &stringObject{text: s, hash: hashString(s)}}
+}
+
+// FNV-1a
+func hashString(s string) uint64 {
+	hash := uint64(14695981039346656037)
+
+	for i := 0; i < len(s); i++ {
+		hash ^= uint64(s[i])
+		hash *= 1099511628211
+	}
+
+	return hash
+}
+
+func StringsEqual(a, b Value) bool {
+	x, y := a.ref.(*stringObject), b.ref.(*stringObject)
+	return x == y || (x.hash == y.hash && x.text == y.text)
+}
+
+// A VM keeps interning the strings of every script it runs and every string
+// builtins return, so the table is emptied once it holds this many
+const maxInterned = 1 << 16
+
+// Strings maps the text of each interned string to the string's value, so
+// that equal strings made at different times are the same object
+type Strings map[string]Value
+
+// Intern returns the interned string with the same text as the value, which
+// becomes the interned one if there's none yet. Anything other than a short
+// string is returned as it is. Strings interned before the table was last
+// emptied still compare equal to new ones, by their text instead of their
+// pointer
+func (strings Strings) Intern(v Value) Value {
+	if v.kind != KindString {
+		return v
+	}
+
+	text := v.ref.(*stringObject).text
+	if len(text) > maxInternLength {
+		return v
+	}
+
+	if interned, ok := strings[text]; ok {
+		return interned
+	}
+
+	if len(strings) >= maxInterned {
+		for text := range strings {
+			delete(strings, text)
+		}
+	}
+
+	strings[text] = v
+	return v
+}
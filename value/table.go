@@ -0,0 +1,306 @@
+package value
+
+import "math"
+
+// Tables keep the integer keys 1..n in a slice and everything else in a map,
+// like Lua does. Keys in the array's range are never in the hash, and the
+// last slot of the array is never empty so that it always ends at a border
+// unless the hash has the next key
+type Table struct {
+	array     []Value
+	hash      hashPart
+	position  int
+	metatable *Table
+	version   uint64
+}
+
+func NewTable() *Table {
+	return &Table{
+		array:    nil,
+		position: 0,
+	}
+}
+
+func (t *Table) Set(k, v Value) bool {
+	if k.IsNil() || IsNaN(k) {
+		return false
+	}
+
+	k = normalizeKey(k)
+	t.version += 1
+
+	if i := k.bits; k.kind == KindInteger && i >= 1 && i <= uint64(len(t.array)) {
+		t.setArray(int(i), v)
+		return true
+	}
+
+	if v.IsNil() {
+		t.hash.delete(k)
+		return true
+	}
+
+	if k.kind == KindInteger && k.bits == uint64(len(t.array))+1 {
+		// Shrinking the array in a rehash can leave the key in the hash
+		t.hash.delete(k)
+		t.append(v)
+		return true
+	}
+
+	// Like Lua, integer keys are moved into or out of the array when a new
+	// key doesn't fit in the hash part
+	if t.hash.full(k) {
+		t.rehash(k)
+
+		// The key may belong in the array now
+		if i := k.bits; k.kind == KindInteger && i >= 1 && i <= uint64(len(t.array))+1 {
+			return t.Set(k, v)
+		}
+	}
+
+	t.setHash(k, v)
+	return true
+}
+
+// The entries are only made once a key needs them, so tables used as
+// arrays never allocate any
+func (t *Table) setHash(k, v Value) {
+	t.hash.set(k, v)
+}
+
+func (t *Table) setArray(i int, v Value) {
+	t.array[i-1] = v
+
+	if v.IsNil() && i == len(t.array) {
+		t.trimArray()
+	}
+}
+
+// Appending to the array can join it with keys that were in the hash
+func (t *Table) append(v Value) {
+	t.array = append(t.array, v)
+
+	for {
+		next := Integer(int64(len(t.array) + 1))
+		v, ok := t.hash.get(next)
+
+		if !ok {
+			return
+		}
+
+		t.hash.delete(next)
+		t.array = append(t.array, v)
+	}
+}
+
+func (t *Table) trimArray() {
+	end := len(t.array)
+
+	for end > 0 && t.array[end-1].IsNil() {
+		end -= 1
+	}
+
+	t.array = t.array[:end]
+}
+
+// Picks the largest power of two n such that more than half of the keys
+// 1..n are in use, counting the key being added, and makes that the array
+func (t *Table) rehash(added Value) {
+	var bins [64]int
+	total := 0
+
+	countKey := func(k Value) {
+		if k.kind == KindInteger && k.AsInteger() >= 1 {
+			bins[ceilLog2(k.bits)] += 1
+			total += 1
+		}
+	}
+
+	for i, v := range t.array {
+		if !v.IsNil() {
+			countKey(Integer(int64(i + 1)))
+		}
+	}
+	t.hash.each(func(k, _ Value) {
+		countKey(k)
+	})
+	countKey(added)
+
+	size, inUse := 0, 0
+	for bin, twoToBin := 0, 1; bin < len(bins) && twoToBin/2 < total; bin, twoToBin = bin+1, twoToBin*2 {
+		inUse += bins[bin]
+
+		if inUse > twoToBin/2 {
+			size = twoToBin
+		}
+	}
+
+	t.resizeArray(size)
+
+	// Dead keys are dropped and the keys after this one get room
+	t.hash.resize(t.hash.len() + 1)
+}
+
+func (t *Table) resizeArray(size int) {
+	for i := size; i < len(t.array); i++ {
+		if !t.array[i].IsNil() {
+			t.setHash(Integer(int64(i+1)), t.array[i])
+			t.array[i] = Nil()
+		}
+	}
+
+	if size < len(t.array) {
+		t.array = t.array[:size]
+	}
+
+	for i := len(t.array); i < size; i++ {
+		key := Integer(int64(i + 1))
+		v, ok := t.hash.get(key)
+
+		if ok {
+			t.hash.delete(key)
+		}
+
+		t.array = append(t.array, v)
+	}
+
+	t.trimArray()
+}
+
+// The smallest b where i <= 2^b
+func ceilLog2(i uint64) int {
+	b := 0
+
+	for i > (uint64(1) << b) {
+		b += 1
+	}
+
+	return b
+}
+
+// Count is the number of entries in the table, not its length. The array can
+// have holes so this walks it
+func (t *Table) Count() int {
+	count := t.hash.len()
+
+	for _, v := range t.array {
+		if !v.IsNil() {
+			count += 1
+		}
+	}
+
+	return count
+}
+
+// Each calls f on every key with a value, the table must not be changed
+// meanwhile
+func (t *Table) Each(f func(k, v Value)) {
+	for i, v := range t.array {
+		if !v.IsNil() {
+			f(Integer(int64(i+1)), v)
+		}
+	}
+
+	t.hash.each(f)
+}
+
+// Insert sets the next positional item of a table constructor, so {a, b}
+// sets 1 and 2 whatever other keys the constructor has
+func (t *Table) Insert(v Value) {
+	t.position += 1
+	t.Set(Integer(int64(t.position)), v)
+}
+
+// Missing keys are nil, which is the zero Value
+func (t *Table) Get(k Value) Value {
+	k = normalizeKey(k)
+
+	if i := k.bits; k.kind == KindInteger && i >= 1 && i <= uint64(len(t.array)) {
+		return t.array[i-1]
+	}
+
+	v, _ := t.hash.get(k)
+	return v
+}
+
+// A Global is a name that code reads from its environment. It remembers the
+// value it last read along with the table it came from and the table's
+// version, which changes on every write, so reading it again before anything
+// is written skips the lookup
+type Global struct {
+	Name    Value
+	table   *Table
+	version uint64
+	value   Value
+}
+
+func NewGlobal(name Value) Global {
+	return Global{Name: name}
+}
+
+func (t *Table) GetGlobal(global *Global) Value {
+	if global.table == t && global.version == t.version {
+		return global.value
+	}
+
+	global.table = t
+	global.version = t.version
+	global.value = t.Get(global.Name)
+
+	return global.value
+}
+
+// Length is a border: t[n] is not nil and t[n+1] is, or 0 when t[1] is nil.
+// The array ends at one unless the keys after it are in the hash, those are
+// found by doubling and then a binary search as in Lua's luaH_getn
+func (t *Table) Length() int {
+	n := len(t.array)
+
+	if !t.hashHas(n + 1) {
+		return n
+	}
+
+	i, j := n+1, n+2
+	for t.hashHas(j) {
+		i = j
+
+		if j > math.MaxInt/2 {
+			// Pathological table, walk it instead
+			for t.hashHas(i + 1) {
+				i += 1
+			}
+
+			return i
+		}
+
+		j *= 2
+	}
+
+	for j-i > 1 {
+		m := (i + j) / 2
+
+		if t.hashHas(m) {
+			i = m
+		} else {
+			j = m
+		}
+	}
+
+	return i
+}
+
+func (t *Table) hashHas(i int) bool {
+	_, ok := t.hash.get(Integer(int64(i)))
+	return ok
+}
+
+// Floats with an exact integer representation are stored under the
+// integer key so that t[1] and t[1.0] refer to the same entry
+func normalizeKey(k Value) Value {
+	if k.kind == KindNumber {
+		if i, ok := FloatToInteger(k.AsNumber()); ok {
+			return Integer(i)
+		}
+	}
+
+	return k
+}
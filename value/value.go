@@ -1,391 +1,275 @@
 package value
 
 import (
+	"arlindohall/glua/glerror"
 	"fmt"
+	"math"
 )
 
-type Value interface {
-	String() string
-
-	IsNumber() bool
-	AsNumber() float64
-
-	IsBoolean() bool
-	AsBoolean() bool
-
-	IsString() bool
-	RawString() string
-
-	IsTable() bool
-	AsTable() *Table
-
-	IsClosure() bool
-	AsClosure() *Closure
-
-	IsBuiltin() bool
-	AsBuiltin() *Builtin
-
-	IsNil() bool
-}
-
-// Pointer points to the right spot in slice, ex: https://go.dev/play/p/NqAO9pOXy6B
-// so long as the slice isn't copied/moved
-type Upvalue struct {
-	Pointer *Value
-	Value   Value
-	IsLocal bool
-	Index   int
-}
-
-func (upvalue *Upvalue) Close() {
-	upvalue.Value = *upvalue.Pointer
-	upvalue.Pointer = &upvalue.Value
-}
-
-type StringVal string
-
-func (s StringVal) String() string {
-	return fmt.Sprintf("\"%s\"", string(s))
-}
-
-func (s StringVal) IsNumber() bool {
-	return false
-}
-
-func (s StringVal) AsNumber() float64 {
-	panic("Cannot coerce string to number")
-}
-
-func (s StringVal) IsBoolean() bool {
-	return false
-}
-
-func (s StringVal) AsBoolean() bool {
-	return true
-}
-
-func (s StringVal) IsString() bool {
-	return true
-}
-
-func (s StringVal) RawString() string {
-	return string(s)
-}
-
-func (s StringVal) IsNil() bool {
-	return false
-}
-
-func (s StringVal) IsTable() bool {
-	return false
-}
-
-func (s StringVal) AsTable() *Table {
-	panic("Internal error: cannot cast string as table.")
-}
-
-func (s StringVal) IsClosure() bool {
-	return false
-}
-
-func (s StringVal) AsClosure() *Closure {
-	panic("Internal error: cannot cast string as function")
-}
-
-func (s StringVal) IsBuiltin() bool {
-	return false
-}
-
-func (s StringVal) AsBuiltin() *Builtin {
-	panic("Internal error: cannot cast string as function")
-}
-
-type Number float64
-
-func (n Number) String() string {
-	return fmt.Sprint(float64(n))
-}
-
-func (n Number) IsNumber() bool {
-	return true
-}
-
-func (n Number) AsNumber() float64 {
-	return float64(n)
-}
+// Kind says which of a value's fields is in use
+type Kind uint8
+
+const (
+	KindNil Kind = iota
+	KindBoolean
+	KindInteger
+	KindNumber
+	KindString
+	KindTable
+	KindClosure
+	KindBuiltin
+)
 
-func (n Number) IsBoolean() bool {
-	return false
+// Values are copied around by the VM rather than boxed: booleans, integers
+// and floats are kept in bits so they never allocate, and strings, tables
+// and functions are held in ref. The zero Value is nil. Strings with the
+// same text are only == when they are interned, StringsEqual compares text
+type Value struct {
+	kind Kind
+	bits uint64
+	ref  interface{}
 }
 
-func (n Number) AsBoolean() bool {
-	return true
+func Nil() Value {
+	return Value{}
 }
 
-func (n Number) IsString() bool {
-	return false
-}
+func Boolean(b bool) Value {
+	if b {
+		return Value{kind: KindBoolean, bits: 1}
+	}
 
-func (n Number) RawString() string {
-	return fmt.Sprint(float64(n))
+	return Value{kind: KindBoolean, bits: 0}
 }
 
-func (n Number) IsNil() bool {
-	return false
+// Integer is the Lua 5.3+ integer subtype of number, arithmetic on two
+// integers wraps around on overflow instead of losing precision
+func Integer(i int64) Value {
+	return Value{kind: KindInteger, bits: uint64(i)}
 }
 
-func (n Number) IsTable() bool {
-	return false
+func Number(f float64) Value {
+	return Value{kind: KindNumber, bits: math.Float64bits(f)}
 }
 
-func (n Number) AsTable() *Table {
-	panic("Internal error: cannot cast number as table.")
+func TableValue(t *Table) Value {
+	return Value{kind: KindTable, ref: t}
 }
 
-func (n Number) IsClosure() bool {
-	return false
+func ClosureValue(closure *Closure) Value {
+	return Value{kind: KindClosure, ref: closure}
 }
 
-func (n Number) AsClosure() *Closure {
-	panic("Internal error: cannot cast number as function")
+func BuiltinValue(builtin *Builtin) Value {
+	return Value{kind: KindBuiltin, ref: builtin}
 }
 
-func (n Number) IsBuiltin() bool {
-	return false
+func (v Value) Kind() Kind {
+	return v.kind
 }
 
-func (n Number) AsBuiltin() *Builtin {
-	panic("Internal error: cannot cast number as function")
+func (v Value) String() string {
+	switch v.kind {
+	case KindNil:
+		return "<nil>"
+	case KindString:
+		return fmt.Sprintf("\"%s\"", v.RawString())
+	default:
+		return v.RawString()
+	}
 }
 
-type Boolean bool
-
-func (b Boolean) String() string {
-	return fmt.Sprint(bool(b))
+func (v Value) RawString() string {
+	switch v.kind {
+	case KindNil:
+		return "nil"
+	case KindBoolean:
+		return fmt.Sprint(v.bits == 1)
+	case KindInteger:
+		return fmt.Sprint(int64(v.bits))
+	case KindNumber:
+		return formatFloat(v.AsNumber())
+	case KindString:
+		return v.ref.(*stringObject).text
+	case KindTable:
+		// todo: this should be pretty-print with tracking
+		return fmt.Sprintf("Table<%p>", v.ref)
+	case KindClosure:
+		return fmt.Sprintf("Function<%s>", v.AsClosure().Name)
+	default:
+		return fmt.Sprintf("Function<%s>", v.AsBuiltin().Name)
+	}
 }
 
-func (b Boolean) IsNumber() bool {
-	return false
+// Integers are numbers too
+func (v Value) IsNumber() bool {
+	return v.kind == KindNumber || v.kind == KindInteger
 }
 
-func (b Boolean) AsNumber() float64 {
-	if bool(b) {
-		return 1
-	} else {
+func (v Value) AsNumber() float64 {
+	switch v.kind {
+	case KindNumber:
+		return math.Float64frombits(v.bits)
+	case KindInteger, KindBoolean:
+		return float64(int64(v.bits))
+	default:
 		return 0
 	}
 }
 
-func (n Boolean) IsBoolean() bool {
-	return true
-}
-
-func (b Boolean) AsBoolean() bool {
-	return bool(b)
-}
-
-func (b Boolean) IsString() bool {
-	return false
-}
-
-func (b Boolean) RawString() string {
-	return fmt.Sprint(bool(b))
-}
-
-func (b Boolean) IsNil() bool {
-	return false
-}
-
-func (b Boolean) IsTable() bool {
-	return false
-}
-
-func (b Boolean) AsTable() *Table {
-	panic("Internal error: cannot cast boolean as table.")
-}
-
-func (b Boolean) IsClosure() bool {
-	return false
-}
-
-func (b Boolean) AsClosure() *Closure {
-	panic("Internal error: cannot cast boolean as function")
-}
-
-func (b Boolean) IsBuiltin() bool {
-	return false
-}
-
-func (b Boolean) AsBuiltin() *Builtin {
-	panic("Internal error: cannot cast boolean as function")
-}
-
-type Nil struct{}
-
-func (n Nil) String() string {
-	return "<nil>"
-}
-
-func (n Nil) IsNumber() bool {
-	return false
-}
-
-func (n Nil) AsNumber() float64 {
-	return 0
-}
-
-func (n Nil) IsBoolean() bool {
-	return false
-}
-
-func (n Nil) AsBoolean() bool {
-	return false
-}
-
-func (n Nil) IsString() bool {
-	return false
-}
-
-func (n Nil) RawString() string {
-	return "nil"
+func (v Value) IsInteger() bool {
+	return v.kind == KindInteger
 }
 
-func (n Nil) IsNil() bool {
-	return true
-}
-
-func (n Nil) IsTable() bool {
-	return false
-}
+// Floats are truncated
+func (v Value) AsInteger() int64 {
+	if v.kind == KindNumber {
+		return int64(math.Float64frombits(v.bits))
+	}
 
-func (n Nil) AsTable() *Table {
-	panic("Internal error: cannot cast nil as table.")
+	return int64(v.bits)
 }
 
-func (n Nil) IsClosure() bool {
-	return false
+func (v Value) IsBoolean() bool {
+	return v.kind == KindBoolean
 }
 
-func (n Nil) AsClosure() *Closure {
-	return nil
+// Only nil and false are falsy
+func (v Value) AsBoolean() bool {
+	switch v.kind {
+	case KindNil:
+		return false
+	case KindBoolean:
+		return v.bits == 1
+	default:
+		return true
+	}
 }
 
-func (n Nil) IsBuiltin() bool {
-	return false
+func (v Value) IsString() bool {
+	return v.kind == KindString
 }
 
-func (n Nil) AsBuiltin() *Builtin {
-	panic("Internal error: cannot cast nil as function")
+func (v Value) IsNil() bool {
+	return v.kind == KindNil
 }
 
-type Table struct {
-	entries map[Value]Value
-	size    int
+func (v Value) IsTable() bool {
+	return v.kind == KindTable
 }
 
-func NewTable() *Table {
-	return &Table{
-		entries: make(map[Value]Value),
-		size:    0,
+func (v Value) AsTable() *Table {
+	if v.kind != KindTable {
+		panic(fmt.Sprint("Internal error: cannot cast ", v, " as table"))
 	}
-}
 
-func (t *Table) String() string {
-	// todo: this should be pretty-print with tracking
-	return fmt.Sprintf("Table<%p>", t)
+	return v.ref.(*Table)
 }
 
-func (t *Table) IsNumber() bool {
-	return false
+func (v Value) IsClosure() bool {
+	return v.kind == KindClosure
 }
 
-func (t *Table) AsNumber() float64 {
-	return 0
-}
-
-func (t *Table) IsBoolean() bool {
-	return false
-}
-
-func (t *Table) AsBoolean() bool {
-	return true
-}
+func (v Value) AsClosure() *Closure {
+	if v.kind != KindClosure {
+		panic(fmt.Sprint("Internal error: cannot cast ", v, " as function"))
+	}
 
-func (t *Table) IsString() bool {
-	return false
+	return v.ref.(*Closure)
 }
 
-func (t *Table) RawString() string {
-	return fmt.Sprintf("Table<%p>", t)
+func (v Value) IsBuiltin() bool {
+	return v.kind == KindBuiltin
 }
 
-func (t *Table) IsNil() bool {
-	return false
-}
+func (v Value) AsBuiltin() *Builtin {
+	if v.kind != KindBuiltin {
+		panic(fmt.Sprint("Internal error: cannot cast ", v, " as function"))
+	}
 
-func (t *Table) IsTable() bool {
-	return true
+	return v.ref.(*Builtin)
+}
+
+// Equal is the == operator. Numbers are equal by value whatever their kind,
+// tables and functions are never equal to anything
+func Equal(a, b Value) bool {
+	switch {
+	case a.IsNumber() && b.IsNumber():
+		return NumbersEqual(a, b)
+	case a.IsBoolean() && b.IsBoolean():
+		return a.AsBoolean() == b.AsBoolean()
+	case a.IsString() && b.IsString():
+		return StringsEqual(a, b)
+	default:
+		return a.IsNil() && b.IsNil()
+	}
 }
 
-func (t *Table) AsTable() *Table {
-	return t
+// An open upvalue refers to the variable by its absolute slot on the VM's
+// stack, the stack is a slice that moves when it grows so a pointer into it
+// would go stale. Closing copies the variable out so it outlives its frame
+type Upvalue struct {
+	Value Value
+	Slot  int
+	Open  bool
 }
 
-func (t *Table) IsClosure() bool {
-	return false
+func NewUpvalue(slot int) *Upvalue {
+	return &Upvalue{
+		Value: Nil(),
+		Slot:  slot,
+		Open:  true,
+	}
 }
 
-func (t *Table) AsClosure() *Closure {
-	return nil
+func (upvalue *Upvalue) Close(val Value) {
+	upvalue.Value = val
+	upvalue.Open = false
 }
 
-func (t *Table) IsBuiltin() bool {
-	return false
+func (t *Table) Metatable() *Table {
+	return t.metatable
 }
 
-func (t *Table) AsBuiltin() *Builtin {
-	panic("Internal error: cannot cast table as function")
+func (t *Table) SetMetatable(metatable *Table) {
+	t.metatable = metatable
 }
 
-func (t *Table) Set(k, v Value) bool {
-	if k == nil || k.IsNil() {
-		return false
-	}
-
-	if v == nil || v.IsNil() {
-		delete(t.entries, k)
-		return true
+// Metamethod looks up an event like "__close" in the value's metatable,
+// returning nil for values that have none
+func Metamethod(v Value, event string) Value {
+	if !v.IsTable() || v.AsTable().metatable == nil {
+		return Nil()
 	}
 
-	t.entries[k] = v
-	return true
-}
-
-func (t *Table) Insert(v Value) {
-	next := t.size + 1
-	t.entries[Number(next)] = v
-	t.size = next
-}
-
-func (t *Table) Get(k Value) Value {
-	v := t.entries[k]
-	if v == nil {
-		return Nil{}
-	} else {
-		return v
-	}
+	return v.AsTable().metatable.Get(StringVal(event))
 }
 
+// Source is the text the code was compiled from, and each instruction has a
+// span in Spans pointing back at the code that emitted it. Registers is the
+// number of stack slots a call needs, starting with the function itself and
+// its Arity parameters. Globals are the global names the code uses, closures
+// share them with the chunk they were made from. The compiler package has the
+// instruction encoding. Compiled is the code as a backend other than the
+// bytecode VM runs it, this package doesn't know what that looks like
 type Chunk struct {
-	Bytecode  []byte
-	Lines     []int
+	Source    *glerror.Source
+	Code      []uint32
+	Spans     []glerror.Span
 	Constants []Value
+	Globals   []Global
+	Registers int
+	Arity     int
+	Compiled  interface{}
 }
 
+// Env is the table that globals are read from and written to, closures
+// share the environment of the function that created them
 type Closure struct {
 	Chunk    Chunk
 	Name     string
 	Upvalues []*Upvalue
+	Env      *Table
 }
 
 func NewClosure(chunk Chunk, name string) *Closure {
@@ -393,65 +277,10 @@ func NewClosure(chunk Chunk, name string) *Closure {
 		Chunk:    chunk,
 		Name:     name,
 		Upvalues: nil,
+		Env:      nil,
 	}
 }
 
-func (closure *Closure) String() string {
-	return fmt.Sprintf("Function<%s>", closure.Name)
-}
-
-func (closure *Closure) IsNumber() bool {
-	return false
-}
-
-func (closure *Closure) AsNumber() float64 {
-	return 0
-}
-
-func (closure *Closure) IsBoolean() bool {
-	return false
-}
-
-func (closure *Closure) AsBoolean() bool {
-	return true
-}
-
-func (closure *Closure) IsString() bool {
-	return false
-}
-
-func (closure *Closure) RawString() string {
-	return closure.Name
-}
-
-func (closure *Closure) IsNil() bool {
-	return false
-}
-
-func (closure *Closure) IsTable() bool {
-	return true
-}
-
-func (closure *Closure) AsTable() *Table {
-	panic("Internal error: cannot cast table as function")
-}
-
-func (closure *Closure) IsClosure() bool {
-	return true
-}
-
-func (closure *Closure) AsClosure() *Closure {
-	return closure
-}
-
-func (closure *Closure) IsBuiltin() bool {
-	return false
-}
-
-func (closure *Closure) AsBuiltin() *Builtin {
-	panic("Internal error: cannot cast closure as builtin")
-}
-
 type BuiltinFunc func([]Value) Value
 
 // todo: multiple return
@@ -459,59 +288,3 @@ type Builtin struct {
 	Function BuiltinFunc
 	Name     string
 }
-
-func (builtin *Builtin) String() string {
-	return fmt.Sprintf("Function<%s>", builtin.Name)
-}
-
-func (builtin *Builtin) IsNumber() bool {
-	return false
-}
-
-func (builtin *Builtin) AsNumber() float64 {
-	return 0
-}
-
-func (builtin *Builtin) IsBoolean() bool {
-	return false
-}
-
-func (builtin *Builtin) AsBoolean() bool {
-	return true
-}
-
-func (builtin *Builtin) IsString() bool {
-	return false
-}
-
-func (builtin *Builtin) RawString() string {
-	return builtin.Name
-}
-
-func (builtin *Builtin) IsNil() bool {
-	return false
-}
-
-func (builtin *Builtin) IsTable() bool {
-	return true
-}
-
-func (builtin *Builtin) AsTable() *Table {
-	panic("Internal error: cannot cast function as table")
-}
-
-func (builtin *Builtin) IsClosure() bool {
-	return false
-}
-
-func (builtin *Builtin) AsClosure() *Closure {
-	panic(fmt.Sprint("Internal error: ", builtin.Name, " is not a function"))
-}
-
-func (builtin *Builtin) IsBuiltin() bool {
-	return true
-}
-
-func (builtin *Builtin) AsBuiltin() *Builtin {
-	return builtin
-}